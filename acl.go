@@ -0,0 +1,178 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// The classes of operations an ACL can be given for.
+const (
+	ACLQuery     = "query"     // any query
+	ACLTransfer  = "transfer"  // AXFR and IXFR queries
+	ACLUpdate    = "update"    // dynamic updates
+	ACLRecursion = "recursion" // queries that are forwarded to the nameservers
+	ACLDebug     = "debug"     // debug queries, see debugRecords
+)
+
+// ACL holds the CIDRs of the clients that are allowed or denied an operation.
+// Deny takes precedence over Allow. If Allow is empty every client not denied is allowed.
+type ACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Client IDs, see Config.ClientIdOption, that are allowed or denied, like the CIDRs.
+	AllowIds []string `json:"allow_ids,omitempty"`
+	DenyIds  []string `json:"deny_ids,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parse parses the CIDRs in the ACL.
+func (a *ACL) parse() (err error) {
+	if a.allow, err = parseCIDRs(a.Allow); err != nil {
+		return err
+	}
+	a.deny, err = parseCIDRs(a.Deny)
+	return err
+}
+
+// Allowed returns true if the client at ip, with the client ID id, is allowed
+// by the ACL. The id is "" when the client has none.
+func (a *ACL) Allowed(ip net.IP, id string) bool {
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if id != "" && contains(a.DenyIds, id) {
+		return false
+	}
+	if len(a.allow) == 0 && len(a.AllowIds) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return id != "" && contains(a.AllowIds, id)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// setACLs checks and parses the ACLs in the config. The CIDRs from
+// AllowRecursion are added to the recursion ACL.
+func setACLs(config *Config) error {
+	if config.ACL == nil {
+		config.ACL = make(map[string]*ACL)
+	}
+	if len(config.AllowRecursion) > 0 {
+		if config.ACL[ACLRecursion] == nil {
+			config.ACL[ACLRecursion] = new(ACL)
+		}
+		config.ACL[ACLRecursion].Allow = append(config.ACL[ACLRecursion].Allow, config.AllowRecursion...)
+	}
+	for op, a := range config.ACL {
+		switch op {
+		case ACLQuery, ACLTransfer, ACLUpdate, ACLRecursion, ACLDebug:
+		default:
+			return fmt.Errorf("unknown acl operation: %q", op)
+		}
+		if err := a.parse(); err != nil {
+			return fmt.Errorf("acl %s: %s", op, err)
+		}
+	}
+	return nil
+}
+
+// aclOperation returns the ACL class of operation req belongs to.
+func aclOperation(req *dns.Msg) string {
+	if req.Opcode == dns.OpcodeUpdate {
+		return ACLUpdate
+	}
+	if len(req.Question) > 0 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+		return ACLTransfer
+	}
+	return ACLQuery
+}
+
+// allowed checks the ACL for op and returns true if the client at addr, with
+// client ID id, is allowed. Denied requests are counted.
+func (s *server) allowed(op string, addr net.Addr, id string) bool {
+	a, ok := s.config.ACL[op]
+	if !ok || a.Allowed(clientIP(addr), id) {
+		return true
+	}
+	if c, ok := StatsACLDeniedCount[op]; ok {
+		c.Inc(1)
+	}
+	return false
+}
+
+// clientID returns the client ID in the EDNS0 option ClientIdOption of req, or
+// "" when there is none. IDs that are not printable ASCII are given in hex.
+func (config *Config) clientID(req *dns.Msg) string {
+	if config.ClientIdOption == 0 {
+		return ""
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == config.ClientIdOption {
+			for _, c := range l.Data {
+				if c < 0x20 || c > 0x7e {
+					return hex.EncodeToString(l.Data)
+				}
+			}
+			return string(l.Data)
+		}
+	}
+	return ""
+}
+
+// clientIP returns the IP address of the client at addr.
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// refused writes a REFUSED reply to req.
+func refused(w dns.ResponseWriter, req *dns.Msg) {
+	StatsRefusedCount.Inc(1)
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestACLAllowed(t *testing.T) {
+	tests := []struct {
+		acl     ACL
+		ip      string
+		allowed bool
+	}{
+		{ACL{}, "10.0.0.1", true},
+		{ACL{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3", true},
+		{ACL{Allow: []string{"10.0.0.0/8"}}, "192.168.0.1", false},
+		{ACL{Allow: []string{"10.0.0.0/8", "192.168.0.0/16"}}, "192.168.0.1", true},
+		{ACL{Deny: []string{"10.0.0.0/24"}}, "10.0.0.1", false},
+		{ACL{Deny: []string{"10.0.0.0/24"}}, "10.0.1.1", true},
+		// Deny takes precedence over Allow.
+		{ACL{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.0/24"}}, "10.0.0.1", false},
+		{ACL{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.0/24"}}, "10.0.1.1", true},
+		{ACL{Allow: []string{"2001:db8::/32"}}, "2001:db8::1", true},
+		{ACL{Allow: []string{"2001:db8::/32"}}, "2001:db9::1", false},
+		{ACL{Allow: []string{"2001:db8::/32"}}, "10.0.0.1", false},
+		{ACL{Allow: []string{"10.0.0.0/8"}}, "::ffff:10.0.0.1", true},
+		{ACL{Allow: []string{"0.0.0.0/0"}, Deny: []string{"10.0.0.1/32"}}, "10.0.0.1", false},
+	}
+	for i, tc := range tests {
+		a := tc.acl
+		if err := a.parse(); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if got := a.Allowed(net.ParseIP(tc.ip), ""); got != tc.allowed {
+			t.Errorf("%d: %s allowed is %t, want %t", i, tc.ip, got, tc.allowed)
+		}
+	}
+}
+
+func TestSetACLs(t *testing.T) {
+	tests := []struct {
+		acl map[string]*ACL
+		ok  bool
+	}{
+		{nil, true},
+		{map[string]*ACL{ACLQuery: {Allow: []string{"10.0.0.0/8"}}, ACLTransfer: {Deny: []string{"0.0.0.0/0"}}}, true},
+		{map[string]*ACL{"axfr": {Allow: []string{"10.0.0.0/8"}}}, false},
+		{map[string]*ACL{ACLQuery: {Allow: []string{"10.0.0.0"}}}, false},
+		{map[string]*ACL{ACLUpdate: {Deny: []string{"10.0.0.0/33"}}}, false},
+	}
+	for i, tc := range tests {
+		if err := setACLs(&Config{ACL: tc.acl}); tc.ok != (err == nil) {
+			t.Errorf("%d: expected ok to be %t, got %v", i, tc.ok, err)
+		}
+	}
+
+	config := &Config{AllowRecursion: []string{"10.0.0.0/8"}}
+	if err := setACLs(config); err != nil {
+		t.Fatal(err)
+	}
+	a := config.ACL[ACLRecursion]
+	if a == nil || a.Allowed(net.ParseIP("192.168.0.1"), "") || !a.Allowed(net.ParseIP("10.0.0.1"), "") {
+		t.Error("expected allow_recursion in the recursion ACL")
+	}
+}
+
+func TestACLOperation(t *testing.T) {
+	tests := []struct {
+		opcode int
+		qtype  uint16
+		op     string
+	}{
+		{dns.OpcodeQuery, dns.TypeA, ACLQuery},
+		{dns.OpcodeQuery, dns.TypeAXFR, ACLTransfer},
+		{dns.OpcodeQuery, dns.TypeIXFR, ACLTransfer},
+		{dns.OpcodeUpdate, dns.TypeSOA, ACLUpdate},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("skydns.test.", tc.qtype)
+		req.Opcode = tc.opcode
+		if op := aclOperation(req); op != tc.op {
+			t.Errorf("opcode %d, type %d: operation %s, want %s", tc.opcode, tc.qtype, op, tc.op)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// additional returns the A and AAAA records for the targets of the SRV records
+// in records that are not in extra yet. Targets in our domain are looked up in
+// etcd and the NS glue, others are resolved through the nameservers if
+// AdditionalForward is set and remote (with client ID id) may recurse. At most
+// AdditionalFanout targets are looked up at the same time.
+func (s *server) additional(ctx context.Context, records, extra []dns.RR, remote net.Addr, id, root string) []dns.RR {
+	seen := make(map[string]bool)
+	for _, r := range extra {
+		seen[strings.ToLower(r.Header().Name)] = true
+	}
+	fanout := s.config.AdditionalFanout
+	if fanout < 1 {
+		fanout = 1
+	}
+	var (
+		wg    sync.WaitGroup
+		found [][]dns.RR // per target, so the order follows records
+		sem   = make(chan struct{}, fanout)
+	)
+	for _, r := range records {
+		srv, ok := r.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		target := strings.ToLower(srv.Target)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		local := dns.IsSubDomain(s.config.Domain, target)
+		if !local && (!s.config.AdditionalForward || !s.allowed(ACLRecursion, remote, id)) {
+			continue
+		}
+		found = append(found, nil)
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if local {
+				found[i] = s.localAddresses(ctx, target, root)
+				return
+			}
+			found[i] = s.forwardAddresses(ctx, target)
+		}(len(found)-1, target)
+	}
+	wg.Wait()
+	var add []dns.RR
+	for _, rrs := range found {
+		add = append(add, rrs...)
+	}
+	return add
+}
+
+// localAddresses returns the A and AAAA records for name from the NS glue or etcd.
+func (s *server) localAddresses(ctx context.Context, name, root string) (rrs []dns.RR) {
+	_, glue := s.nsRecords()
+	for _, r := range glue {
+		if strings.ToLower(r.Header().Name) == name {
+			rrs = append(rrs, r)
+		}
+	}
+	if len(rrs) > 0 {
+		return rrs
+	}
+	// One lookup for both types.
+	sx, err := s.services(ctx, name, root)
+	if err != nil {
+		return rrs
+	}
+	for _, serv := range sx {
+		ip := net.ParseIP(serv.Host)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			rrs = append(rrs, serv.NewA(name, serv.ttl, ip.To4()))
+		default:
+			rrs = append(rrs, serv.NewAAAA(name, serv.ttl, ip.To16()))
+		}
+	}
+	return rrs
+}
+
+// forwardAddresses asks the nameservers for the A and AAAA records of name. Only
+// the address records owned by name itself are returned.
+func (s *server) forwardAddresses(ctx context.Context, name string) (rrs []dns.RR) {
+	nameservers := s.config.Nameservers
+	if len(nameservers) == 0 {
+		return nil
+	}
+	c := &dns.Client{Net: "udp", ReadTimeout: timeout(ctx, s.config.ReadTimeout)}
+	for i, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, t)
+		r, err := s.exchange(c, req, nameservers[i%len(nameservers)])
+		if err != nil || r.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, a := range r.Answer {
+			if a.Header().Rrtype == t && strings.EqualFold(a.Header().Name, name) {
+				rrs = append(rrs, a)
+			}
+		}
+	}
+	return rrs
+}
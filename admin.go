@@ -0,0 +1,232 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// The admin API listens on localhost only and allows:
+//
+//	POST /flush               flush the caches
+//	GET  /config              dump the current configuration
+//	GET  /records?name=<name> list the etcd records for name
+//	PUT  /records?name=<name> register the service in the body as name, see adminRegister
+//	GET  /log-level           the current log level
+//	POST /log-level?level=<l> set the log level: debug, info, warn or error
+//	GET  /healthz, /readyz    health and readiness, see health.go
+//	GET  /leader              are we the leader, see election.go
+//	GET  /prometheus/targets  the services as Prometheus targets, only when PrometheusSd is set
+//	GET  /debug/pprof/        runtime profiles, only when AdminPprof is set
+
+// runAdmin starts the admin HTTP API on addr, which must be a loopback address.
+func (s *server) runAdmin(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin_addr must be a loopback address: %q", addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flush", s.adminFlush)
+	mux.HandleFunc("/config", s.adminConfig)
+	mux.HandleFunc("/records", s.adminRecords)
+	mux.HandleFunc("/log-level", s.adminLogLevel)
+	s.healthHandlers(mux)
+	mux.HandleFunc("/leader", s.adminLeader)
+	if s.config.PrometheusSd {
+		mux.HandleFunc("/prometheus/targets", s.prometheusTargets)
+	}
+	if s.config.AdminPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(l, localOnly(mux)); err != nil {
+			s.config.log.Errorf("admin api failed: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// localOnly only lets requests from loopback addresses through to h.
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) adminFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cache.flush()
+	cur := s.current()
+	cur.rcache.flush()
+	cur.fcache.flush()
+	cur.scache.flush()
+	fmt.Fprintln(w, "flushed")
+}
+
+func (s *server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(s.current().config, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+type adminRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+func (s *server) adminRecords(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name parameter missing", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		s.adminRegister(w, r, name)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp, err := s.client.Get(PathNoWildcard(dns.Fqdn(name)), true, true)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	records := []adminRecord{}
+	var walk func(n *etcd.Node)
+	walk = func(n *etcd.Node) {
+		if n.Dir {
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+			return
+		}
+		records = append(records, adminRecord{Key: n.Key, Value: n.Value, TTL: n.TTL})
+	}
+	walk(resp.Node)
+	b, _ := json.MarshalIndent(records, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// adminRegister stores the service in the body of r as name, with the optional
+// ttl parameter as the TTL of the key. With AdminTokens r needs a token for
+// name. Services that would not answer, like one with an invalid host or a
+// port out of range, are rejected with the problems.
+func (s *server) adminRegister(w http.ResponseWriter, r *http.Request, name string) {
+	config := s.current().config
+	name = strings.ToLower(dns.Fqdn(name))
+	if _, ok := dns.IsDomainName(name); !ok || !dns.IsSubDomain(config.Domain, name) || name == config.Domain {
+		http.Error(w, fmt.Sprintf("invalid name %q: not a name in %s", name, config.Domain), http.StatusBadRequest)
+		return
+	}
+	who, status := config.authorize(r, name)
+	switch status {
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing or unknown token", status)
+		return
+	case http.StatusForbidden:
+		http.Error(w, fmt.Sprintf("token %s is not for %s", who, name), status)
+		return
+	}
+	var ttl uint64
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		var err error
+		if ttl, err = strconv.ParseUint(t, 10, 32); err != nil {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", t), http.StatusBadRequest)
+			return
+		}
+		if ttl > uint64(config.SoaExpire) {
+			http.Error(w, fmt.Sprintf("ttl %d is longer than the SOA expire (%d)", ttl, config.SoaExpire), http.StatusBadRequest)
+			return
+		}
+	}
+	serv := new(Service)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(serv); err != nil {
+		http.Error(w, fmt.Sprintf("invalid service: %s", err), http.StatusBadRequest)
+		return
+	}
+	if problems := serv.validate(name); len(problems) > 0 {
+		http.Error(w, "invalid service: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+	serv.Version = serviceVersion
+	b, _ := json.Marshal(serv)
+	resp, err := s.client.Set(PathNoWildcard(name), string(b), ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	before := ""
+	if resp != nil && resp.PrevNode != nil {
+		before = resp.PrevNode.Value
+	}
+	s.audit.record(who, "set", PathNoWildcard(name), before, string(b), ttl)
+	fmt.Fprintf(w, "%s %s\n", PathNoWildcard(name), b)
+}
+
+func (s *server) adminLeader(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%t\n", s.elector.isLeader())
+}
+
+func (s *server) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		p, err := parseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogLevel(p)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", getLogLevel())
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/go-log/log"
+)
+
+// Every change SkyDNS makes to the services, through the admin API, -import
+// or -migrate, is written to the audit log as a JSON line: when, who, what
+// and the value before and after. With AuditPrefix the entries are also
+// stored in etcd, as in-order keys below the prefix, so the changes made by
+// all SkyDNS instances end up in one place. The PTR records of Reverse are
+// managed by SkyDNS itself and not audited.
+
+type auditLog struct {
+	sync.Mutex
+	w      io.Writer // nil when only stored in etcd
+	client *etcd.Client
+	prefix string // AuditPrefix
+	log    *log.Logger
+}
+
+type auditEntry struct {
+	Time   string `json:"time"`
+	Who    string `json:"who"` // the admin token or client of the admin API, "import" or "migrate"
+	Op     string `json:"op"`  // set, create or swap
+	Key    string `json:"key"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after"`
+	TTL    uint64 `json:"ttl,omitempty"`
+}
+
+// newAuditLog returns the audit log of config, or nil when there is none.
+func newAuditLog(config *Config, client *etcd.Client) (*auditLog, error) {
+	if config.AuditLog == "" && config.AuditPrefix == "" {
+		return nil, nil
+	}
+	a := &auditLog{client: client, prefix: config.AuditPrefix, log: config.log}
+	if config.AuditLog != "" {
+		w, err := openLog(config.AuditLog, "audit", config.log)
+		if err != nil {
+			return nil, err
+		}
+		a.w = w
+	}
+	return a, nil
+}
+
+// record logs that who did op on key, which had the value before (or none)
+// and now has after, with ttl.
+func (a *auditLog) record(who, op, key, before, after string, ttl uint64) {
+	if a == nil {
+		return
+	}
+	e := auditEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Who:    who,
+		Op:     op,
+		Key:    key,
+		Before: before,
+		After:  after,
+		TTL:    ttl,
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if a.w != nil {
+		a.Lock()
+		a.w.Write(append(b, '\n'))
+		a.Unlock()
+	}
+	if a.prefix != "" {
+		if _, err := a.client.CreateInOrder(a.prefix, string(b), 0); err != nil {
+			a.log.Errorf("failure to store the audit entry for %s: %s", key, err.Error())
+		}
+	}
+}
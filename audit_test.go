@@ -0,0 +1,27 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var nilLog *auditLog
+	nilLog.record("import", "create", "/skydns/local/skydns/a", "", "{}", 0) // no audit log, no panic
+
+	buf := new(bytes.Buffer)
+	a := &auditLog{w: buf}
+	a.record("127.0.0.1:4711", "set", "/skydns/local/skydns/a", `{"host":"10.0.0.1"}`, `{"host":"10.0.0.2"}`, 60)
+	var e auditEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("audit entry is not JSON: %s", err)
+	}
+	if e.Who != "127.0.0.1:4711" || e.Op != "set" || e.Before != `{"host":"10.0.0.1"}` || e.After != `{"host":"10.0.0.2"}` || e.TTL != 60 || e.Time == "" {
+		t.Errorf("unexpected audit entry: %+v", e)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// With AdminTokens, registering a service with the admin API needs a bearer
+// token, and a token is only good for the names below its own subtrees. So
+// each team can be given a token for its part of the domain. The config holds
+// the SHA-256 of the tokens, not the tokens themselves, as it is stored in
+// etcd and dumped by GET /config.
+
+// AdminToken lets the holder of the token register the services of Names and
+// the names below them.
+type AdminToken struct {
+	Name string `json:"name"` // who holds the token, for the audit log
+	// The SHA-256 of the token, in hex.
+	Sha256 string   `json:"sha256"`
+	Names  []string `json:"names"`
+
+	sum []byte
+}
+
+// setAdminTokens checks the admin tokens in config.
+func setAdminTokens(config *Config) error {
+	seen := make(map[string]bool)
+	for _, t := range config.AdminTokens {
+		if t.Name == "" || seen[t.Name] {
+			return fmt.Errorf("admin token without a name, or a duplicate one: %q", t.Name)
+		}
+		seen[t.Name] = true
+		sum, err := hex.DecodeString(t.Sha256)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("admin token %s: sha256 is not a SHA-256 in hex", t.Name)
+		}
+		t.sum = sum
+		if len(t.Names) == 0 {
+			return fmt.Errorf("admin token %s: no names", t.Name)
+		}
+		for i, name := range t.Names {
+			name = dns.Fqdn(strings.ToLower(name))
+			if !dns.IsSubDomain(config.Domain, name) {
+				return fmt.Errorf("admin token %s: %s is not in domain %s", t.Name, name, config.Domain)
+			}
+			t.Names[i] = name
+		}
+	}
+	return nil
+}
+
+// authorize returns who may register name with r: the name of the token of r,
+// or the client address when there are no tokens. The status is not 0, but
+// 401 or 403, when the token is missing or unknown, or is not for name.
+func (config *Config) authorize(r *http.Request, name string) (who string, status int) {
+	if len(config.AdminTokens) == 0 {
+		return r.RemoteAddr, 0
+	}
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		return "", http.StatusUnauthorized
+	}
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(token, "Bearer ")))
+	for _, t := range config.AdminTokens {
+		if subtle.ConstantTimeCompare(sum[:], t.sum) != 1 {
+			continue
+		}
+		for _, n := range t.Names {
+			if dns.IsSubDomain(n, name) {
+				return t.Name, 0
+			}
+		}
+		return t.Name, http.StatusForbidden
+	}
+	return "", http.StatusUnauthorized
+}
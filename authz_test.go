@@ -0,0 +1,47 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	config := &Config{Domain: "skydns.local.", AdminTokens: []*AdminToken{
+		{Name: "web-team", Sha256: hex.EncodeToString(sum[:]), Names: []string{"Web.skydns.local"}},
+	}}
+	if err := setAdminTokens(config); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		auth, name string
+		who        string
+		status     int
+	}{
+		{"Bearer s3cret", "web.skydns.local.", "web-team", 0},
+		{"Bearer s3cret", "a.web.skydns.local.", "web-team", 0},
+		{"Bearer s3cret", "db.skydns.local.", "web-team", http.StatusForbidden},
+		{"Bearer wrong", "web.skydns.local.", "", http.StatusUnauthorized},
+		{"", "web.skydns.local.", "", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		r, _ := http.NewRequest("PUT", "/records?name="+tc.name, nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		if who, status := config.authorize(r, tc.name); who != tc.who || status != tc.status {
+			t.Errorf("%q for %s: got %q %d, want %q %d", tc.auth, tc.name, who, status, tc.who, tc.status)
+		}
+	}
+
+	config.AdminTokens[0].Names = []string{"example.org"}
+	if err := setAdminTokens(config); err == nil {
+		t.Error("expected an error for a name outside the domain")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// With a search list in resolv.conf (and ndots:5, as in Kubernetes) a client
+// tries web.default.svc.skydns.local.default.svc.skydns.local. and friends
+// before the name it wanted. Autopath answers such a query with a CNAME to
+// the name without the search suffix, saving the NXDOMAIN round-trips.
+
+// autopath returns the name in our domain that name, carrying a search suffix
+// that is also in our domain, is meant to be. It returns "" otherwise, or
+// when Autopath is off.
+func (config *Config) autopath(name string) string {
+	if !config.Autopath || !strings.HasSuffix(name, "."+config.Domain) {
+		return ""
+	}
+	end := strings.Index(name, "."+config.Domain) + 1 + len(config.Domain)
+	if end == len(name) {
+		return ""
+	}
+	return name[:end]
+}
+
+// autopathRecords returns the records of q for name, the name q is meant to be.
+func (s *server) autopathRecords(ctx context.Context, q dns.Question, name, root string) (records, extra []dns.RR, err error) {
+	q.Name = name
+	switch {
+	case q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA:
+		records, err = s.AddressRecords(ctx, q, root)
+	case q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY:
+		records, extra, err = s.SRVRecords(ctx, q, root)
+	default:
+		records, err = s.OtherRecords(ctx, q, root)
+	}
+	return records, extra, err
+}
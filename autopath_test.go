@@ -0,0 +1,22 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestAutopath(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Autopath: true}
+	for name, want := range map[string]string{
+		"web.default.svc.cluster.local.default.svc.cluster.local.": "web.default.svc.cluster.local.",
+		"web.default.svc.cluster.local.cluster.local.":             "web.default.svc.cluster.local.",
+		"web.default.svc.cluster.local.":                           "",
+		"cluster.local.cluster.local.":                             "",
+		"web.cluster.local.example.com.":                           "",
+	} {
+		if got := config.autopath(name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
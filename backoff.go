@@ -0,0 +1,53 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// etcdBackoffMax is the longest we wait before trying etcd again.
+const etcdBackoffMax = time.Minute
+
+// backoff is an exponential backoff with jitter: the n-th wait is a random
+// duration between half and all of min*2^n, at most max. This keeps the
+// replicas from retrying in lock step when etcd comes back.
+type backoff struct {
+	min, max time.Duration
+	n        uint
+}
+
+// next returns how long to wait before the next try.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.n < 32 && b.min<<b.n < b.max {
+		d = b.min << b.n
+		b.n++
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reset starts again from min, after a success.
+func (b *backoff) reset() { b.n = 0 }
+
+// etcdResult records in StatsEtcdUp whether etcd could be reached for the
+// result err, and logs when that changes.
+func (s *server) etcdResult(err error) {
+	down := int32(0)
+	if etcdFailure(err) {
+		down = 1
+	}
+	if atomic.SwapInt32(&s.etcdDown, down) == down {
+		return
+	}
+	StatsEtcdUp.Update(int64(1 - down))
+	if down == 1 {
+		s.config.log.Errorf("etcd can not be reached: %s", err.Error())
+		return
+	}
+	s.config.log.Noticef("etcd can be reached again")
+}
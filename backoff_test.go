@@ -0,0 +1,24 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second}
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10, 10} {
+		max *= time.Second
+		if d := b.next(); d < max/2 || d > max {
+			t.Errorf("try %d: expected between %s and %s, got %s", i, max/2, max, d)
+		}
+	}
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Errorf("expected at most 1s after reset, got %s", d)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// benchmark replays the queries in file against the nameserver at addr, or, when
+// s is not nil, against s, which is started and stopped for it. The report is
+// written to standard output.
+func benchmark(s *server, file, addr string, clients int, d time.Duration) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	queries, err := readQueries(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	if s != nil {
+		addr = strings.Split(s.config.DnsAddr, ",")[0]
+		go func() {
+			if err := s.Run(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		defer s.Stop()
+		for i := 0; !s.listening(); i++ {
+			if i == 50 {
+				return fmt.Errorf("listeners on %s not started", s.config.DnsAddr)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if clients < 1 {
+		clients = 1
+	}
+	fmt.Printf("sending the %d queries of %s to %s for %s from %d clients\n", len(queries), file, addr, d, clients)
+	bench(addr, queries, clients, d).report(os.Stdout)
+	return nil
+}
+
+// benchQuery is a query from a query file.
+type benchQuery struct {
+	name  string
+	qtype uint16
+}
+
+// readQueries reads a query file in the format of dnsperf: a name and a type
+// per line, i.e. "www.skydns.local A". Empty lines and lines starting with #
+// are skipped.
+func readQueries(r io.Reader) ([]benchQuery, error) {
+	var queries []benchQuery
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("line %d: want a name and a type: %q", i, line)
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(f[1])]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown type %q", i, f[1])
+		}
+		if _, ok := dns.IsDomainName(f[0]); !ok {
+			return nil, fmt.Errorf("line %d: invalid name %q", i, f[0])
+		}
+		queries = append(queries, benchQuery{dns.Fqdn(f[0]), qtype})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries")
+	}
+	return queries, nil
+}
+
+// benchResult is what bench measured.
+type benchResult struct {
+	sent      int
+	lost      int // timed out or failed
+	rcodes    map[int]int
+	latencies []time.Duration // of the answered queries
+	elapsed   time.Duration
+}
+
+// bench sends the queries, over and over, to the nameserver at addr for d,
+// from clients concurrent clients that each wait for the answer before they
+// send the next query.
+func bench(addr string, queries []benchQuery, clients int, d time.Duration) *benchResult {
+	res := &benchResult{rcodes: make(map[int]int)}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	start := time.Now()
+	deadline := start.Add(d)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &dns.Client{ReadTimeout: 2 * time.Second}
+			mine := &benchResult{rcodes: make(map[int]int)}
+			for j := i; time.Now().Before(deadline); j++ {
+				q := queries[j%len(queries)]
+				m := new(dns.Msg)
+				m.SetQuestion(q.name, q.qtype)
+				t := time.Now()
+				r, _, err := c.Exchange(m, addr)
+				mine.sent++
+				if err != nil || r == nil {
+					mine.lost++
+					continue
+				}
+				mine.latencies = append(mine.latencies, time.Since(t))
+				mine.rcodes[r.Rcode]++
+			}
+			mu.Lock()
+			res.sent += mine.sent
+			res.lost += mine.lost
+			res.latencies = append(res.latencies, mine.latencies...)
+			for rcode, n := range mine.rcodes {
+				res.rcodes[rcode] += n
+			}
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	sort.Sort(durations(res.latencies))
+	return res
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+
+// percentile returns the p-th percentile (0-100) of the sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// report writes the QPS, the latency percentiles and the rcodes of r to w.
+func (r *benchResult) report(w io.Writer) {
+	answered := len(r.latencies)
+	fmt.Fprintf(w, "queries sent:     %d\n", r.sent)
+	fmt.Fprintf(w, "queries answered: %d\n", answered)
+	fmt.Fprintf(w, "queries lost:     %d\n", r.lost)
+	fmt.Fprintf(w, "run time:         %s\n", r.elapsed)
+	fmt.Fprintf(w, "queries/s:        %.1f\n", float64(answered)/r.elapsed.Seconds())
+	if answered > 0 {
+		var sum time.Duration
+		for _, l := range r.latencies {
+			sum += l
+		}
+		fmt.Fprintf(w, "latency:          min %s, avg %s, p50 %s, p90 %s, p99 %s, max %s\n",
+			r.latencies[0], sum/time.Duration(answered), percentile(r.latencies, 50),
+			percentile(r.latencies, 90), percentile(r.latencies, 99), r.latencies[answered-1])
+	}
+	rcodes := make([]int, 0, len(r.rcodes))
+	for rcode := range r.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Ints(rcodes)
+	for _, rcode := range rcodes {
+		fmt.Fprintf(w, "rcode %-10s %d (%.1f%%)\n", dns.RcodeToString[rcode]+":", r.rcodes[rcode], 100*float64(r.rcodes[rcode])/float64(answered))
+	}
+}
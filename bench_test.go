@@ -0,0 +1,27 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadQueries(t *testing.T) {
+	queries, err := readQueries(strings.NewReader("# a comment\nwww.skydns.test A\n\n_http._tcp.skydns.test. srv\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 || queries[0] != (benchQuery{"www.skydns.test.", dns.TypeA}) || queries[1] != (benchQuery{"_http._tcp.skydns.test.", dns.TypeSRV}) {
+		t.Errorf("queries = %v", queries)
+	}
+	for _, bad := range []string{"www.skydns.test", "www.skydns.test BOGUS", ""} {
+		if _, err := readQueries(strings.NewReader(bad)); err == nil {
+			t.Errorf("readQueries(%q) gives no error", bad)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// What to do with a name that matches the blocklist.
+const (
+	policyNXDomain = iota // reply with NXDOMAIN, or the sinkhole address if configured
+	policyNoData          // reply with NODATA
+	policyPassthru        // allowed, handle the query as usual
+	policyLocal           // reply with the local data from the RPZ
+)
+
+type policy struct {
+	action int
+	rrs    []dns.RR // for policyLocal
+}
+
+// blocklist holds the names from the block and allow lists. Names are
+// matched exactly, names starting with "*." match everything below.
+type blocklist struct {
+	sync.RWMutex
+	names map[string]*policy
+	mtime map[string]time.Time // modification times of the files when last loaded
+}
+
+// loadBlocklist returns the blocklist for config, or nil when no lists are configured.
+func loadBlocklist(config *Config) (*blocklist, error) {
+	if len(config.Blocklists) == 0 && len(config.Allowlists) == 0 {
+		return nil, nil
+	}
+	return newBlocklist(config)
+}
+
+// newBlocklist loads the block and allow lists from config.
+func newBlocklist(config *Config) (*blocklist, error) {
+	b := &blocklist{mtime: make(map[string]time.Time)}
+	if err := b.load(config); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// load (re)reads all the lists from config and swaps them in.
+func (b *blocklist) load(config *Config) error {
+	names := make(map[string]*policy)
+	mtime := make(map[string]time.Time)
+	for i, files := range [][]string{config.Blocklists, config.Allowlists} {
+		for _, f := range files {
+			fi, err := os.Stat(f)
+			if err != nil {
+				return err
+			}
+			mtime[f] = fi.ModTime()
+			switch filepath.Ext(f) {
+			case ".rpz", ".zone":
+				err = readRPZ(f, names)
+			default:
+				action := policyNXDomain
+				if i == 1 {
+					action = policyPassthru
+				}
+				err = readHosts(f, names, action)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	b.Lock()
+	b.names = names
+	b.mtime = mtime
+	b.Unlock()
+	return nil
+}
+
+// changed returns true when one of the files was modified since it was loaded.
+func (b *blocklist) changed() bool {
+	b.RLock()
+	defer b.RUnlock()
+	for f, t := range b.mtime {
+		fi, err := os.Stat(f)
+		if err != nil || !fi.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the lists every interval when they have changed, until stop is closed.
+func (b *blocklist) watch(config *Config, interval time.Duration, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if !b.changed() {
+			continue
+		}
+		if err := b.load(config); err != nil {
+			config.log.Errorf("failure to reload blocklists: %s", err.Error())
+			continue
+		}
+		config.log.Info("reloaded blocklists")
+	}
+}
+
+// match returns the policy for name or nil when the name is not listed.
+// The passthru policies from the allow lists take precedence: a passthru
+// for a wildcard above name wins over a block of name itself. Otherwise the
+// exact name, then the nearest wildcard is used.
+func (b *blocklist) match(name string) *policy {
+	if b == nil {
+		return nil
+	}
+	b.RLock()
+	defer b.RUnlock()
+	if len(b.names) == 0 {
+		return nil
+	}
+	var first *policy
+	if p, ok := b.names[name]; ok {
+		if p.action == policyPassthru {
+			return p
+		}
+		first = p
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		p, ok := b.names["*."+dns.Fqdn(strings.Join(labels[i:], "."))]
+		if !ok {
+			continue
+		}
+		if p.action == policyPassthru {
+			return p
+		}
+		if first == nil {
+			first = p
+		}
+	}
+	return first
+}
+
+// readHosts reads a hosts-like file: each line holds an optional address
+// followed by one or more names. Comments start with a #.
+func readHosts(file string, names map[string]*policy, action int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, n := range fields {
+			n = dns.Fqdn(strings.ToLower(n))
+			if p, ok := names[n]; ok && p.action == policyPassthru {
+				continue
+			}
+			names[n] = &policy{action: action}
+		}
+	}
+	return scanner.Err()
+}
+
+// readRPZ reads a response policy zone. The origin of the zone is taken from
+// its SOA record and stripped from the names. Supported are the NXDOMAIN
+// (CNAME .), NODATA (CNAME *.) and PASSTHRU (CNAME rpz-passthru.) actions and
+// local data.
+func readRPZ(file string, names map[string]*policy) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	origin := ""
+	tokens := dns.ParseZone(f, "", file)
+	for t := range tokens {
+		if t.Error != nil {
+			for range tokens {
+				// Drain the channel so the parser can finish.
+			}
+			return t.Error
+		}
+		if soa, ok := t.RR.(*dns.SOA); ok && origin == "" {
+			origin = strings.ToLower(soa.Hdr.Name)
+			continue
+		}
+		if origin == "" || !dns.IsSubDomain(origin, t.RR.Header().Name) {
+			continue
+		}
+		n := strings.ToLower(t.RR.Header().Name)
+		n = dns.Fqdn(strings.TrimSuffix(strings.TrimSuffix(n, origin), "."))
+
+		p := &policy{action: policyLocal}
+		if cname, ok := t.RR.(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				p.action = policyNXDomain
+			case "*.":
+				p.action = policyNoData
+			case "rpz-passthru.":
+				p.action = policyPassthru
+			}
+		}
+		if p.action != policyLocal {
+			names[n] = p
+			continue
+		}
+		if old, ok := names[n]; ok && old.action == policyLocal {
+			p = old
+		}
+		p.rrs = append(p.rrs, t.RR)
+		names[n] = p
+	}
+	return nil
+}
+
+// ServeDNSBlocked writes the reply for a name that matched policy p
+// in the blocklist.
+func (s *server) ServeDNSBlocked(w dns.ResponseWriter, req *dns.Msg, p *policy) {
+	StatsBlockedCount.Inc(1)
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+
+	switch p.action {
+	case policyNXDomain:
+		sinkhole := net.ParseIP(s.config.BlocklistSinkhole)
+		if sinkhole == nil {
+			m.SetRcode(req, dns.RcodeNameError)
+			break
+		}
+		serv := new(Service)
+		switch {
+		case q.Qtype == dns.TypeA && sinkhole.To4() != nil:
+			m.Answer = append(m.Answer, serv.NewA(q.Name, s.config.MinTtl, sinkhole.To4()))
+		case q.Qtype == dns.TypeAAAA && sinkhole.To4() == nil:
+			m.Answer = append(m.Answer, serv.NewAAAA(q.Name, s.config.MinTtl, sinkhole))
+		}
+	case policyLocal:
+		for _, r := range p.rrs {
+			if r.Header().Rrtype != q.Qtype && r.Header().Rrtype != dns.TypeCNAME {
+				continue
+			}
+			r1 := dns.Copy(r)
+			r1.Header().Name = q.Name
+			m.Answer = append(m.Answer, r1)
+		}
+	}
+	w.WriteMsg(m)
+}
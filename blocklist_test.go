@@ -0,0 +1,142 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testHosts = `# ads
+0.0.0.0 ads.example.com tracker.example.com
+*.malware.example.org
+`
+
+const testRPZ = `$TTL 60
+@ IN SOA localhost. root.localhost. 1 3600 600 86400 60
+rpz.test. IN NS localhost.
+nx.example.net.rpz.test. CNAME .
+nodata.example.net.rpz.test. CNAME *.
+ok.malware.example.org.rpz.test. CNAME rpz-passthru.
+local.example.net.rpz.test. A 10.0.0.1
+`
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	rpz := filepath.Join(dir, "block.rpz")
+	ioutil.WriteFile(hosts, []byte(testHosts), 0644)
+	ioutil.WriteFile(rpz, []byte("$ORIGIN rpz.test.\n"+testRPZ), 0644)
+
+	b, err := newBlocklist(&Config{Blocklists: []string{hosts, rpz}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		action int
+		match  bool
+	}{
+		{"ads.example.com.", policyNXDomain, true},
+		{"tracker.example.com.", policyNXDomain, true},
+		{"www.example.com.", 0, false},
+		{"a.b.malware.example.org.", policyNXDomain, true},
+		{"malware.example.org.", 0, false},
+		{"ok.malware.example.org.", policyPassthru, true},
+		{"nx.example.net.", policyNXDomain, true},
+		{"nodata.example.net.", policyNoData, true},
+		{"local.example.net.", policyLocal, true},
+	}
+	for _, tc := range tests {
+		p := b.match(tc.name)
+		if (p != nil) != tc.match {
+			t.Errorf("%s: expected match to be %t", tc.name, tc.match)
+			continue
+		}
+		if p != nil && p.action != tc.action {
+			t.Errorf("%s: expected action %d, got %d", tc.name, tc.action, p.action)
+		}
+	}
+	if p := b.match("local.example.net."); p == nil || len(p.rrs) != 1 {
+		t.Errorf("expected local data for local.example.net.")
+	}
+}
+
+func TestBlocklistPassthru(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	allow := filepath.Join(dir, "allow")
+	ioutil.WriteFile(hosts, []byte(testHosts), 0644)
+	ioutil.WriteFile(allow, []byte("*.example.com\nok.bad.malware.example.org\n"), 0644)
+
+	b, err := newBlocklist(&Config{Blocklists: []string{hosts}, Allowlists: []string{allow}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		action int
+	}{
+		{"ads.example.com.", policyPassthru},            // wildcard allowed over the exact block
+		{"ok.bad.malware.example.org.", policyPassthru}, // exact allowed below a blocked wildcard
+		{"a.bad.malware.example.org.", policyNXDomain},
+	}
+	for _, tc := range tests {
+		if p := b.match(tc.name); p == nil || p.action != tc.action {
+			t.Errorf("%s: expected action %d, got %v", tc.name, tc.action, p)
+		}
+	}
+}
+
+const testRPZMixedCase = `$TTL 60
+@ IN SOA localhost. root.localhost. 1 3600 600 86400 60
+RPZ.Test. IN NS localhost.
+NX.Example.NET.rpz.TEST. CNAME .
+ok.Example.net.Rpz.Test. CNAME RPZ-PASSTHRU.
+Local.example.net.RPZ.test. A 10.0.0.1
+`
+
+func TestBlocklistRPZCase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rpz := filepath.Join(dir, "block.rpz")
+	ioutil.WriteFile(rpz, []byte("$ORIGIN Rpz.Test.\n"+testRPZMixedCase), 0644)
+
+	b, err := newBlocklist(&Config{Blocklists: []string{rpz}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		action int
+	}{
+		{"nx.example.net.", policyNXDomain},
+		{"ok.example.net.", policyPassthru},
+		{"local.example.net.", policyLocal},
+	}
+	for _, tc := range tests {
+		p := b.match(tc.name)
+		if p == nil {
+			t.Errorf("%s: expected a match", tc.name)
+			continue
+		}
+		if p.action != tc.action {
+			t.Errorf("%s: expected action %d, got %d", tc.name, tc.action, p.action)
+		}
+	}
+}
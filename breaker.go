@@ -0,0 +1,155 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// How often etcd is probed while the breaker is open, at first. Later probes
+// back off to etcdBackoffMax.
+const breakerProbe = 2 * time.Second
+
+var errBreakerOpen = errors.New("etcd circuit breaker is open")
+
+// breaker is a circuit breaker for etcd. It keeps a snapshot of the last
+// response for every key found, see trie.go. After failures errors in a row it opens:
+// lookups no longer go to etcd but are answered from the snapshot, with the
+// TTLs lowered to ttl, while etcd is probed in the background. When etcd
+// answers a probe the breaker closes again.
+type breaker struct {
+	failures int
+	ttl      int64
+	probe    func() error
+
+	sync.Mutex
+	fails    int // errors in a row
+	open     bool
+	snapshot *recordTrie
+}
+
+type snapshotKey struct {
+	key             string
+	sort, recursive bool
+}
+
+type snapshotEntry struct {
+	r   *etcd.Response
+	err error // a "key not found", for a key below a recursive response
+}
+
+// newBreaker returns a breaker that opens after failures errors in a row, or
+// nil when failures is 0.
+func newBreaker(failures int, ttl uint32, probe func() error) *breaker {
+	if failures <= 0 {
+		return nil
+	}
+	return &breaker{failures: failures, ttl: int64(ttl), probe: probe, snapshot: newRecordTrie()}
+}
+
+// etcdFailure returns true if err means etcd could not be reached, an error
+// returned by etcd itself, like "key not found", is an answer.
+func etcdFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(*etcd.EtcdError)
+	return !ok
+}
+
+// isOpen returns true if the lookups should be answered from the snapshot.
+func (b *breaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.open
+}
+
+// record stores the result of a lookup in the snapshot, or counts the error.
+// Only the keys found are stored, any name can be asked for and not be found:
+// a key that is gone is removed, and the nearest key above answers for it.
+func (b *breaker) record(k snapshotKey, r *etcd.Response, err error) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if etcdFailure(err) {
+		b.fails++
+		if b.fails >= b.failures && !b.open {
+			b.open = true
+			StatsBreakerOpenCount.Inc(1)
+			go b.recover()
+		}
+		return
+	}
+	b.fails = 0
+	if err != nil {
+		b.snapshot.remove(k)
+		return
+	}
+	b.snapshot.insert(k, snapshotEntry{r: r})
+}
+
+// stale returns the response for k from the snapshot, with the TTLs lowered. A
+// key that wasn't looked up itself is answered from a recursive lookup above it.
+func (b *breaker) stale(k snapshotKey) (*etcd.Response, error) {
+	b.Lock()
+	e, ok := b.snapshot.lookup(k)
+	b.Unlock()
+	if !ok {
+		return nil, errBreakerOpen
+	}
+	StatsStaleCount.Inc(1)
+	if e.err != nil {
+		return nil, e.err
+	}
+	r := *e.r
+	r.Node = staleNode(e.r.Node, b.ttl)
+	return &r, nil
+}
+
+// staleNode returns a copy of n and the nodes below it with the TTL set to ttl.
+func staleNode(n *etcd.Node, ttl int64) *etcd.Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.TTL = ttl
+	c.Expiration = nil
+	c.Nodes = make(etcd.Nodes, len(n.Nodes))
+	for i := range n.Nodes {
+		c.Nodes[i] = staleNode(n.Nodes[i], ttl)
+	}
+	return &c
+}
+
+// probe checks if etcd can be reached.
+func (s *server) probe() error {
+	_, err := s.client.Get("/skydns", false, false)
+	s.etcdResult(err)
+	return err
+}
+
+// recover probes etcd until it answers and closes the breaker.
+func (b *breaker) recover() {
+	bo := &backoff{min: breakerProbe, max: etcdBackoffMax}
+	for {
+		time.Sleep(bo.next())
+		if err := b.probe(); !etcdFailure(err) {
+			break
+		}
+	}
+	b.Lock()
+	b.open = false
+	b.fails = 0
+	b.Unlock()
+}
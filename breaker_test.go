@@ -0,0 +1,48 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestBreaker(t *testing.T) {
+	down := errors.New("connection refused")
+	b := newBreaker(2, 30, func() error { return down })
+	k := snapshotKey{key: "/skydns/local/skydns/a"}
+	r := &etcd.Response{Node: &etcd.Node{Key: k.key, Dir: true, TTL: 3600,
+		Nodes: etcd.Nodes{{Key: k.key + "/1", Value: `{"host":"10.0.0.1"}`, TTL: 3600}}}}
+	b.record(k, r, nil)
+	gone := snapshotKey{key: "/skydns/local/skydns/c"}
+	b.record(gone, r, nil)
+	b.record(gone, nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found"})
+
+	b.record(k, nil, down)
+	if b.isOpen() {
+		t.Fatal("breaker open after one failure")
+	}
+	b.record(k, nil, down)
+	if !b.isOpen() {
+		t.Fatal("breaker not open after two failures")
+	}
+	stale, err := b.stale(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.Node.TTL != 30 || stale.Node.Nodes[0].TTL != 30 {
+		t.Errorf("expected TTL 30, got %d and %d", stale.Node.TTL, stale.Node.Nodes[0].TTL)
+	}
+	if r.Node.Nodes[0].TTL != 3600 {
+		t.Error("snapshot modified")
+	}
+	for _, k := range []snapshotKey{{key: "/skydns/local/skydns/b"}, gone} {
+		if _, err := b.stale(k); err != errBreakerOpen {
+			t.Errorf("%s: expected %q, got %v", k.key, errBreakerOpen, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The signature and response caches can be saved to a file on shutdown and
+// loaded again on start, so a restart doesn't begin with a signing storm.
+
+type cacheSnapshot struct {
+	KeyTag uint16        `json:"keytag"` // of the key that made the signatures
+	Sigs   []snapshotSig `json:"sigs"`
+	Msgs   []snapshotMsg `json:"msgs"`
+}
+
+type snapshotSig struct {
+	Key []byte `json:"key"`
+	Sig string `json:"sig"`
+}
+
+type snapshotMsg struct {
+	Key      string    `json:"key"`
+	Msg      []byte    `json:"msg"`
+	TTL      int64     `json:"ttl"`
+	Expire   time.Time `json:"expire"`
+	Negative bool      `json:"negative,omitempty"`
+}
+
+// saveCaches writes the signature cache and s.rcache to file.
+func (s *server) saveCaches(file string) error {
+	snap := cacheSnapshot{KeyTag: s.config.KeyTag}
+	cache.RLock()
+	for k, sig := range cache.m {
+		snap.Sigs = append(snap.Sigs, snapshotSig{Key: []byte(k), Sig: sig.String()})
+	}
+	cache.RUnlock()
+	if c := s.rcache; c != nil {
+		now := time.Now()
+		c.RLock()
+		for k, e := range c.m {
+			if now.After(e.expire) {
+				continue
+			}
+			buf, err := e.msg.Pack()
+			if err != nil {
+				continue
+			}
+			snap.Msgs = append(snap.Msgs, snapshotMsg{Key: k, Msg: buf, TTL: int64(e.ttl), Expire: e.expire, Negative: e.negative})
+		}
+		c.RUnlock()
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// loadCaches fills the signature cache and s.rcache from file. Nothing is
+// loaded when the DNSSEC key has changed since the file was written, and
+// expired entries are skipped. A missing file is not an error.
+func (s *server) loadCaches(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap cacheSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+	if snap.KeyTag != s.config.KeyTag {
+		s.config.log.Info("DNSSEC key changed, not loading the saved caches")
+		return nil
+	}
+	now := time.Now()
+	sigs, msgs := 0, 0
+	for _, e := range snap.Sigs {
+		rr, err := dns.NewRR(e.Sig)
+		if err != nil {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.ValidityPeriod(now.Add(24*time.Hour)) {
+			cache.insert(string(e.Key), sig)
+			sigs++
+		}
+	}
+	if c := s.rcache; c != nil {
+		c.Lock()
+		for _, e := range snap.Msgs {
+			if now.After(e.Expire) || len(c.m) >= c.size {
+				continue
+			}
+			m := new(dns.Msg)
+			if err := m.Unpack(e.Msg); err != nil {
+				continue
+			}
+			if c.add(e.Key, &msgEntry{msg: m, ttl: time.Duration(e.TTL), expire: e.Expire, negative: e.Negative}) {
+				msgs++
+			}
+		}
+		c.Unlock()
+	}
+	s.config.log.Infof("loaded %d signatures and %d responses from %s", sigs, msgs, file)
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// checked is a service as found by checkZone.
+type checked struct {
+	key  string
+	serv *Service
+	ttl  uint32
+}
+
+// checkZone loads all services under the domain and reports the problems it
+// finds to w, one per line, prefixed with the etcd key: values that are not a
+// valid service (bad JSON or unknown fields), invalid addresses, host names,
+// ports and records, hosts in our domain that don't exist, services in one
+// directory with the same host, port and priority, and TTLs past the SOA
+// expire. It returns the number of problems.
+func (s *server) checkZone(w io.Writer) (int, error) {
+	p, _ := Path(s.config.Domain)
+	r, err := s.client.Get(p, true, true)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+			return 0, nil
+		}
+		return 0, err
+	}
+	problems := 0
+	report := func(key, format string, a ...interface{}) {
+		fmt.Fprintf(w, "%s: %s\n", key, fmt.Sprintf(format, a...))
+		problems++
+	}
+
+	var services []checked
+	paths := make(map[string]bool) // every key and directory
+	var walk func(nodes etcd.Nodes)
+	walk = func(nodes etcd.Nodes) {
+		for _, n := range nodes {
+			paths[n.Key] = true
+			if n.Dir {
+				walk(n.Nodes)
+				continue
+			}
+			serv := new(Service)
+			dec := json.NewDecoder(strings.NewReader(n.Value))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(serv); err != nil {
+				report(n.Key, "not a valid service: %s", err)
+				continue
+			}
+			ttl := uint32(n.TTL)
+			if ttl == 0 {
+				ttl = s.config.Ttl
+			}
+			services = append(services, checked{n.Key, serv, ttl})
+		}
+	}
+	walk(r.Node.Nodes)
+
+	type dup struct {
+		dir, host  string
+		port, prio int
+	}
+	seen := make(map[dup]string)
+	for _, c := range services {
+		for _, problem := range c.serv.validate(Domain(c.key)) {
+			report(c.key, "%s", problem)
+		}
+		host := strings.ToLower(dns.Fqdn(c.serv.Host))
+		if c.serv.Host != "" && net.ParseIP(c.serv.Host) == nil && dns.IsSubDomain(s.config.Domain, host) && !exists(paths, host) {
+			report(c.key, "host %s does not exist", c.serv.Host)
+		}
+		if c.serv.Host != "" {
+			d := dup{path.Dir(c.key), host, c.serv.Port, c.serv.Priority}
+			if other, ok := seen[d]; ok {
+				report(c.key, "same host, port and priority as %s", other)
+			} else {
+				seen[d] = c.key
+			}
+		}
+		if c.ttl > s.config.SoaExpire {
+			report(c.key, "ttl %d is longer than the SOA expire (%d)", c.ttl, s.config.SoaExpire)
+		}
+	}
+	return problems, nil
+}
+
+// exists returns true if name, in our domain, has a key or directory in paths,
+// or a wildcard at one of its ancestors.
+func exists(paths map[string]bool, name string) bool {
+	if paths[PathNoWildcard(name)] {
+		return true
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if paths[PathNoWildcard(strings.Join(labels[i:], "."))+"/*"] {
+			return true
+		}
+	}
+	return false
+}
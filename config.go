@@ -5,9 +5,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -19,18 +23,223 @@ import (
 
 // Config provides options to the SkyDNS resolver.
 type Config struct {
-	// The ip:port SkyDNS should be listening on for incoming DNS requests.
+	// The ip:port SkyDNS should be listening on for incoming DNS requests. A comma
+	// separated list to listen on more than one address, i.e. "10.0.0.1:53,[2001:db8::1]:53".
 	DnsAddr string `json:"dns_addr,omitempty"`
 	// The domain SkyDNS is authoritative for, defaults to skydns.local.
 	Domain string `json:"domain,omitempty"`
 	// The hostmaster responsible for this domain, defaults to hostmaster.<Domain>.
 	Hostmaster string `json:"hostmaster,omitempty"`
-	DNSSEC     string `json:"dnssec,omitempty"`
+	// The nameservers in the NS records, with their addresses. Defaults to ns1.dns.<Domain>,
+	// ns2.dns.<Domain>, etc. with the addresses of the etcd machines.
+	NS []NSRecord `json:"ns,omitempty"`
+	// Our own name, sent in the NSID option (RFC 5001) when the client asks for it.
+	// Defaults to the hostname.
+	NSID string `json:"nsid,omitempty"`
+	// The primary nameserver in the SOA record, defaults to the first of NS or ns1.dns.<Domain>.
+	SoaNs string `json:"soa_ns,omitempty"`
+	// The refresh, retry and expire timers, in seconds, in the SOA record.
+	// Defaults to 28800, 7200 and 604800.
+	SoaRefresh uint32 `json:"soa_refresh,omitempty"`
+	SoaRetry   uint32 `json:"soa_retry,omitempty"`
+	SoaExpire  uint32 `json:"soa_expire,omitempty"`
+	// The minimum field of the SOA record, the TTL for negative caching. Defaults to MinTtl.
+	SoaMinttl uint32 `json:"soa_minttl,omitempty"`
+	DNSSEC    string `json:"dnssec,omitempty"`
+	// Sign the answers for our names at startup with this many queries at the same time, see warmup.go.
+	DnssecWarmup int `json:"dnssec_warmup,omitempty"`
+	// The log level: debug, info (the default), warn or error. The -log-level flag takes precedence.
+	LogLevel string `json:"log_level,omitempty"`
 	// Round robin A/AAAA replies. Default is true.
 	RoundRobin bool `json:"round_robin,omitempty"`
 	// List of ip:port, seperated by commas of recursive nameservers to forward queries to.
 	Nameservers []string      `json:"nameservers,omitempty"`
 	ReadTimeout time.Duration `json:"read_timeout,omitempty"`
+	// The EDNS0 UDP payload size we advertise, and the most we use of a client's. Defaults to 4096.
+	EdnsUdpSize uint16 `json:"edns_udp_size,omitempty"`
+	// Hard limit on the size of every reply over UDP, forwarded ones too. Disabled when 0.
+	MaxUdpSize uint16 `json:"max_udp_size,omitempty"`
+	// What to do with a reply that is too large for UDP: "drop_additional" (the default) removes
+	// the additional section first, "tc" sets the TC bit right away.
+	TruncatePolicy string `json:"truncate_policy,omitempty"`
+	// Names in Domain with more labels than this get NXDOMAIN without an etcd lookup. Defaults to 32.
+	MaxLabels int `json:"max_labels,omitempty"`
+	// Values in etcd longer than this, in bytes, are not used. Defaults to 65536.
+	MaxValueSize int `json:"max_value_size,omitempty"`
+	// The most records in the answer section of a reply from etcd. Defaults to 1000.
+	MaxAnswers int `json:"max_answers,omitempty"`
+	// Deadline for answering a query, after it the client gets a SERVFAIL. Defaults to 5s.
+	QueryTimeout time.Duration `json:"query_timeout,omitempty"`
+	// Answer from the last known etcd data after this many failed etcd lookups in a row,
+	// until etcd is back. Disabled when 0.
+	BreakerFailures int `json:"breaker_failures,omitempty"`
+	// Serve answers of the nameservers up to this long after they expired, when forwarding
+	// fails. Disabled when 0.
+	ServeStale time.Duration `json:"serve_stale,omitempty"`
+	// TTL of the records in stale answers. Defaults to 30.
+	StaleTtl uint32 `json:"stale_ttl,omitempty"`
+	// Answer a query that failed to forward with a SERVFAIL for this long, without
+	// forwarding it again. At most 5m, disabled when 0.
+	ServfailCache time.Duration `json:"servfail_cache,omitempty"`
+	// The resolv.conf to take the nameservers from when none are given, defaults to /etc/resolv.conf.
+	// Changes to this file are picked up while running.
+	ResolvConf string `json:"resolv_conf,omitempty"`
+	// How to forward to the nameservers: "sequential" (the default) tries them one
+	// after another, "race" queries a second one when the first is slow and
+	// "happy_eyeballs" tries IPv6 and IPv4 ones alternately, as in RFC 8305.
+	ForwardPolicy string `json:"forward_policy,omitempty"`
+	// Delay before the next nameserver is queried with the race and happy_eyeballs policies. Defaults to 100ms.
+	RaceDelay time.Duration `json:"race_delay,omitempty"`
+	// PEM file with the CA certificates used to verify tls:// nameservers, defaults to the system roots.
+	ForwardTLSCA string `json:"forward_tls_ca,omitempty"`
+	// Base64 encoded SHA-256 hashes of the SubjectPublicKeyInfo of tls:// nameservers. When
+	// given, one of the nameserver's certificates must match a pin and CA validation is skipped.
+	ForwardTLSPins []string `json:"forward_tls_pins,omitempty"`
+	// Source addresses, or interfaces, for the queries to the nameservers; the first one of the
+	// family of a nameserver is used. Defaults to the one the system picks.
+	ForwardSource []string `json:"forward_source,omitempty"`
+	// Range of source ports for the queries to the nameservers, i.e. "40000-40999". Defaults to random.
+	ForwardPorts string `json:"forward_ports,omitempty"`
+	// Keep the TCP and TLS connections to the nameservers open and pipeline the queries on them.
+	ForwardReuse bool `json:"forward_reuse,omitempty"`
+	// How long an idle connection to a nameserver stays open with ForwardReuse. Defaults to 10s.
+	ForwardIdleTimeout time.Duration `json:"forward_idle_timeout,omitempty"`
+	// Randomize the case of forwarded question names and check the reply echoes it (0x20).
+	Forward0x20 bool `json:"forward_0x20,omitempty"`
+	// Set the DO bit in all forwarded queries, for when the nameservers validate. The DNSSEC
+	// records are still only returned to the clients that set DO themselves.
+	ForwardDo bool `json:"forward_do,omitempty"`
+	// Resolve SRV targets outside our domain through the nameservers, for the additional section.
+	AdditionalForward bool `json:"additional_forward,omitempty"`
+	// Maximum number of SRV targets looked up at the same time for the additional section. Defaults to 8.
+	AdditionalFanout int `json:"additional_fanout,omitempty"`
+	// NAT64 prefix, i.e. 64:ff9b::/96, to synthesize AAAA records with for forwarded
+	// names that only have A records (DNS64). Disabled when empty.
+	Dns64Prefix string `json:"dns64_prefix,omitempty"`
+	// IPv4 prefixes, i.e. 10.0.0.0/8, for whose addresses in services the PTR records are
+	// kept in etcd and answered, see reverse.go.
+	Reverse []string `json:"reverse,omitempty"`
+	// List of CIDRs of clients that may use SkyDNS to recurse. Defaults to all clients.
+	AllowRecursion []string `json:"allow_recursion,omitempty"`
+	// CIDRs of the load balancers that send a PROXY protocol header on TCP connections.
+	ProxyProtocol []string `json:"proxy_protocol,omitempty"`
+	// Allow and deny lists of CIDRs per class of operation: query, transfer, update, recursion and debug.
+	ACL map[string]*ACL `json:"acl,omitempty"`
+	// The EDNS0 option code that carries the ID of the client, i.e. a local one like 65001. The ID
+	// is logged and can be used in the ACLs. Off when 0.
+	ClientIdOption uint16 `json:"client_id_option,omitempty"`
+	// Answer TXT queries for o-o.debug.<name> with how name is looked up, see debugRecords.
+	DebugQueries bool `json:"debug_queries,omitempty"`
+	// Rules to rewrite question names, addresses and TTLs, the first one that matches is used.
+	Rewrite []*RewriteRule `json:"rewrite,omitempty"`
+	// The stages a query goes through, in order, before it is answered from etcd: log, acl,
+	// quota, hooks, blocklist, rewrite, forward and cache. Defaults to all of them, in that order.
+	Stages []string `json:"stages,omitempty"`
+	// Go plugins with query firewall hooks, called in this order, see hooks.go.
+	Hooks []string `json:"hooks,omitempty"`
+	// Templates that synthesize answers from the question name, the first one that matches is used.
+	Templates []*Template `json:"templates,omitempty"`
+	// Answer the Kubernetes pod names, 1-2-3-4.<namespace>.pod.<Domain>, with the address in the name.
+	PodNames bool `json:"pod_names,omitempty"`
+	// Answer names in Domain that carry a search suffix in Domain with a CNAME to the name without it.
+	Autopath bool `json:"autopath,omitempty"`
+	// Try single label queries with these suffixes in Domain, in order, see search.go.
+	Search []string `json:"search,omitempty"`
+	// Split-horizon views, the first one that matches the client is used.
+	Views []*View `json:"views,omitempty"`
+	// Files with names to block, in hosts format or as a response policy zone (.rpz or .zone).
+	Blocklists []string `json:"blocklists,omitempty"`
+	// Files with names that are never blocked.
+	Allowlists []string `json:"allowlists,omitempty"`
+	// Address to reply with for blocked names, instead of NXDOMAIN.
+	BlocklistSinkhole string `json:"blocklist_sinkhole,omitempty"`
+	// Send dnstap messages to this collector: unix:/path/to/socket or tcp:host:port.
+	Dnstap string `json:"dnstap,omitempty"`
+	// Log queries as JSON lines to this file, to standard output when set to "stdout", or
+	// to syslog: "syslog", "syslog:unix:/path", "syslog:udp:host:port" or "syslog:tcp:host:port".
+	QueryLog string `json:"query_log,omitempty"`
+	// Fraction (0.0 - 1.0) of the queries to log. Defaults to 1.0, or to 0.0 when QueryLogSlow is set.
+	QueryLogSample float64 `json:"query_log_sample,omitempty"`
+	// Queries slower than this are always logged.
+	QueryLogSlow time.Duration `json:"query_log_slow,omitempty"`
+	// Log the changes to the services as JSON lines, to a file or syslog like QueryLog.
+	AuditLog string `json:"audit_log,omitempty"`
+	// Also store the audit log entries in etcd, as in-order keys below this prefix.
+	AuditPrefix string `json:"audit_prefix,omitempty"`
+	// The loopback ip:port for the admin HTTP API. Disabled when empty.
+	AdminAddr string `json:"admin_addr,omitempty"`
+	// Tokens for registering services with the admin API, each for its own names, see authz.go.
+	AdminTokens []*AdminToken `json:"admin_tokens,omitempty"`
+	// Serve the net/http/pprof profiles under /debug/pprof/ on the admin API.
+	AdminPprof bool `json:"admin_pprof,omitempty"`
+	// How long to wait for the queries in flight when shutting down. Defaults to 5s.
+	ShutdownTimeout time.Duration `json:"shutdown_timeout,omitempty"`
+	// The address families to serve: "dual" (the default), "v4only" or "v6only". In the
+	// v4only and v6only modes we only bind to, and return records of, that family.
+	IpMode string `json:"ip_mode,omitempty"`
+	// Also answer multicast DNS queries (224.0.0.251:5353) for the names in Domain.
+	Mdns bool `json:"mdns,omitempty"`
+	// Set SO_REUSEPORT on the sockets, so multiple SkyDNS processes can share DnsAddr.
+	ReusePort bool `json:"reuse_port,omitempty"`
+	// The ip:port for the /healthz and /readyz HTTP endpoints. Disabled when empty.
+	HealthAddr string `json:"health_addr,omitempty"`
+	// The ip:port for DNS over QUIC, usually on port 853, see doq.go. Disabled when empty.
+	DoqAddr string `json:"doq_addr,omitempty"`
+	// PEM files with the certificate and the key of the DNS over QUIC listener.
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+	// Serve the services as Prometheus targets on the admin API and HealthAddr, see prometheus.go.
+	PrometheusSd bool `json:"prometheus_sd,omitempty"`
+	// Answer the names below machines.<domain> with the hosts of the cluster, see machines.go.
+	Machines bool `json:"machines,omitempty"`
+	// Answer NXDOMAIN without an etcd lookup for the names a filter of the names in etcd
+	// surely doesn't hold, see existence.go.
+	ExistenceFilter bool `json:"existence_filter,omitempty"`
+	// The Consul HTTP API to mirror the services to, i.e. http://127.0.0.1:8500, see consul.go. Disabled when empty.
+	ConsulAddr string `json:"consul_addr,omitempty"`
+	// The Consul node the services are registered on. Defaults to "skydns".
+	ConsulNode string `json:"consul_node,omitempty"`
+	// File with the ACL token for the Consul API. Defaults to the CONSUL_HTTP_TOKEN environment variable.
+	ConsulTokenFile string `json:"consul_token_file,omitempty"`
+	// The ACL token, from ConsulTokenFile. Never in etcd or on /config.
+	ConsulToken string `json:"-"`
+	// OTLP/HTTP endpoint to export traces to, i.e. http://localhost:4318/v1/traces. Disabled when empty.
+	TraceEndpoint string `json:"trace_endpoint,omitempty"`
+	// Fraction (0.0 - 1.0) of the queries to trace. Defaults to 1.0.
+	TraceSample float64 `json:"trace_sample,omitempty"`
+	// Maximum number of responses to cache, 0 (the default) disables the cache.
+	CacheSize int `json:"cache_size,omitempty"`
+	// Bytes the signature, response and stale caches may use together, 0 (the default) is no limit.
+	CacheMemory int64 `json:"cache_memory,omitempty"`
+	// Maximum time, in seconds, to cache NXDOMAIN and NODATA responses. Defaults to 60.
+	CacheNegativeTtl uint32 `json:"cache_negative_ttl,omitempty"`
+	// Refresh cached responses with at least this many hits before they expire. Disabled when 0.
+	CachePrefetch int `json:"cache_prefetch,omitempty"`
+	// Save the signature and response caches to this file on shutdown and load them on start.
+	CacheFile string `json:"cache_file,omitempty"`
+	// Maximum number of UDP queries handled concurrently, 0 (the default) means no limit.
+	UdpWorkers int `json:"udp_workers,omitempty"`
+	// What to do with UDP queries when all workers are busy: "drop" (the default),
+	// "servfail" or "truncate" (so the client retries over TCP).
+	OverloadPolicy string `json:"overload_policy,omitempty"`
+	// Queries per second allowed per client address, per /24 (/56 for IPv6) of clients and per
+	// question name. Off when 0.
+	QuotaClient  float64 `json:"quota_client,omitempty"`
+	QuotaNetwork float64 `json:"quota_network,omitempty"`
+	QuotaName    float64 `json:"quota_name,omitempty"`
+	// What to do with queries over a quota: "refuse" (the default) or "drop".
+	QuotaPolicy string `json:"quota_policy,omitempty"`
+	// Take part in an election in etcd, so only one of the replicas does the
+	// things that should be done once, like registrations.
+	Election bool `json:"election,omitempty"`
+	// How long the leadership lasts without being refreshed. Defaults to 15s.
+	ElectionTtl time.Duration `json:"election_ttl,omitempty"`
+	// The name to register this replica under, with a TTL, see register.go. Disabled when empty.
+	SelfName string `json:"self_name,omitempty"`
+	// The address to register, defaults to the one of DnsAddr.
+	SelfAddr string `json:"self_addr,omitempty"`
+	// How long the registration lasts without being refreshed. Defaults to 30s.
+	SelfTtl time.Duration `json:"self_ttl,omitempty"`
 	// Default priority on SRV records when none is given. Defaults to 10.
 	Priority uint16 `json:"priority"`
 	// Default TTL, in seconds, when none is given in etcd. Defaults to 3600.
@@ -46,79 +255,346 @@ type Config struct {
 	ClosestEncloser *dns.NSEC3     `json:"-"`
 	DenyWildcard    *dns.NSEC3     `json:"-"`
 
+	forwardTLS *tls.Config  `json:"-"`
+	serverTLS  *tls.Config  `json:"-"`
+	proxyNets  []*net.IPNet `json:"-"`
+	dns64      *net.IPNet   `json:"-"`
+	sources    []net.IP     `json:"-"` // of ForwardSource
+	srcPorts   [2]int       `json:"-"` // of ForwardPorts, 0 when not set
+	reverse    []*net.IPNet `json:"-"`
+	hooks      []*hook      `json:"-"`
+	resolvConf bool         `json:"-"` // nameservers are taken from ResolvConf
+
 	log *log.Logger `json:"-"`
 }
 
+// LoadConfig loads the configuration. Options set with flags take precedence over the
+// ones from the configuration file, which take precedence over the ones stored in etcd.
 func LoadConfig(client *etcd.Client) (*Config, error) {
 	config := &Config{ReadTimeout: 0, Domain: "", DnsAddr: "", DNSSEC: ""}
-	config.log = log.New("skydns", false,
-		log.CombinedSink(os.Stderr, "[%s] %s %-9s | %s\n", []string{"prefix", "time", "priority", "message"}))
+	config.log = newLogger()
 
-	n, err := client.Get("/skydns/config", false, false)
+	n, err := client.Get(configKey, false, false)
 	if err != nil {
-		config.log.Info("falling back to default configuration")
-		if err := setDefaults(config); err != nil {
-			return nil, err
+		if configFile == "" {
+			config.log.Info("falling back to default configuration")
 		}
-		return config, nil
-	}
-	if err := json.Unmarshal([]byte(n.Node.Value), &config); err != nil {
+	} else if err := json.Unmarshal([]byte(n.Node.Value), &config); err != nil {
 		return nil, err
 	}
+	if configFile != "" {
+		if err := loadConfigFile(config, configFile); err != nil {
+			return nil, err
+		}
+	}
+	setFlags(config)
 	if err := setDefaults(config); err != nil {
 		return nil, err
 	}
 	return config, nil
 }
 
+// loadConfigFile reads the JSON configuration in file over config, only the
+// options given in the file are changed.
+func loadConfigFile(config *Config, file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, config); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	return nil
+}
+
+// setFlags copies the options that are set with flags to config.
+func setFlags(config *Config) {
+	if configFlags.DnsAddr != "" {
+		config.DnsAddr = configFlags.DnsAddr
+	}
+	if configFlags.Domain != "" {
+		config.Domain = configFlags.Domain
+	}
+	if configFlags.LogLevel != "" {
+		config.LogLevel = configFlags.LogLevel
+	}
+	if configFlags.Hostmaster != "" {
+		config.Hostmaster = configFlags.Hostmaster
+	}
+	if configFlags.DNSSEC != "" {
+		config.DNSSEC = configFlags.DNSSEC
+	}
+	if len(configFlags.Nameservers) > 0 {
+		config.Nameservers = configFlags.Nameservers
+	}
+	if configFlags.AdminAddr != "" {
+		config.AdminAddr = configFlags.AdminAddr
+	}
+	if configFlags.HealthAddr != "" {
+		config.HealthAddr = configFlags.HealthAddr
+	}
+}
+
 func setDefaults(config *Config) error {
 	if config.ReadTimeout == 0 {
 		config.ReadTimeout = 2 * time.Second
 	}
+	if config.EdnsUdpSize == 0 {
+		config.EdnsUdpSize = 4096
+	}
+	if config.EdnsUdpSize < dns.MinMsgSize || (config.MaxUdpSize > 0 && config.MaxUdpSize < dns.MinMsgSize) {
+		return fmt.Errorf("edns_udp_size and max_udp_size can not be less than %d", dns.MinMsgSize)
+	}
+	if config.MaxLabels == 0 {
+		config.MaxLabels = 32
+	}
+	if config.MaxValueSize == 0 {
+		config.MaxValueSize = 65536
+	}
+	if config.MaxAnswers == 0 {
+		config.MaxAnswers = 1000
+	}
+	if config.MaxLabels < 0 || config.MaxValueSize < 0 || config.MaxAnswers < 0 {
+		return fmt.Errorf("max_labels, max_value_size and max_answers can not be negative")
+	}
+	switch config.TruncatePolicy {
+	case "":
+		config.TruncatePolicy = "drop_additional"
+	case "drop_additional", "tc":
+	default:
+		return fmt.Errorf("unknown truncate_policy: %q", config.TruncatePolicy)
+	}
+	if config.AdditionalFanout <= 0 {
+		config.AdditionalFanout = 8
+	}
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = 5 * time.Second
+	}
+	if config.StaleTtl == 0 {
+		config.StaleTtl = 30
+	}
+	if config.ServeStale > 0 && config.CacheSize == 0 {
+		return fmt.Errorf("serve_stale needs a cache_size")
+	}
+	if config.ServfailCache < 0 || config.ServfailCache > 5*time.Minute {
+		return fmt.Errorf("servfail_cache must be between 0 and 5m")
+	}
+	if config.ForwardPolicy == "" {
+		config.ForwardPolicy = "sequential"
+	}
+	switch config.ForwardPolicy {
+	case "sequential", "race", "happy_eyeballs":
+	default:
+		return fmt.Errorf("unknown forward_policy: %q", config.ForwardPolicy)
+	}
+	switch config.OverloadPolicy {
+	case "":
+		config.OverloadPolicy = "drop"
+	case "drop", "servfail", "truncate":
+	default:
+		return fmt.Errorf("unknown overload_policy: %q", config.OverloadPolicy)
+	}
+	switch config.QuotaPolicy {
+	case "":
+		config.QuotaPolicy = "refuse"
+	case "refuse", "drop":
+	default:
+		return fmt.Errorf("unknown quota_policy: %q", config.QuotaPolicy)
+	}
+	if config.QuotaClient < 0 || config.QuotaNetwork < 0 || config.QuotaName < 0 {
+		return fmt.Errorf("quota_client, quota_network and quota_name can not be negative")
+	}
+	if config.ForwardIdleTimeout == 0 {
+		config.ForwardIdleTimeout = 10 * time.Second
+	}
+	if config.ForwardReuse && config.ForwardIdleTimeout <= config.ReadTimeout {
+		// Otherwise a connection is closed while a query waits for its reply.
+		return fmt.Errorf("forward_idle_timeout must be longer than read_timeout")
+	}
+	if config.RaceDelay == 0 {
+		config.RaceDelay = 100 * time.Millisecond
+	}
+	if config.QueryLogSample == 0 && config.QueryLogSlow == 0 {
+		config.QueryLogSample = 1.0
+	}
+	if config.TraceSample == 0 {
+		config.TraceSample = 1.0
+	}
+	if config.ElectionTtl < 3*time.Second {
+		config.ElectionTtl = 15 * time.Second
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 5 * time.Second
+	}
 	if config.DnsAddr == "" {
 		config.DnsAddr = "127.0.0.1:53"
 	}
+	if config.IpMode == "" {
+		config.IpMode = "dual"
+	}
+	if config.IpMode != "dual" && config.IpMode != "v4only" && config.IpMode != "v6only" {
+		return fmt.Errorf("unknown ip_mode: %q", config.IpMode)
+	}
+	for _, a := range config.dnsAddrs() {
+		host, _, err := net.SplitHostPort(a)
+		if err != nil {
+			return fmt.Errorf("bad dns_addr %q: %s", a, err)
+		}
+		if ip := net.ParseIP(host); ip != nil && !config.family(ip) {
+			return fmt.Errorf("dns_addr %q is not allowed with ip_mode %s", a, config.IpMode)
+		}
+	}
 	if config.Domain == "" {
 		config.Domain = "skydns.local"
 	}
 	if config.Hostmaster == "" {
 		config.Hostmaster = "hostmaster.skydns.local."
 	}
+	if config.SoaRefresh == 0 {
+		config.SoaRefresh = 28800
+	}
+	if config.SoaRetry == 0 {
+		config.SoaRetry = 7200
+	}
+	if config.SoaExpire == 0 {
+		config.SoaExpire = 604800
+	}
 	// People probably don't know that SOA's email addresses cannot
 	// contain @-signs, replace them with dots
 	config.Hostmaster = dns.Fqdn(strings.Replace(config.Hostmaster, "@", ".", -1))
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return err
+	}
 	if config.MinTtl == 0 {
 		config.MinTtl = 60
 	}
 	if config.Ttl == 0 {
 		config.Ttl = 3600
 	}
+	if config.CacheNegativeTtl == 0 {
+		config.CacheNegativeTtl = 60
+	}
 	if config.Priority == 0 {
 		config.Priority = 10
 	}
 
+	if config.ResolvConf == "" {
+		config.ResolvConf = "/etc/resolv.conf"
+	}
 	if len(config.Nameservers) == 0 {
-		c, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		nameservers, err := readResolvConf(config.ResolvConf)
 		if err != nil {
 			return err
 		}
-		for _, s := range c.Servers {
-			config.Nameservers = append(config.Nameservers, net.JoinHostPort(s, c.Port))
+		config.Nameservers = nameservers
+		config.resolvConf = true
+	}
+	if err := setForwardTLS(config); err != nil {
+		return err
+	}
+	if err := setServerTLS(config); err != nil {
+		return err
+	}
+	if err := setACLs(config); err != nil {
+		return err
+	}
+	if err := setViews(config); err != nil {
+		return err
+	}
+	if err := setRewrites(config); err != nil {
+		return err
+	}
+	if err := setTemplates(config); err != nil {
+		return err
+	}
+	if err := setHooks(config); err != nil {
+		return err
+	}
+	if err := setForwardSource(config); err != nil {
+		return err
+	}
+	if err := setStages(config); err != nil {
+		return err
+	}
+	proxyNets, err := parseCIDRs(config.ProxyProtocol)
+	if err != nil {
+		return fmt.Errorf("bad proxy_protocol: %s", err)
+	}
+	config.proxyNets = proxyNets
+	if config.Dns64Prefix != "" {
+		if config.dns64, err = parseDns64Prefix(config.Dns64Prefix); err != nil {
+			return fmt.Errorf("bad dns64_prefix: %s", err)
 		}
 	}
+	if config.reverse, err = parseCIDRs(config.Reverse); err != nil {
+		return fmt.Errorf("bad reverse: %s", err)
+	}
+	if config.BlocklistSinkhole != "" && net.ParseIP(config.BlocklistSinkhole) == nil {
+		return fmt.Errorf("blocklist_sinkhole is not an IP address: %q", config.BlocklistSinkhole)
+	}
 	config.Domain = dns.Fqdn(strings.ToLower(config.Domain))
 	config.DomainLabels = dns.CountLabel(config.Domain)
+	if err := setAdminTokens(config); err != nil {
+		return err
+	}
+	if err := setSelf(config); err != nil {
+		return err
+	}
+	if config.ConsulAddr != "" {
+		if u, err := url.Parse(config.ConsulAddr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("consul_addr is not an http(s) URL: %q", config.ConsulAddr)
+		}
+		if config.ConsulNode == "" {
+			config.ConsulNode = "skydns"
+		}
+		config.ConsulToken = os.Getenv("CONSUL_HTTP_TOKEN")
+		if config.ConsulTokenFile != "" {
+			buf, err := ioutil.ReadFile(config.ConsulTokenFile)
+			if err != nil {
+				return err
+			}
+			config.ConsulToken = strings.TrimSpace(string(buf))
+		}
+	}
+	if p := config.AuditPrefix; p != "" {
+		if dp, _ := Path(config.Domain); !strings.HasPrefix(p, "/") || strings.HasPrefix(p+"/", dp+"/") {
+			return fmt.Errorf("audit_prefix must be an etcd path outside the domain: %q", p)
+		}
+	}
+	for i, suffix := range config.Search {
+		suffix = dns.Fqdn(strings.ToLower(strings.TrimPrefix(suffix, ".")))
+		if !strings.HasSuffix("."+suffix, "."+config.Domain) {
+			return fmt.Errorf("search suffix %q is not in domain %s", config.Search[i], config.Domain)
+		}
+		config.Search[i] = suffix
+	}
+	for i := range config.NS {
+		config.NS[i].Name = dns.Fqdn(strings.ToLower(config.NS[i].Name))
+		if a := config.NS[i].Addr; a != "" && net.ParseIP(a) == nil {
+			return fmt.Errorf("address of nameserver %s is not an IP address: %q", config.NS[i].Name, a)
+		}
+	}
+	if config.SoaNs == "" {
+		config.SoaNs = "ns1.dns." + config.Domain
+		if len(config.NS) > 0 {
+			config.SoaNs = config.NS[0].Name
+		}
+	}
+	if config.NSID == "" {
+		config.NSID, _ = os.Hostname()
+	}
+	config.SoaNs = dns.Fqdn(config.SoaNs)
+	if config.SoaMinttl == 0 {
+		config.SoaMinttl = config.MinTtl
+	}
 	if config.DNSSEC != "" {
-		// For some reason the + are replaces by spaces in etcd. Re-replace them
-		keyfile := strings.Replace(config.DNSSEC, " ", "+", -1)
-		k, p, err := ParseKeyFile(keyfile)
+		k, p, err := config.loadKey()
 		if err != nil {
 			return err
 		}
-		if k.Header().Name != dns.Fqdn(config.Domain) {
-			return fmt.Errorf("ownername of DNSKEY must match SkyDNS domain")
-		}
-		k.Header().Ttl = config.Ttl
 		config.PubKey = k
 		config.KeyTag = k.KeyTag()
 		config.PrivKey = p
@@ -126,3 +602,124 @@ func setDefaults(config *Config) error {
 	}
 	return nil
 }
+
+// setForwardTLS checks the tls:// nameservers and sets up the TLS configuration used
+// to talk to them.
+func setForwardTLS(config *Config) error {
+	tlsNameservers := false
+	for _, n := range config.Nameservers {
+		if !strings.HasPrefix(n, "tls://") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(strings.TrimPrefix(n, "tls://")); err != nil {
+			return fmt.Errorf("bad tls nameserver %q: %s", n, err)
+		}
+		tlsNameservers = true
+	}
+	if !tlsNameservers {
+		return nil
+	}
+	config.forwardTLS = &tls.Config{}
+	if len(config.ForwardTLSPins) > 0 {
+		// We verify the pins ourselves after the handshake.
+		config.forwardTLS.InsecureSkipVerify = true
+		return nil
+	}
+	if config.ForwardTLSCA != "" {
+		pem, err := ioutil.ReadFile(config.ForwardTLSCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", config.ForwardTLSCA)
+		}
+		config.forwardTLS.RootCAs = pool
+	}
+	return nil
+}
+
+// setServerTLS loads the certificate of the DNS over QUIC listener.
+func setServerTLS(config *Config) error {
+	if config.DoqAddr == "" {
+		return nil
+	}
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return fmt.Errorf("doq_addr needs tls_cert and tls_key")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return err
+	}
+	config.serverTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// dnsAddrs returns the addresses in DnsAddr.
+func (config *Config) dnsAddrs() []string {
+	var addrs []string
+	for _, a := range strings.Split(config.DnsAddr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// network returns the network to listen on for base ("tcp" or "udp"), given IpMode.
+func (config *Config) network(base string) string {
+	switch config.IpMode {
+	case "v4only":
+		return base + "4"
+	case "v6only":
+		return base + "6"
+	}
+	return base
+}
+
+// family returns true when IpMode allows the address family of ip.
+func (config *Config) family(ip net.IP) bool {
+	switch config.IpMode {
+	case "v4only":
+		return ip.To4() != nil
+	case "v6only":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// familyRRs returns rrs without the A or AAAA records IpMode doesn't allow.
+func (config *Config) familyRRs(rrs []dns.RR) []dns.RR {
+	if config.IpMode == "" || config.IpMode == "dual" {
+		return rrs
+	}
+	j := 0
+	for _, r := range rrs {
+		switch r := r.(type) {
+		case *dns.A:
+			if !config.family(r.A) {
+				continue
+			}
+		case *dns.AAAA:
+			if !config.family(r.AAAA) {
+				continue
+			}
+		}
+		rrs[j] = r
+		j++
+	}
+	return rrs[:j]
+}
+
+// readResolvConf returns the nameservers (as ip:port) listed in the resolv.conf file.
+func readResolvConf(file string) ([]string, error) {
+	c, err := dns.ClientConfigFromFile(file)
+	if err != nil {
+		return nil, err
+	}
+	nameservers := make([]string, 0, len(c.Servers))
+	for _, s := range c.Servers {
+		nameservers = append(nameservers, net.JoinHostPort(s, c.Port))
+	}
+	return nameservers, nil
+}
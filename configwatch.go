@@ -0,0 +1,211 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const configKey = "/skydns/config"
+
+// liveOptions are the options a change of configKey applies while running,
+// the other ones need a Reload (SIGHUP) or a restart.
+var liveOptions = []string{"ttl", "min_ttl", "soa_minttl", "nameservers", "round_robin", "log_level"}
+
+// watchConfig watches configKey and applies the changes to the live options,
+// until s.done is closed. While etcd can't be reached the watch backs off. When
+// the watch falls behind etcd's history the configuration is read again.
+func (s *server) watchConfig() {
+	stop := make(chan bool)
+	go func() {
+		<-s.done
+		close(stop)
+	}()
+	bo := &backoff{min: time.Second, max: etcdBackoffMax}
+	index := uint64(0)
+	for {
+		r, err := s.client.Watch(configKey, index, false, nil, stop)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if err != nil || r == nil || r.Node == nil {
+			if indexCleared(err) {
+				// Changes were missed, so the configuration is read again as a whole.
+				s.config.log.Warning("the config watch fell behind etcd, reading the configuration again")
+				index = resyncIndex(err)
+				s.updateConfig()
+				continue
+			}
+			select {
+			case <-s.done:
+				return
+			case <-time.After(bo.next()):
+			}
+			continue
+		}
+		bo.reset()
+		index = r.Node.ModifiedIndex + 1
+		s.updateConfig()
+	}
+}
+
+// updateConfig loads the configuration again and applies the live options. A
+// configuration that doesn't load, or isn't valid, is rejected as a whole.
+func (s *server) updateConfig() {
+	config, err := LoadConfig(s.client)
+	if err != nil {
+		s.config.log.Errorf("rejected the changed configuration: %s", err.Error())
+		return
+	}
+	s.applyConfig(config)
+}
+
+// applyConfig applies the live options of config, a loaded and checked
+// configuration, to a copy of the current one and publishes it.
+func (s *server) applyConfig(config *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.current()
+	if others := otherChanges(cur.config, config); len(others) > 0 {
+		cur.config.log.Warningf("changes to %s are applied by a reload or restart", strings.Join(others, ", "))
+	}
+	ns := s.update(func(c *Config) {
+		c.Ttl, c.MinTtl, c.SoaMinttl = config.Ttl, config.MinTtl, config.SoaMinttl
+		if c.ClosestEncloser != nil && config.ClosestEncloser != nil {
+			c.ClosestEncloser, c.DenyWildcard = config.ClosestEncloser, config.DenyWildcard
+		}
+		c.RoundRobin = config.RoundRobin
+		// With resolv.conf nameservers on both sides, the watcher keeps them.
+		if !config.resolvConf || !c.resolvConf {
+			c.Nameservers = config.Nameservers
+			// LoadConfig set up TLS for the tls:// ones among them. The source
+			// addresses need nothing new, the one of the family of a nameserver
+			// is picked when forwarding.
+			c.forwardTLS = config.forwardTLS
+		}
+		c.resolvConf = config.resolvConf
+		c.LogLevel = config.LogLevel
+	})
+	old := cur.config
+	if old.Ttl != config.Ttl || old.MinTtl != config.MinTtl || old.SoaMinttl != config.SoaMinttl {
+		// The cached responses have the old TTLs.
+		ns.rcache.flush()
+		cache.flush()
+	}
+	if old.resolvConf != config.resolvConf {
+		if config.resolvConf {
+			ns.startResolvConf()
+		} else {
+			s.stopResolvConf()
+		}
+	}
+	if old.LogLevel != config.LogLevel {
+		setLogLevel(logLevels[config.LogLevel])
+	}
+	old.log.Info("applied the changed configuration")
+}
+
+// startResolvConf starts watchResolvConf, which runs until s.stop is closed or
+// stopResolvConf is called. The caller holds s.mu.
+func (s *server) startResolvConf() {
+	s.stopResolvConf()
+	off := make(chan struct{})
+	s.resolvStop = off
+	go s.watchResolvConf(s.config, 5*time.Second, s.stop, off)
+}
+
+// stopResolvConf stops watchResolvConf, if it runs. The caller holds s.mu.
+func (s *server) stopResolvConf() {
+	if s.resolvStop != nil {
+		close(s.resolvStop)
+		s.resolvStop = nil
+	}
+}
+
+// watchResolvConf checks the ResolvConf file of config every interval and
+// publishes the new list of nameservers when the file has changed, until stop
+// or off is closed.
+func (s *server) watchResolvConf(config *Config, interval time.Duration, stop, off chan struct{}) {
+	last, _ := os.Stat(config.ResolvConf)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-off:
+			return
+		case <-time.After(interval):
+		}
+		fi, err := os.Stat(config.ResolvConf)
+		if err != nil {
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		nameservers, err := readResolvConf(config.ResolvConf)
+		if err != nil {
+			config.log.Errorf("failure to reload %s: %s", config.ResolvConf, err.Error())
+			continue
+		}
+		if len(nameservers) == 0 {
+			config.log.Warningf("no nameservers found in %s, keeping the current ones", config.ResolvConf)
+			continue
+		}
+		s.mu.Lock()
+		select {
+		case <-off:
+			// Switched to other nameservers while we read the file.
+			s.mu.Unlock()
+			return
+		default:
+		}
+		s.update(func(c *Config) { c.Nameservers = nameservers })
+		s.mu.Unlock()
+		config.log.Infof("reloaded nameservers from %s: %s", config.ResolvConf, strings.Join(nameservers, ","))
+	}
+}
+
+// logLevel returns the configured log level.
+func (s *server) logLevel() string {
+	return s.current().config.LogLevel
+}
+
+// otherChanges returns the JSON names of the options, other than the live ones,
+// that differ between old and config.
+func otherChanges(old, config *Config) []string {
+	a, b := optionMap(old), optionMap(config)
+	for _, o := range liveOptions {
+		delete(a, o)
+		delete(b, o)
+	}
+	var names []string
+	for k, v := range a {
+		if !reflect.DeepEqual(v, b[k]) {
+			names = append(names, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func optionMap(config *Config) map[string]interface{} {
+	buf, _ := json.Marshal(config)
+	m := make(map[string]interface{})
+	json.Unmarshal(buf, &m)
+	return m
+}
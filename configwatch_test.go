@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/go-log/log"
+)
+
+func TestOtherChanges(t *testing.T) {
+	old := &Config{Domain: "skydns.local.", Ttl: 3600, Nameservers: []string{"8.8.8.8:53"}}
+	config := &Config{Domain: "skydns.local.", Ttl: 60, Nameservers: []string{"8.8.4.4:53"}, LogLevel: "debug"}
+	if others := otherChanges(old, config); len(others) != 0 {
+		t.Errorf("expected only live options to change, got %v", others)
+	}
+	config.Domain = "skydns.test."
+	config.CacheSize = 100
+	if others := otherChanges(old, config); !reflect.DeepEqual(others, []string{"cache_size", "domain"}) {
+		t.Errorf("expected cache_size and domain, got %v", others)
+	}
+}
+
+func TestResyncIndex(t *testing.T) {
+	err := &etcd.EtcdError{ErrorCode: 401, Message: "The event in requested index is outdated and cleared", Index: 2000}
+	if !indexCleared(err) {
+		t.Fatal("expected index outdated")
+	}
+	if indexCleared(&etcd.EtcdError{ErrorCode: 100}) {
+		t.Error("key not found is not index outdated")
+	}
+	if i := resyncIndex(err); i != 2001 {
+		t.Errorf("resyncIndex = %d, want 2001", i)
+	}
+}
+
+func TestApplyConfigTLSNameserver(t *testing.T) {
+	old := &Config{Domain: "skydns.local.", Nameservers: []string{"8.8.8.8:53"}, log: log.New("skydns", false, log.NullSink())}
+	if err := setForwardTLS(old); err != nil || old.forwardTLS != nil {
+		t.Fatalf("expected no TLS without tls:// nameservers, got %v", err)
+	}
+	s := NewServer(old, nil)
+
+	config := &Config{Domain: "skydns.local.", Nameservers: []string{"tls://1.1.1.1:853"}}
+	if err := setForwardTLS(config); err != nil {
+		t.Fatal(err)
+	}
+	s.applyConfig(config)
+	c := s.current().config
+	if c.forwardTLS == nil {
+		t.Fatal("no TLS configuration after adding a tls:// nameserver")
+	}
+	if !reflect.DeepEqual(c.Nameservers, config.Nameservers) {
+		t.Errorf("nameservers %v, want %v", c.Nameservers, config.Nameservers)
+	}
+	if c == old || !reflect.DeepEqual(old.Nameservers, []string{"8.8.8.8:53"}) {
+		t.Error("the configuration queries may still use is changed")
+	}
+}
+
+func TestApplyConfigResolvConf(t *testing.T) {
+	s := NewServer(&Config{Domain: "skydns.local.", Nameservers: []string{"10.0.0.1:53"}, ResolvConf: "/nonexistent",
+		resolvConf: true, log: log.New("skydns", false, log.NullSink())}, nil)
+	defer close(s.stop)
+	s.mu.Lock()
+	s.startResolvConf()
+	off := s.resolvStop
+	s.mu.Unlock()
+
+	s.applyConfig(&Config{Domain: "skydns.local.", Nameservers: []string{"8.8.8.8:53"}})
+	c := s.current().config
+	if c.resolvConf || s.resolvStop != nil {
+		t.Fatal("still taking the nameservers from resolv.conf")
+	}
+	select {
+	case <-off:
+	default:
+		t.Error("the resolv.conf watcher is not stopped")
+	}
+	if !reflect.DeepEqual(c.Nameservers, []string{"8.8.8.8:53"}) {
+		t.Errorf("nameservers %v, want 8.8.8.8:53", c.Nameservers)
+	}
+}
+
+func TestUpdateKeepsQueryState(t *testing.T) {
+	s := NewServer(&Config{Domain: "skydns.local.", Ttl: 3600, log: log.New("skydns", false, log.NullSink())}, nil)
+	q := s.current() // a query in flight
+
+	done := make(chan struct{})
+	go func() {
+		s.applyConfig(&Config{Domain: "skydns.local.", Ttl: 60})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the update waits for the query in flight")
+	}
+	if q.config.Ttl != 3600 {
+		t.Errorf("the query in flight sees ttl %d, want 3600", q.config.Ttl)
+	}
+	if c := s.current().config; c.Ttl != 60 {
+		t.Errorf("new queries see ttl %d, want 60", c.Ttl)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// With ForwardReuse the TCP and TLS connections to the nameservers are kept
+// open and shared by the queries: they are pipelined, each goes out with an ID
+// that is unique on its connection and the replies, which may come back in any
+// order, are matched to the queries by that ID (RFC 7766, section 6.2.1). A
+// connection is closed when it has been idle for ForwardIdleTimeout, or on an
+// error, it is dialed again by the next query.
+
+var errConnClosed = errors.New("connection to nameserver closed")
+
+// upstreams are the connections by nameserver, "tls://" for the TLS ones. A nil
+// *upstreams reuses nothing.
+type upstreams struct {
+	sync.Mutex
+	idle    time.Duration
+	conns   map[string]*upstream
+	dialing map[string]*dialCall // the dials going on, by nameserver
+}
+
+// dialCall is a dial to a nameserver, the queries that need the connection
+// while it is dialed wait for done.
+type dialCall struct {
+	done chan struct{}
+	u    *upstream
+	err  error
+}
+
+func newUpstreams(idle time.Duration) *upstreams {
+	return &upstreams{idle: idle, conns: make(map[string]*upstream), dialing: make(map[string]*dialCall)}
+}
+
+// upstream is one connection and the queries waiting for a reply on it.
+type upstream struct {
+	co   *dns.Conn
+	wmu  sync.Mutex // serializes the writes
+	done chan struct{}
+
+	sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	err     error // why done was closed
+}
+
+// exchange sends req to nameserver over the connection to it, dialing one with
+// dial when there is none, and waits at most timeout for the reply. When a
+// connection that was already open turns out to be closed by the nameserver,
+// the query is sent again on a new one.
+func (us *upstreams) exchange(req *dns.Msg, nameserver string, timeout time.Duration, dial func() (net.Conn, error)) (*dns.Msg, error) {
+	r, err, reused := us.exchangeOnce(req, nameserver, timeout, dial)
+	if err != nil && reused {
+		r, err, _ = us.exchangeOnce(req, nameserver, timeout, dial)
+	}
+	return r, err
+}
+
+// exchangeOnce is exchange without the retry, reused is true when the query
+// failed on a connection that was open before.
+func (us *upstreams) exchangeOnce(req *dns.Msg, nameserver string, timeout time.Duration, dial func() (net.Conn, error)) (r *dns.Msg, err error, reused bool) {
+	u, fresh, err := us.get(nameserver, dial)
+	if err != nil {
+		return nil, err, false
+	}
+	m := req.Copy()
+	ch := make(chan *dns.Msg, 1)
+	u.Lock()
+	if u.err != nil {
+		u.Unlock()
+		return nil, u.err, !fresh
+	}
+	for {
+		m.Id = dns.Id()
+		if _, ok := u.pending[m.Id]; !ok {
+			break
+		}
+	}
+	u.pending[m.Id] = ch
+	u.Unlock()
+	defer func() {
+		u.Lock()
+		delete(u.pending, m.Id)
+		u.Unlock()
+	}()
+
+	u.wmu.Lock()
+	u.co.SetWriteDeadline(time.Now().Add(timeout))
+	err = u.co.WriteMsg(m)
+	u.wmu.Unlock()
+	if err != nil {
+		us.remove(nameserver, u)
+		u.close(err)
+		return nil, err, !fresh
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		if len(r.Question) != len(m.Question) || (len(r.Question) > 0 && !strings.EqualFold(r.Question[0].Name, m.Question[0].Name)) {
+			return nil, errors.New("reply from " + nameserver + " does not match the query"), false
+		}
+		r.Id = req.Id
+		return r, nil, false
+	case <-u.done:
+		return nil, u.err, !fresh
+	case <-t.C:
+		return nil, errors.New("timeout waiting for the reply from " + nameserver), false
+	}
+}
+
+// get returns the connection to nameserver, dialing a new one when needed,
+// fresh is true for a new one. The dial is done without the lock, so a slow
+// nameserver only holds up the queries for itself; the ones that come in
+// during the dial wait for it.
+func (us *upstreams) get(nameserver string, dial func() (net.Conn, error)) (u *upstream, fresh bool, err error) {
+	us.Lock()
+	if u, ok := us.conns[nameserver]; ok {
+		us.Unlock()
+		return u, false, nil
+	}
+	if d, ok := us.dialing[nameserver]; ok {
+		us.Unlock()
+		<-d.done
+		return d.u, true, d.err
+	}
+	d := &dialCall{done: make(chan struct{})}
+	us.dialing[nameserver] = d
+	us.Unlock()
+
+	conn, err := dial()
+
+	us.Lock()
+	delete(us.dialing, nameserver)
+	switch {
+	case err != nil:
+		d.err = err
+	case us.conns[nameserver] != nil:
+		// Not while we are dialing, but check: one connection per nameserver.
+		conn.Close()
+		d.u = us.conns[nameserver]
+	default:
+		d.u = &upstream{co: &dns.Conn{Conn: conn}, done: make(chan struct{}), pending: make(map[uint16]chan *dns.Msg)}
+		us.conns[nameserver] = d.u
+		go us.read(nameserver, d.u)
+	}
+	us.Unlock()
+	close(d.done)
+	return d.u, true, d.err
+}
+
+func (us *upstreams) remove(nameserver string, u *upstream) {
+	us.Lock()
+	defer us.Unlock()
+	if us.conns[nameserver] == u {
+		delete(us.conns, nameserver)
+	}
+}
+
+// read hands the replies on u to the queries waiting for them, until the
+// connection fails or nothing is read for the idle timeout, which is longer
+// than the queries wait.
+func (us *upstreams) read(nameserver string, u *upstream) {
+	for {
+		u.co.SetReadDeadline(time.Now().Add(us.idle))
+		r, err := u.co.ReadMsg()
+		if err != nil {
+			// Removed first, so no new queries are sent on it.
+			us.remove(nameserver, u)
+			u.close(err)
+			return
+		}
+		u.Lock()
+		ch, ok := u.pending[r.Id]
+		u.Unlock()
+		if ok {
+			select {
+			case ch <- r:
+			default: // a second reply with this ID
+			}
+		}
+	}
+}
+
+// close closes the connection, the queries still waiting get err.
+func (u *upstream) close(err error) {
+	u.Lock()
+	defer u.Unlock()
+	if u.err != nil {
+		return
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		err = errConnClosed
+	}
+	u.err = err
+	u.co.Close()
+	close(u.done)
+}
+
+// close closes all connections.
+func (us *upstreams) close() {
+	if us == nil {
+		return
+	}
+	us.Lock()
+	conns := us.conns
+	us.conns = make(map[string]*upstream)
+	us.Unlock()
+	for _, u := range conns {
+		u.close(errConnClosed)
+	}
+}
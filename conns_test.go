@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type countListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestUpstreamsPipelining(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countListener{Listener: ln}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// The first queries are answered last.
+		i, _ := strconv.Atoi(dns.SplitDomainName(req.Question[0].Name)[0])
+		time.Sleep(time.Duration(10-i) * 10 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{new(Service).NewA(req.Question[0].Name, 60, net.IPv4(10, 0, 0, byte(i)))}
+		w.WriteMsg(m)
+	})
+	srv := &dns.Server{Listener: cl, Handler: handler}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	addr := ln.Addr().String()
+	us := newUpstreams(time.Second)
+	defer us.close()
+	dial := func() (net.Conn, error) { return net.Dial("tcp", addr) }
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(strconv.Itoa(i)+".example.org.", dns.TypeA)
+			r, err := us.exchange(req, addr, 2*time.Second, dial)
+			if err != nil {
+				t.Errorf("query %d: %s", i, err)
+				return
+			}
+			if r.Id != req.Id || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.IPv4(10, 0, 0, byte(i))) {
+				t.Errorf("query %d: wrong reply %v", i, r)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&cl.accepted); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestUpstreamsSlowDial(t *testing.T) {
+	us := newUpstreams(time.Second)
+	defer us.close()
+	release := make(chan struct{})
+	slow := func() (net.Conn, error) {
+		<-release
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	fast := func() (net.Conn, error) {
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	got := make(chan *upstream, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			u, _, err := us.get("slow", slow)
+			if err != nil {
+				t.Error(err)
+			}
+			got <- u
+		}()
+	}
+	// The dial to the slow nameserver must not hold up the others.
+	done := make(chan struct{})
+	go func() {
+		if _, _, err := us.get("fast", fast); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dialing a slow nameserver blocks the others")
+	}
+
+	close(release)
+	u1, u2 := <-got, <-got
+	if u1 == nil || u1 != u2 {
+		t.Error("the queries waiting for the dial got different connections")
+	}
+}
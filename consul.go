@@ -0,0 +1,227 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// With ConsulAddr the services in our domain are mirrored into the Consul
+// catalog, as the services of the node ConsulNode, for sites that migrate
+// from one to the other. Every change below the domain, or a minute passing,
+// syncs them: services are registered with the etcd key as their ID and
+// deregistered when the key is gone. Only the leader syncs. Services without
+// a host are left out, and the other services of the node are left alone.
+
+// consulService is a service in the Consul catalog.
+type consulService struct {
+	ID      string
+	Service string
+	Address string
+	Port    int
+	Tags    []string
+}
+
+// syncConsul mirrors the services into Consul until stop is closed. After a
+// failure the next try backs off.
+func (s *server) syncConsul(config *Config, stop chan struct{}) {
+	p, _ := Path(config.Domain)
+	bo := &backoff{min: time.Second, max: etcdBackoffMax}
+	index := uint64(0)
+	for {
+		if s.elector.isLeader() {
+			if err := s.updateConsul(config); err != nil {
+				config.log.Errorf("failure to sync the services to consul: %s", err.Error())
+				select {
+				case <-stop:
+					return
+				case <-time.After(bo.next()):
+				}
+				continue
+			}
+			bo.reset()
+		}
+		var ok bool
+		if index, ok = s.waitChange(p, index, time.Minute, stop); !ok {
+			return
+		}
+	}
+}
+
+// waitChange waits at most d for a change below p after index, and returns the
+// index to wait from next. It returns false when stop is closed. When the
+// watch fell behind etcd's history it returns at once, as if p changed.
+func (s *server) waitChange(p string, index uint64, d time.Duration, stop chan struct{}) (uint64, bool) {
+	stopWatch := make(chan bool)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-time.After(d):
+		case <-done:
+			return
+		}
+		close(stopWatch)
+	}()
+	r, err := s.client.Watch(p, index, true, nil, stopWatch)
+	if indexCleared(err) {
+		// Changes were missed, return right away so everything is synced again.
+		index = resyncIndex(err)
+	} else if err != nil || r == nil || r.Node == nil {
+		// Stopped, or etcd failed, the rest of d is waited out so we don't spin.
+		select {
+		case <-stopWatch:
+		case <-stop:
+		}
+		index = 0
+	} else {
+		index = r.Node.ModifiedIndex + 1
+	}
+	select {
+	case <-stop:
+		return 0, false
+	default:
+		return index, true
+	}
+}
+
+// updateConsul registers the services in Consul and deregisters the ones that
+// are gone.
+func (s *server) updateConsul(config *Config) error {
+	p, _ := Path(config.Domain)
+	r, err := s.client.Get(p, true, true)
+	if err != nil && !notFound(err) {
+		return err
+	}
+	want := make(map[string]*consulService)
+	if err == nil {
+		for _, cs := range config.consulServices(r.Node) {
+			want[cs.ID] = cs
+		}
+	}
+
+	var node struct {
+		Services map[string]*consulService
+	}
+	if err := config.consul("GET", "/v1/catalog/node/"+url.PathEscape(config.ConsulNode), nil, &node); err != nil {
+		return err
+	}
+	for id, cs := range want {
+		if have, ok := node.Services[id]; ok && sameService(have, cs) {
+			continue
+		}
+		reg := map[string]interface{}{"Node": config.ConsulNode, "Address": config.consulAddress(), "Service": cs, "SkipNodeUpdate": true}
+		if err := config.consul("PUT", "/v1/catalog/register", reg, nil); err != nil {
+			return err
+		}
+	}
+	for id := range node.Services {
+		if _, ok := want[id]; ok || !strings.HasPrefix(id, "/skydns/") {
+			continue
+		}
+		dereg := map[string]string{"Node": config.ConsulNode, "ServiceID": id}
+		if err := config.consul("PUT", "/v1/catalog/deregister", dereg, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consulServices returns the Consul services for the services in n and below it.
+// The name of a service in Consul is its name in our domain with dashes for the
+// dots, i.e. web-east for web.east.skydns.local. The tags are key=value.
+func (config *Config) consulServices(n *etcd.Node) (services []*consulService) {
+	var walk func(n *etcd.Node)
+	walk = func(n *etcd.Node) {
+		if n.Dir {
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+			return
+		}
+		serv, err := config.decodeService(n)
+		if err != nil || serv.Host == "" {
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(serviceName(n.Key), config.Domain), ".")
+		if name == "" {
+			return
+		}
+		cs := &consulService{ID: n.Key, Service: strings.Replace(name, ".", "-", -1), Address: serv.Host, Port: serv.Port}
+		for k, v := range serv.Tags {
+			cs.Tags = append(cs.Tags, k+"="+v)
+		}
+		sort.Strings(cs.Tags)
+		services = append(services, cs)
+	}
+	walk(n)
+	return services
+}
+
+// sameService returns true when a and b are the same, no tags and empty tags
+// are.
+func sameService(a, b *consulService) bool {
+	if a.ID != b.ID || a.Service != b.Service || a.Address != b.Address || a.Port != b.Port || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	for i := range a.Tags {
+		if a.Tags[i] != b.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// consulAddress returns the address of our node in Consul: the one of DnsAddr,
+// or 127.0.0.1 when it listens on all addresses.
+func (config *Config) consulAddress() string {
+	host, _, _ := net.SplitHostPort(config.DnsAddr)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return host
+	}
+	return "127.0.0.1"
+}
+
+// consul does the request to the Consul HTTP API with in as the JSON body and
+// decodes the reply into out, when not nil.
+func (config *Config) consul(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(config.ConsulAddr, "/")+path, &body)
+	if err != nil {
+		return err
+	}
+	if config.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", config.ConsulToken)
+	}
+	c := &http.Client{Timeout: 10 * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
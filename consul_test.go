@@ -0,0 +1,52 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestConsulServices(t *testing.T) {
+	config := &Config{Domain: "skydns.local.", Ttl: 3600}
+	root := &etcd.Node{Key: "/skydns/local/skydns", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/east/web", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/skydns/east/web/1", Value: `{"host":"10.0.0.1","port":80,"tags":{"env":"prod","app":"web"}}`},
+		}},
+		{Key: "/skydns/local/skydns/db", Value: `{"host":"10.0.0.2","port":5432}`},
+		{Key: "/skydns/local/skydns/txt", Value: `{"rr":["TXT hello"]}`},
+	}}
+	want := []*consulService{
+		{ID: "/skydns/local/skydns/east/web/1", Service: "web-east", Address: "10.0.0.1", Port: 80, Tags: []string{"app=web", "env=prod"}},
+		{ID: "/skydns/local/skydns/db", Service: "db", Address: "10.0.0.2", Port: 5432},
+	}
+	if got := config.consulServices(root); !reflect.DeepEqual(got, want) {
+		t.Errorf("consulServices = %v, want %v", got, want)
+	}
+	if !sameService(want[1], &consulService{ID: want[1].ID, Service: "db", Address: "10.0.0.2", Port: 5432, Tags: []string{}}) {
+		t.Error("sameService: want no tags to be empty tags")
+	}
+}
+
+func TestConsulTokenNotInConfig(t *testing.T) {
+	config := &Config{ConsulAddr: "http://127.0.0.1:8500", ConsulToken: "secret"}
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("the Consul token is in the JSON of the config: %s", b)
+	}
+	// Nor can it be set from etcd.
+	config = new(Config)
+	json.Unmarshal([]byte(`{"consul_token":"secret"}`), config)
+	if config.ConsulToken != "" {
+		t.Error("the Consul token is read from the JSON config")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// debugPrefix is the label a TXT query for a name in our domain is prefixed with
+// to get the debug answer for that name, i.e. o-o.debug.web.skydns.local.
+const debugPrefix = "o-o.debug."
+
+// debugName returns the name a debug query for name is about, or "" when name
+// is not a debug query.
+func (config *Config) debugName(name string) string {
+	if !config.DebugQueries || !strings.HasPrefix(name, debugPrefix) {
+		return ""
+	}
+	name = strings.TrimPrefix(name, debugPrefix)
+	if !strings.HasSuffix(name, config.Domain) {
+		return ""
+	}
+	return name
+}
+
+// debugRecords returns TXT records that describe how name is looked up in view:
+// the state of etcd and, per key that matches, its TTL, value and whether it is
+// used for answers. The records have a TTL of 0, so they are never cached.
+func (s *server) debugRecords(ctx context.Context, owner, name, view string) []dns.RR {
+	var lines []string
+	if s.breaker.isOpen() {
+		lines = append(lines, "etcd: unreachable, answering from the snapshot")
+	} else {
+		lines = append(lines, "etcd: ok")
+	}
+	r, parts, star, wildcard, err := s.lookup(ctx, name, view)
+	switch {
+	case notFound(err):
+		lines = append(lines, "no keys for "+name)
+	case err != nil:
+		lines = append(lines, "error: "+err.Error())
+	default:
+		if wildcard {
+			lines = append(lines, "matched by a wildcard")
+		}
+		var sx []*Service
+		var walk func(n *etcd.Node)
+		walk = func(n *etcd.Node) {
+			if n.Dir {
+				for _, c := range n.Nodes {
+					walk(c)
+				}
+				return
+			}
+			if star && !matchStar(n.Key, parts) {
+				return
+			}
+			serv, err := s.config.decodeService(n)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("key %s: invalid: %s", n.Key, err))
+				return
+			}
+			sx = append(sx, serv)
+		}
+		walk(r.Node)
+		gx, _ := group(sx)
+		used := make(map[*Service]bool)
+		for _, serv := range gx {
+			used[serv] = true
+		}
+		for _, serv := range sx {
+			state := "used"
+			if !used[serv] {
+				state = "not used, not in group " + gx[0].Group
+			}
+			lines = append(lines, fmt.Sprintf("key %s: ttl %d, host %s, port %d, priority %d: %s", serv.key, serv.ttl, serv.Host, serv.Port, serv.Priority, state))
+		}
+	}
+	hdr := dns.RR_Header{Name: owner, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
+	rrs := make([]dns.RR, 0, len(lines))
+	for _, l := range lines {
+		if len(l) > 255 {
+			l = l[:255]
+		}
+		rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: []string{l}})
+	}
+	return rrs
+}
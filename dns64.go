@@ -0,0 +1,94 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64 (RFC 6147): AAAA records are synthesized from the A records of names
+// forwarded to the nameservers that have no AAAA records of their own, using
+// the NAT64 prefix in Dns64Prefix.
+
+// parseDns64Prefix parses prefix, which must have one of the lengths of RFC 6052.
+func parseDns64Prefix(prefix string) (*net.IPNet, error) {
+	ip, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	if ip.To4() != nil || bits != 128 {
+		return nil, fmt.Errorf("%q is not an IPv6 prefix", prefix)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return n, nil
+	}
+	return nil, fmt.Errorf("prefix length of %q must be 32, 40, 48, 56, 64 or 96", prefix)
+}
+
+// embedIPv4 returns the IPv6 address for v4 within prefix, see section 2.2 of RFC 6052.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	i := ones / 8
+	for _, b := range v4.To4() {
+		if i == 8 {
+			i++ // bits 64 to 71 (the "u" octet) must be zero
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// dns64 returns r, the reply to req. When req is an AAAA query and r a reply without AAAA records,
+// the A records are asked from nameserver and a reply with AAAA records synthesized from those is
+// returned instead.
+func (s *server) dns64(c *dns.Client, req, r *dns.Msg, nameserver string) *dns.Msg {
+	if s.config.dns64 == nil || req.Question[0].Qtype != dns.TypeAAAA || req.CheckingDisabled || r.Rcode != dns.RcodeSuccess {
+		return r
+	}
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return r
+		}
+	}
+	reqA := req.Copy()
+	reqA.Question[0].Qtype = dns.TypeA
+	ra, err := s.exchange(c, reqA, nameserver)
+	if err != nil || ra.Rcode != dns.RcodeSuccess {
+		return r
+	}
+	// The TTL is at most that of the SOA in the negative AAAA reply, see section 5.1.7 of RFC 6147.
+	ttl, negative := negativeTtl(r)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = ra.RecursionAvailable
+	synthesized := false
+	for _, rr := range ra.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			m.Answer = append(m.Answer, rr)
+		case *dns.A:
+			aaaa := &dns.AAAA{Hdr: rr.Hdr, AAAA: embedIPv4(s.config.dns64, rr.A)}
+			aaaa.Hdr.Rrtype = dns.TypeAAAA
+			if negative && ttl < aaaa.Hdr.Ttl {
+				aaaa.Hdr.Ttl = ttl
+			}
+			m.Answer = append(m.Answer, aaaa)
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return r
+	}
+	StatsDns64Count.Inc(1)
+	return m
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDns64Embed(t *testing.T) {
+	// The examples from section 2.4 of RFC 6052.
+	for prefix, want := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+	} {
+		n, err := parseDns64Prefix(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := embedIPv4(n, net.ParseIP("192.0.2.33")); !ip.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: expected %s, got %s", prefix, want, ip)
+		}
+	}
+	if _, err := parseDns64Prefix("64:ff9b::/80"); err == nil {
+		t.Error("expected an error for a /80 prefix")
+	}
+}
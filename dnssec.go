@@ -5,9 +5,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base32"
+	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -48,24 +52,108 @@ func ParseKeyFile(file string) (*dns.DNSKEY, dns.PrivateKey, error) {
 	return k.(*dns.DNSKEY), p, nil
 }
 
+// keyFile returns the basename of the DNSSEC key files.
+func (config *Config) keyFile() string {
+	// For some reason the + are replaces by spaces in etcd. Re-replace them
+	return strings.Replace(config.DNSSEC, " ", "+", -1)
+}
+
+// loadKey reads the DNSSEC key files, the key must be for config.Domain.
+func (config *Config) loadKey() (*dns.DNSKEY, dns.PrivateKey, error) {
+	k, p, err := ParseKeyFile(config.keyFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	if k.Header().Name != dns.Fqdn(config.Domain) {
+		return nil, nil, fmt.Errorf("ownername of DNSKEY must match SkyDNS domain")
+	}
+	k.Header().Ttl = config.Ttl
+	return k, p, nil
+}
+
+// keyModTime returns the latest modification time of the DNSSEC key files.
+func (config *Config) keyModTime() (time.Time, error) {
+	var t time.Time
+	for _, ext := range []string{".key", ".private"} {
+		fi, err := os.Stat(config.keyFile() + ext)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// watchKey checks the DNSSEC key files of config every interval and swaps in
+// the new key when they have changed, until stop is closed.
+func (s *server) watchKey(config *Config, interval time.Duration, stop chan struct{}) {
+	last, _ := config.keyModTime()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		t, err := config.keyModTime()
+		if err != nil || t.Equal(last) {
+			continue
+		}
+		last = t
+		if err := s.swapKey(config); err != nil {
+			config.log.Errorf("failure to reload the DNSSEC key: %s", err.Error())
+		}
+	}
+}
+
+// swapKey reads the DNSSEC key files of config again and swaps in the key.
+// The signatures of the old key, and the replies carrying them, are flushed
+// from the caches.
+// A key that doesn't load leaves the current one in use.
+func (s *server) swapKey(config *Config) error {
+	k, p, err := config.loadKey()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.current().config; old.PubKey != nil {
+		cache.flushKey(old.PubKey.Hdr.Name, old.KeyTag)
+	}
+	ns := s.update(func(c *Config) {
+		c.PubKey, c.KeyTag, c.PrivKey = k, k.KeyTag(), p
+	})
+	ns.rcache.flush()
+	config.log.Infof("reloaded the DNSSEC key, key tag %d", k.KeyTag())
+	return nil
+}
+
 // Denial creates (if needed) NSEC3 records that are included in the reply.
-func (s *server) Denial(m *dns.Msg) {
+func (s *server) Denial(ctx context.Context, m *dns.Msg) {
 	if m.Rcode == dns.RcodeNameError {
 		// Deny Qname nsec3
-		nsec3 := s.NewNSEC3NameError(m.Question[0].Name)
+		qname := strings.ToLower(m.Question[0].Name)
+		nsec3 := s.NewNSEC3NameError(qname)
 		m.Ns = append(m.Ns, nsec3)
 
-		if nsec3.Hdr.Name != s.config.ClosestEncloser.Hdr.Name {
-			m.Ns = append(m.Ns, s.config.ClosestEncloser)
+		// Below a subtree that exists, the closest encloser and the wildcard
+		// we deny are that subtree's, not the apex's.
+		ce, deny := s.config.ClosestEncloser, s.config.DenyWildcard
+		if name, _, err := s.closestEncloser(ctx, qname, ""); err == nil && name != s.config.Domain {
+			ce, deny = newNSEC3CEandWildcard(s.config.Domain, name, s.config.MinTtl)
 		}
-		if nsec3.Hdr.Name != s.config.DenyWildcard.Hdr.Name {
-			m.Ns = append(m.Ns, s.config.DenyWildcard)
+		if nsec3.Hdr.Name != ce.Hdr.Name {
+			m.Ns = append(m.Ns, ce)
+		}
+		if nsec3.Hdr.Name != deny.Hdr.Name {
+			m.Ns = append(m.Ns, deny)
 		}
 	}
 	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
 		// NODATA
 		if _, ok := m.Ns[0].(*dns.SOA); ok {
-		m.Ns = append(m.Ns, s.NewNSEC3NoData(m.Question[0].Name))
+		m.Ns = append(m.Ns, s.NewNSEC3NoData(strings.ToLower(m.Question[0].Name)))
 		}
 	}
 }
@@ -77,7 +165,7 @@ func (s *server) Denial(m *dns.Msg) {
 // throw away signatures when services decide to have longer TTL. So we just
 // set the origTTL to 60.
 // TODO(miek): revisit origTTL
-func (s *server) sign(m *dns.Msg, bufsize uint16) {
+func (s *server) sign(ctx context.Context, m *dns.Msg) {
 	now := time.Now().UTC()
 	incep := uint32(now.Add(-3 * time.Hour).Unix())     // 2+1 hours, be sure to catch daylight saving time and such
 	expir := uint32(now.Add(7 * 24 * time.Hour).Unix()) // sign for a week
@@ -86,7 +174,7 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 		if r[0].Header().Rrtype == dns.TypeRRSIG {
 			continue
 		}
-		if sig, err := s.signSet(r, now, incep, expir); err == nil {
+		if sig, err := s.signSet(ctx, r, now, incep, expir); err == nil {
 			m.Answer = append(m.Answer, sig)
 		}
 	}
@@ -94,7 +182,7 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 		if r[0].Header().Rrtype == dns.TypeRRSIG {
 			continue
 		}
-		if sig, err := s.signSet(r, now, incep, expir); err == nil {
+		if sig, err := s.signSet(ctx, r, now, incep, expir); err == nil {
 			m.Ns = append(m.Ns, sig)
 		}
 	}
@@ -102,24 +190,24 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 		if r[0].Header().Rrtype == dns.TypeRRSIG {
 			continue
 		}
-		if sig, err := s.signSet(r, now, incep, expir); err == nil {
+		if sig, err := s.signSet(ctx, r, now, incep, expir); err == nil {
 			m.Extra = append(m.Extra, sig)
 		}
 	}
-	if bufsize >= 512 || bufsize <= 4096 {
-		m.Truncated = m.Len() > int(bufsize)
-	}
 	o := new(dns.OPT)
 	o.Hdr.Name = "."
 	o.Hdr.Rrtype = dns.TypeOPT
 	o.SetDo()
-	o.SetUDPSize(4096) // TODO(miek): echo client
+	o.SetUDPSize(s.config.EdnsUdpSize)
 	m.Extra = append(m.Extra, o)
 	return
 }
 
-func (s *server) signSet(r []dns.RR, now time.Time, incep, expir uint32) (*dns.RRSIG, error) {
-	key := cache.key(r)
+func (s *server) signSet(ctx context.Context, r []dns.RR, now time.Time, incep, expir uint32) (*dns.RRSIG, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := cache.key(s.config.PubKey.Hdr.Name, s.config.KeyTag, r)
 	if sig := cache.search(key); sig != nil {
 		// Is it still valid 24 hours from now?
 		if sig.ValidityPeriod(now.Add(+24 * time.Hour)) {
@@ -127,9 +215,9 @@ func (s *server) signSet(r []dns.RR, now time.Time, incep, expir uint32) (*dns.R
 		}
 		cache.remove(key)
 	}
-	s.config.log.Infof("cache miss for %s type %d", r[0].Header().Name, r[0].Header().Rrtype)
+	s.config.log.Debugf("cache miss for %s type %d", r[0].Header().Name, r[0].Header().Rrtype)
 	StatsDnssecCacheMiss.Inc(1)
-	sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
+	v, err, shared := inflight.Do(key, func() (interface{}, error) {
 		sig1 := s.NewRRSIG(incep, expir)
 		sig1.Header().Ttl = r[0].Header().Ttl
 		if r[0].Header().Rrtype == dns.TypeTXT {
@@ -144,6 +232,7 @@ func (s *server) signSet(r []dns.RR, now time.Time, incep, expir uint32) (*dns.R
 	if err != nil {
 		return nil, err
 	}
+	sig := v.(*dns.RRSIG)
 	if !shared {
 		cache.insert(key, sig)
 	}
@@ -244,7 +333,7 @@ func newNSEC3CEandWildcard(apex, ce string, ttl uint32) (*dns.NSEC3, *dns.NSEC3)
 	n2.Flags = 0
 	n2.Salt = ""
 
-	buf = packBase32("*." + apex)
+	buf = packBase32("*." + ce)
 	byteArith(buf, false) // one before
 	n2.Hdr.Name = strings.ToLower(unpackBase32(buf)) + "." + apex
 	byteArith(buf, true) // one next
@@ -281,27 +370,77 @@ type rrset struct {
 	qtype uint16
 }
 
-func rrSets(rrs []dns.RR) map[rrset][]dns.RR {
-	m := make(map[rrset][]dns.RR)
+// rrSets groups rrs in RRsets, in the order the first record of each set is
+// found in rrs. The records of a set are sorted in the canonical order, so the
+// same set always has the same cache key and signature. The order of rrs itself
+// is left alone.
+func rrSets(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	idx := make(map[rrset]int)
 	for _, r := range rrs {
-		if s, ok := m[rrset{r.Header().Name, r.Header().Rrtype}]; ok {
-			s = append(s, r)
-			m[rrset{r.Header().Name, r.Header().Rrtype}] = s
-		} else {
-			s := make([]dns.RR, 1, 3)
-			s[0] = r
-			m[rrset{r.Header().Name, r.Header().Rrtype}] = s
+		k := rrset{r.Header().Name, r.Header().Rrtype}
+		if i, ok := idx[k]; ok {
+			sets[i] = append(sets[i], r)
+			continue
 		}
+		idx[k] = len(sets)
+		s := make([]dns.RR, 1, 3)
+		s[0] = r
+		sets = append(sets, s)
 	}
-	if len(m) > 0 {
-		return m
+	for _, s := range sets {
+		sortCanonical(s)
+	}
+	return sets
+}
+
+// sortCanonical sorts the records of an RRset on their rdata in wire format,
+// the canonical order of RFC 4034, section 6.3.
+func sortCanonical(rrs []dns.RR) {
+	if len(rrs) < 2 {
+		return
+	}
+	rdata := make([][]byte, len(rrs))
+	for i, r := range rrs {
+		rdata[i] = wireRdata(r)
+	}
+	sort.Sort(byRdata{rrs, rdata})
+}
+
+// wireRdata returns the rdata of r in uncompressed wire format.
+func wireRdata(r dns.RR) []byte {
+	buf := make([]byte, dns.Len(r)+256)
+	off, err := dns.PackRR(r, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	name, err := dns.PackDomainName(r.Header().Name, buf[off:], 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	// The name, type, class, TTL and rdlength come before the rdata.
+	if hdr := name + 10; hdr < off {
+		return buf[hdr:off]
 	}
 	return nil
 }
 
+type byRdata struct {
+	rrs   []dns.RR
+	rdata [][]byte
+}
+
+func (b byRdata) Len() int           { return len(b.rrs) }
+func (b byRdata) Less(i, j int) bool { return bytes.Compare(b.rdata[i], b.rdata[j]) < 0 }
+func (b byRdata) Swap(i, j int) {
+	b.rrs[i], b.rrs[j] = b.rrs[j], b.rrs[i]
+	b.rdata[i], b.rdata[j] = b.rdata[j], b.rdata[i]
+}
+
 type sigCache struct {
 	sync.RWMutex
-	m map[string]*dns.RRSIG
+	m     map[string]*dns.RRSIG
+	bytes int64
 }
 
 func newCache() *sigCache {
@@ -311,17 +450,70 @@ func newCache() *sigCache {
 }
 
 func (c *sigCache) remove(s string) {
-	delete(c.m, s)
+	c.Lock()
+	defer c.Unlock()
+	c.drop(s)
 }
 
+// flush removes all signatures from the cache.
+func (c *sigCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.m = make(map[string]*dns.RRSIG)
+	c.account(-int(c.bytes))
+}
+
+// flushKey removes the signatures made with the key with keytag for zone, the
+// ones of other keys stay.
+func (c *sigCache) flushKey(zone string, keytag uint16) {
+	prefix := keyPrefix(zone, keytag)
+	c.Lock()
+	defer c.Unlock()
+	for k := range c.m {
+		if strings.HasPrefix(k, prefix) {
+			c.drop(k)
+		}
+	}
+}
+
+// insert adds r under s, random signatures are evicted when r does not fit
+// in the memory budget.
 func (c *sigCache) insert(s string, r *dns.RRSIG) {
 	c.Lock()
 	defer c.Unlock()
-	if _, ok := c.m[s]; !ok {
+	if _, ok := c.m[s]; ok {
+		return
+	}
+	n := sigSize(s, r)
+	for k := range c.m {
+		if memory.fits(n) {
+			break
+		}
+		StatsCacheEvictCount.Inc(1)
+		c.drop(k)
+	}
+	if memory.fits(n) {
 		c.m[s] = r
+		c.account(n)
+	}
+}
+
+// drop removes the signature for s. The caller holds the lock.
+func (c *sigCache) drop(s string) {
+	if r, ok := c.m[s]; ok {
+		delete(c.m, s)
+		c.account(-sigSize(s, r))
 	}
 }
 
+func (c *sigCache) account(n int) {
+	c.bytes += int64(n)
+	memory.add(n)
+	StatsSigCacheMemory.Update(c.bytes)
+}
+
+func sigSize(s string, r *dns.RRSIG) int { return dns.Len(r) + len(s) + entryOverhead }
+
 func (c *sigCache) search(s string) *dns.RRSIG {
 	c.RLock()
 	defer c.RUnlock()
@@ -334,75 +526,29 @@ func (c *sigCache) search(s string) *dns.RRSIG {
 	return nil
 }
 
-// key uses the name, type and rdata, which is serialized and then hashed as the
-// key for the lookup
-func (c *sigCache) key(rrs []dns.RR) string {
+// key returns the cache key of the signature over rrs: the owner name, the
+// type and the rdata of every record in wire format, hashed. It is prefixed
+// with the zone and key tag of the signing key, see keyPrefix. The records
+// must be in canonical order, as rrSets returns them.
+func (c *sigCache) key(zone string, keytag uint16, rrs []dns.RR) string {
 	h := sha1.New()
-	i := []byte(rrs[0].Header().Name)
-	i = append(i, packUint16(rrs[0].Header().Rrtype)...)
+	// Signatures are made over the lower cased names, so they are the same for every case.
+	h.Write([]byte(strings.ToLower(rrs[0].Header().Name)))
+	h.Write(packUint16(rrs[0].Header().Rrtype))
 	for _, r := range rrs {
-		switch t := r.(type) { // we only do a few type, serialize these manually
-		case *dns.SOA:
-			// We only fiddle with the serial so store that.
-			i = append(i, packUint32(t.Serial)...)
-		case *dns.SRV:
-			i = append(i, packUint16(t.Priority)...)
-			i = append(i, packUint16(t.Weight)...)
-			i = append(i, packUint16(t.Weight)...)
-			i = append(i, []byte(t.Target)...)
-		case *dns.A:
-			i = append(i, []byte(t.A)...)
-		case *dns.AAAA:
-			i = append(i, []byte(t.AAAA)...)
-		case *dns.NSEC3:
-			i = append(i, []byte(t.NextDomain)...)
-			// Bitmap does not differentiate in SkyDNS.
-		case *dns.DNSKEY:
-		case *dns.NS:
-		case *dns.TXT:
-		}
+		rdata := wireRdata(r)
+		// With the length, the rdata of two records can't run into each other.
+		h.Write(packUint16(uint16(len(rdata))))
+		h.Write(rdata)
 	}
-	return string(h.Sum(i))
-}
-
-func packUint16(i uint16) []byte { return []byte{byte(i >> 8), byte(i)} }
-func packUint32(i uint32) []byte { return []byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)} }
-
-// Adapted from singleinflight.go from the original Go Code. Copyright 2013 The Go Authors.
-type call struct {
-	wg   sync.WaitGroup
-	val  *dns.RRSIG
-	err  error
-	dups int
+	return keyPrefix(zone, keytag) + string(h.Sum(nil))
 }
 
-type single struct {
-	sync.Mutex
-	m map[string]*call
+// keyPrefix returns the start of the keys of the signatures made with the key
+// with keytag for zone. A zone name can't hold a zero byte, so the prefix of
+// one zone is never the start of another's.
+func keyPrefix(zone string, keytag uint16) string {
+	return strings.ToLower(dns.Fqdn(zone)) + "\x00" + string(packUint16(keytag))
 }
 
-func (g *single) Do(key string, fn func() (*dns.RRSIG, error)) (*dns.RRSIG, error, bool) {
-	g.Lock()
-	if g.m == nil {
-		g.m = make(map[string]*call)
-	}
-	if c, ok := g.m[key]; ok {
-		c.dups++
-		g.Unlock()
-		c.wg.Wait()
-		return c.val, c.err, true
-	}
-	c := new(call)
-	c.wg.Add(1)
-	g.m[key] = c
-	g.Unlock()
-
-	c.val, c.err = fn()
-	c.wg.Done()
-
-	g.Lock()
-	delete(g.m, key)
-	g.Unlock()
-
-	return c.val, c.err, c.dups > 0
-}
+func packUint16(i uint16) []byte { return []byte{byte(i >> 8), byte(i)} }
@@ -0,0 +1,149 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-log/log"
+	"github.com/miekg/dns"
+)
+
+func writeTestKey(t *testing.T, base, name string) *dns.DNSKEY {
+	k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags: 256, Protocol: 3, Algorithm: dns.RSASHA256}
+	p, err := k.Generate(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".key", []byte(k.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".private", []byte(k.PrivateKeyString(p)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSwapKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "Kskydns.test.")
+
+	config := &Config{Domain: "skydns.test.", Ttl: 3600, DNSSEC: base, log: log.New("skydns", false, log.NullSink())}
+	s := NewServer(config, nil)
+	k1 := writeTestKey(t, base, "skydns.test.")
+	if err := s.swapKey(config); err != nil {
+		t.Fatal(err)
+	}
+	if c := s.current().config; c.KeyTag != k1.KeyTag() {
+		t.Fatalf("key tag %d, want %d", c.KeyTag, k1.KeyTag())
+	}
+	if config.PubKey != nil {
+		t.Error("the key is swapped in the configuration queries may still use")
+	}
+
+	rrs := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.skydns.test.", Rrtype: dns.TypeA, Class: dns.ClassINET}}}
+	key := cache.key("skydns.test.", k1.KeyTag(), rrs)
+	cache.insert(key, new(dns.RRSIG))
+	k2 := writeTestKey(t, base, "skydns.test.")
+	if err := s.swapKey(config); err != nil {
+		t.Fatal(err)
+	}
+	if c := s.current().config; c.KeyTag != k2.KeyTag() || c.PubKey.PublicKey != k2.PublicKey {
+		t.Fatalf("key tag %d, want %d", c.KeyTag, k2.KeyTag())
+	}
+	if cache.search(key) != nil {
+		t.Error("signature made with the old key is still cached")
+	}
+
+	// A key for another zone is rejected and the current one stays.
+	writeTestKey(t, base, "example.org.")
+	if err := s.swapKey(config); err == nil {
+		t.Fatal("expected an error for a key of another zone")
+	}
+	if c := s.current().config; c.KeyTag != k2.KeyTag() {
+		t.Errorf("key tag %d, want %d", c.KeyTag, k2.KeyTag())
+	}
+}
+
+func TestSigCacheFlushKey(t *testing.T) {
+	c := newCache()
+	rrs := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.skydns.test.", Rrtype: dns.TypeA, Class: dns.ClassINET}}}
+	k1 := c.key("skydns.test.", 1, rrs)
+	k2 := c.key("skydns.test.", 2, rrs)
+	k3 := c.key("other.test.", 1, rrs)
+	for _, k := range []string{k1, k2, k3} {
+		c.insert(k, new(dns.RRSIG))
+	}
+	c.flushKey("skydns.test.", 1)
+	if c.search(k1) != nil {
+		t.Error("signature of the flushed key is still cached")
+	}
+	if c.search(k2) == nil || c.search(k3) == nil {
+		t.Error("signatures of other keys are flushed")
+	}
+	c.flush()
+}
+
+func TestRRSetsCanonical(t *testing.T) {
+	rrs := []dns.RR{
+		newA("a.skydns.test. IN A 10.0.0.2"),
+		newAAAA("a.skydns.test. IN AAAA ::1"),
+		newA("a.skydns.test. IN A 10.0.0.1"),
+	}
+	sets := rrSets(rrs)
+	if len(sets) != 2 {
+		t.Fatalf("rrSets = %d sets, want 2", len(sets))
+	}
+	if sets[0][0].Header().Rrtype != dns.TypeA || sets[1][0].Header().Rrtype != dns.TypeAAAA {
+		t.Fatal("sets are not in the order of their first record")
+	}
+	if sets[0][0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("A set is not sorted: %v", sets[0])
+	}
+	if rrs[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Error("the records of the message are reordered")
+	}
+
+	swapped := rrSets([]dns.RR{rrs[2], rrs[0]})
+	if cache.key("skydns.test.", 1, sets[0]) != cache.key("skydns.test.", 1, swapped[0]) {
+		t.Error("the same set in another order has another cache key")
+	}
+}
+
+func TestSigCacheKeyCollisions(t *testing.T) {
+	newRR := func(s string) dns.RR { r, _ := dns.NewRR(s); return r }
+	pairs := [][2][]dns.RR{
+		{{newRR("a.skydns.test. IN SRV 10 20 8080 b.skydns.test.")}, {newRR("a.skydns.test. IN SRV 10 20 9090 b.skydns.test.")}},
+		{{newRR("a.skydns.test. IN SRV 10 20 8080 b.skydns.test.")}, {newRR("a.skydns.test. IN SRV 10 30 8080 b.skydns.test.")}},
+		{{newRR(`a.skydns.test. IN TXT "one"`)}, {newRR(`a.skydns.test. IN TXT "two"`)}},
+		{{newRR("skydns.test. IN NS ns1.dns.skydns.test.")}, {newRR("skydns.test. IN NS ns2.dns.skydns.test.")}},
+		{{newRR("skydns.test. IN DNSKEY 256 3 8 AwEAAQ==")}, {newRR("skydns.test. IN DNSKEY 257 3 8 AwEAAQ==")}},
+		{{newRR("skydns.test. IN SOA ns1.dns.skydns.test. hostmaster.skydns.test. 1 28800 7200 604800 60")},
+			{newRR("skydns.test. IN SOA ns1.dns.skydns.test. hostmaster.skydns.test. 2 28800 7200 604800 60")}},
+		// The rdata of the records in a set must not run into each other.
+		{{newRR(`a.skydns.test. IN TXT "ab"`), newRR(`a.skydns.test. IN TXT "c"`)},
+			{newRR(`a.skydns.test. IN TXT "a"`), newRR(`a.skydns.test. IN TXT "bc"`)}},
+	}
+	for i, p := range pairs {
+		if cache.key("skydns.test.", 1, p[0]) == cache.key("skydns.test.", 1, p[1]) {
+			t.Errorf("%d: %s and %s have the same cache key", i, p[0][0], p[1][0])
+		}
+	}
+
+	// Only the case of the owner name doesn't matter.
+	a := []dns.RR{newRR("A.skydns.test. IN A 10.0.0.1")}
+	b := []dns.RR{newRR("a.skydns.test. IN A 10.0.0.1")}
+	if cache.key("skydns.test.", 1, a) != cache.key("skydns.test.", 1, b) {
+		t.Error("names that differ in case have different cache keys")
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/miekg/dns"
+)
+
+// Dnstap (http://dnstap.info) support. The protobuf messages and the Frame
+// Streams protocol are both small enough to encode by hand, which saves us
+// two dependencies.
+
+// Dnstap message types we log.
+const (
+	tapClientQuery       = 5
+	tapClientResponse    = 6
+	tapForwarderQuery    = 7
+	tapForwarderResponse = 8
+)
+
+const tapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types.
+const (
+	fstrmAccept = 0x01
+	fstrmStart  = 0x02
+	fstrmReady  = 0x04
+
+	fstrmContentType = 0x01
+)
+
+// tapper sends dnstap messages to a collector.
+type tapper struct {
+	network, addr string
+	identity      []byte
+	frames        chan []byte
+	log           *log.Logger
+}
+
+// newTapper returns a tapper that sends to dest, which is "unix:/path" or "tcp:host:port".
+func newTapper(dest string, l *log.Logger) (*tapper, error) {
+	i := strings.Index(dest, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("bad dnstap destination: %q", dest)
+	}
+	t := &tapper{network: dest[:i], addr: dest[i+1:], frames: make(chan []byte, 1000), log: l}
+	if t.network != "unix" && t.network != "tcp" {
+		return nil, fmt.Errorf("bad dnstap destination: %q", dest)
+	}
+	hostname, _ := os.Hostname()
+	t.identity = []byte(hostname)
+	return t, nil
+}
+
+// run connects to the collector and writes the frames, reconnecting on errors.
+func (t *tapper) run() {
+	for {
+		conn, err := net.Dial(t.network, t.addr)
+		if err != nil {
+			t.log.Errorf("failure to connect to dnstap collector: %s", err.Error())
+			t.discard(5 * time.Second)
+			continue
+		}
+		if err := t.handshake(conn); err != nil {
+			t.log.Errorf("failure to start dnstap stream: %s", err.Error())
+			conn.Close()
+			t.discard(5 * time.Second)
+			continue
+		}
+		for f := range t.frames {
+			if _, err := conn.Write(f); err != nil {
+				t.log.Errorf("failure to write dnstap frame: %s", err.Error())
+				break
+			}
+		}
+		conn.Close()
+	}
+}
+
+// discard drops frames for duration d, so the senders never block while we
+// can't reach the collector.
+func (t *tapper) discard(d time.Duration) {
+	timeout := time.After(d)
+	for {
+		select {
+		case <-t.frames:
+			StatsDnstapDroppedCount.Inc(1)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// handshake does the bidirectional Frame Streams handshake: READY, ACCEPT, START.
+func (t *tapper) handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(controlFrame(fstrmReady)); err != nil {
+		return err
+	}
+	typ, err := readControlFrame(conn)
+	if err != nil {
+		return err
+	}
+	if typ != fstrmAccept {
+		return fmt.Errorf("expected ACCEPT control frame, got %d", typ)
+	}
+	_, err = conn.Write(controlFrame(fstrmStart))
+	return err
+}
+
+// controlFrame returns a Frame Streams control frame of type typ with our content type.
+func controlFrame(typ uint32) []byte {
+	b := make([]byte, 0, 32)
+	b = appendUint32(b, 0) // escape
+	b = appendUint32(b, uint32(12+len(tapContentType)))
+	b = appendUint32(b, typ)
+	b = appendUint32(b, fstrmContentType)
+	b = appendUint32(b, uint32(len(tapContentType)))
+	return append(b, tapContentType...)
+}
+
+// readControlFrame reads a control frame and returns its type.
+func readControlFrame(r io.Reader) (uint32, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return 0, fmt.Errorf("expected control frame")
+	}
+	l := binary.BigEndian.Uint32(hdr[4:])
+	if l < 4 || l > 512 {
+		return 0, fmt.Errorf("bad control frame length %d", l)
+	}
+	body := make([]byte, l)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(body[:4]), nil
+}
+
+// tap queues a dnstap message of type typ for m. Peer is the address of the
+// client or the nameserver, local our own address. The message is dropped when
+// the queue is full.
+func (t *tapper) tap(typ int, m *dns.Msg, local, peer net.Addr, tcp bool) {
+	if t == nil {
+		return
+	}
+	buf, err := pack(m)
+	if err != nil {
+		return
+	}
+	defer putBuf(buf)
+	now := time.Now()
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(typ))
+
+	query, response := peer, local // client messages: the client is the query address
+	if typ == tapForwarderQuery || typ == tapForwarderResponse {
+		query, response = local, peer
+	}
+	qip, qport := splitAddr(query)
+	rip, rport := splitAddr(response)
+	family := uint64(1)
+	if qip.To4() == nil && rip.To4() == nil {
+		family = 2
+	}
+	msg = appendVarintField(msg, 2, family)
+	proto := uint64(1)
+	if tcp {
+		proto = 2
+	}
+	msg = appendVarintField(msg, 3, proto)
+	if qip != nil {
+		msg = appendBytesField(msg, 4, ipBytes(qip))
+		msg = appendVarintField(msg, 6, uint64(qport))
+	}
+	if rip != nil {
+		msg = appendBytesField(msg, 5, ipBytes(rip))
+		msg = appendVarintField(msg, 7, uint64(rport))
+	}
+	if typ == tapClientQuery || typ == tapForwarderQuery {
+		msg = appendVarintField(msg, 8, uint64(now.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(now.Nanosecond()))
+		msg = appendBytesField(msg, 10, buf)
+	} else {
+		msg = appendVarintField(msg, 12, uint64(now.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(now.Nanosecond()))
+		msg = appendBytesField(msg, 14, buf)
+	}
+
+	var d []byte
+	d = appendBytesField(d, 1, t.identity)
+	d = appendBytesField(d, 2, []byte("SkyDNS2"))
+	d = appendBytesField(d, 14, msg)
+	d = appendVarintField(d, 15, 1) // MESSAGE
+
+	frame := appendUint32(make([]byte, 0, 4+len(d)), uint32(len(d)))
+	frame = append(frame, d...)
+	select {
+	case t.frames <- frame:
+	default:
+		StatsDnstapDroppedCount.Inc(1)
+	}
+}
+
+func splitAddr(a net.Addr) (net.IP, int) {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func appendUint32(b []byte, i uint32) []byte {
+	return append(b, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+}
+
+func appendVarint(b []byte, i uint64) []byte {
+	for i >= 0x80 {
+		b = append(b, byte(i)|0x80)
+		i >>= 7
+	}
+	return append(b, byte(i))
+}
+
+func appendVarintField(b []byte, field int, i uint64) []byte {
+	b = appendVarint(b, uint64(field<<3))
+	return appendVarint(b, i)
+}
+
+func appendFixed32Field(b []byte, field int, i uint32) []byte {
+	b = appendVarint(b, uint64(field<<3|5))
+	return append(b, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|2))
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// tapWriter is a dns.ResponseWriter that logs the replies to the tapper.
+type tapWriter struct {
+	dns.ResponseWriter
+	t *tapper
+}
+
+func (w *tapWriter) WriteMsg(m *dns.Msg) error {
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	w.t.tap(tapClientResponse, m, w.LocalAddr(), w.RemoteAddr(), tcp)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// nameserverAddr returns the address of nameserver as a net.Addr.
+func nameserverAddr(nameserver string, tcp bool) net.Addr {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(nameserver, "tls://"))
+	if err != nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	if tcp {
+		return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestProtobufEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"varint 0", appendVarint(nil, 0), []byte{0x00}},
+		{"varint 127", appendVarint(nil, 127), []byte{0x7f}},
+		{"varint 128", appendVarint(nil, 128), []byte{0x80, 0x01}},
+		{"varint 300", appendVarint(nil, 300), []byte{0xac, 0x02}},
+		{"varint max", appendVarint(nil, 1<<64-1), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"varint field", appendVarintField(nil, 1, 5), []byte{0x08, 0x05}},
+		{"varint field 15", appendVarintField(nil, 15, 1), []byte{0x78, 0x01}},
+		{"varint field 16", appendVarintField(nil, 16, 1), []byte{0x80, 0x01, 0x01}},
+		{"fixed32 field", appendFixed32Field(nil, 9, 0x01020304), []byte{0x4d, 0x04, 0x03, 0x02, 0x01}},
+		{"bytes field", appendBytesField(nil, 14, []byte("ab")), []byte{0x72, 0x02, 'a', 'b'}},
+		{"empty bytes field", appendBytesField(nil, 1, nil), []byte{0x0a, 0x00}},
+	}
+	for _, tc := range tests {
+		if !bytes.Equal(tc.got, tc.want) {
+			t.Errorf("%s: got % x, want % x", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+// decodeProto decodes the fields of a protobuf message, the varints as
+// uint64, fixed32 as uint32 and length delimited fields as []byte.
+func decodeProto(t *testing.T, b []byte) map[int]interface{} {
+	fields := make(map[int]interface{})
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag in % x", b)
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint in % x", b)
+			}
+			fields[int(tag>>3)], b = v, b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length in % x", b)
+			}
+			fields[int(tag>>3)], b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			fields[int(tag>>3)], b = binary.LittleEndian.Uint32(b), b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+func TestTapMessage(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	local := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 53}
+	ns := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}
+	tests := []struct {
+		typ          int
+		local, peer  net.Addr
+		tcp          bool
+		family       uint64
+		protocol     uint64
+		query        net.IP
+		queryPort    uint64
+		response     net.IP
+		responsePort uint64
+		msgField     int
+	}{
+		{tapClientQuery, local, client, false, 1, 1, client.IP, 1234, local.IP, 53, 10},
+		{tapClientResponse, local, client, false, 1, 1, client.IP, 1234, local.IP, 53, 14},
+		{tapForwarderQuery, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4321}, ns, true, 2, 2,
+			net.ParseIP("2001:db8::2"), 4321, ns.IP, 53, 10},
+		{tapForwarderResponse, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4321}, ns, true, 2, 2,
+			net.ParseIP("2001:db8::2"), 4321, ns.IP, 53, 14},
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.test.", dns.TypeA)
+	for _, tc := range tests {
+		tp := &tapper{identity: []byte("host"), frames: make(chan []byte, 1)}
+		tp.tap(tc.typ, m, tc.local, tc.peer, tc.tcp)
+		frame := <-tp.frames
+		if l := binary.BigEndian.Uint32(frame); int(l) != len(frame)-4 {
+			t.Fatalf("%d: frame length %d, want %d", tc.typ, l, len(frame)-4)
+		}
+		d := decodeProto(t, frame[4:])
+		if string(d[1].([]byte)) != "host" || string(d[2].([]byte)) != "SkyDNS2" || d[15] != uint64(1) {
+			t.Errorf("%d: bad dnstap fields: %v", tc.typ, d)
+		}
+		msg := decodeProto(t, d[14].([]byte))
+		checks := []struct {
+			field int
+			want  interface{}
+		}{
+			{1, uint64(tc.typ)},
+			{2, tc.family},
+			{3, tc.protocol},
+			{6, tc.queryPort},
+			{7, tc.responsePort},
+		}
+		for _, c := range checks {
+			if msg[c.field] != c.want {
+				t.Errorf("%d: field %d is %v, want %v", tc.typ, c.field, msg[c.field], c.want)
+			}
+		}
+		if !bytes.Equal(msg[4].([]byte), ipBytes(tc.query)) || !bytes.Equal(msg[5].([]byte), ipBytes(tc.response)) {
+			t.Errorf("%d: addresses %v and %v, want %s and %s", tc.typ, msg[4], msg[5], tc.query, tc.response)
+		}
+		wire, ok := msg[tc.msgField].([]byte)
+		if !ok {
+			t.Fatalf("%d: no message in field %d", tc.typ, tc.msgField)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(wire); err != nil || r.Question[0].Name != "skydns.test." {
+			t.Errorf("%d: bad message: %v", tc.typ, err)
+		}
+	}
+}
+
+func TestControlFrame(t *testing.T) {
+	bad := controlFrame(fstrmAccept)
+	bad[3] = 1
+	long := controlFrame(fstrmAccept)
+	binary.BigEndian.PutUint32(long[4:], 1024)
+	tests := []struct {
+		name string
+		in   []byte
+		typ  uint32
+		ok   bool
+	}{
+		{"accept", controlFrame(fstrmAccept), fstrmAccept, true},
+		{"ready", controlFrame(fstrmReady), fstrmReady, true},
+		{"data frame", bad, 0, false},
+		{"too long", long, 0, false},
+		{"short", controlFrame(fstrmAccept)[:10], 0, false},
+	}
+	for _, tc := range tests {
+		typ, err := readControlFrame(bytes.NewReader(tc.in))
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: expected ok to be %t, got %v", tc.name, tc.ok, err)
+			continue
+		}
+		if tc.ok && typ != tc.typ {
+			t.Errorf("%s: type %d, want %d", tc.name, typ, tc.typ)
+		}
+	}
+}
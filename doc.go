@@ -10,14 +10,18 @@ top of Ectd (https://github.com/coreos/etcd). It utilizes DNS queries
 to discover available services. This is done by leveraging SRV records in DNS,
 with special meaning given to subdomains, priorities and weights.
 
-SkyDNS' configuration is stored in etcd: there are no flags. To start SkyDNS, set the
-etcd machines with the environment variable ETCD_MACHINES:
+SkyDNS' configuration is stored in etcd. To start SkyDNS, set the
+etcd machines with the environment variable ETCD_MACHINES (or the -machines flag):
 
     export ETCD_MACHINES='http://192.168.0.1:4001,http://192.168.0.2:4001'
     ./skydns
 
 If `ETCD_MACHINES` is not set, SkyDNS will default to using `http://127.0.0.1:4001` to connect to etcd.
 
+The configuration can also be read from a local JSON file with -config, options in the
+file override the ones in etcd. Flags (-addr, -domain, -dnssec, -nameservers, -admin
+and -health) override both. With -validate-config SkyDNS checks the configuration and exits.
+
 The configuration is stored in etcd under the key `/skydns/config`. The following parameters
 may be set:
 
@@ -42,12 +46,16 @@ To set the configuration, use something like:
     curl -XPUT http://127.0.0.1:4001/v2/keys/skydns/config \
         -d value='{"dns_addr":"127.0.0.1:5354","ttl":3600}'
 
-SkyDNS needs to be restarted for configuration changes to take effect.
+Send SkyDNS a SIGHUP to reload the configuration (including the DNSSEC key) without dropping
+queries. Only changes to `dns_addr`, `dnstap` and `query_log` need a restart.
 
 SkyDNS uses these environment variables:
 
 TODO(miek): list them here
 
+Every flag can also be set with a SKYDNS_ environment variable, i.e. SKYDNS_NAMESERVERS
+for -nameservers and SKYDNS_VALIDATE_CONFIG for -validate-config.
+
 Announce your service by submitting JSON over HTTP to etcd with information about your service.
 This information will then be available for queries via DNS.
 We use the directory `/skydns` to anchor all names.
@@ -145,6 +153,8 @@ option: `Kskydns.local.+005+49860`, like so (together with some other options):
         value='{"dns_addr":"127.0.0.1:5354","dnssec":"Kskydns.local.+005+55656"}'
 
 If you then query with `dig +dnssec` you will get signatures, keys and NSEC3 records returned.
+The key files are checked every 5 seconds, a new key written to them is used without a
+reload and the signatures made with the old one are thrown away.
 Authenticated denial of existence is implemented using NSEC3 whitelies, 
 see RFC7129 (http://tools.ietf.org/html/rfc7129), Appendix B.
 */
@@ -0,0 +1,124 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DNS over QUIC (RFC 9250). Every query comes on a stream of its own,
+// prefixed with its length as over TCP, and the reply goes back on the same
+// stream. QUIC validates the address of the client in the handshake, so the
+// queries are served as TCP queries: they are not truncated or rate limited.
+
+const (
+	doqALPN          = "doq"
+	doqProtocolError = 0x2 // DOQ_PROTOCOL_ERROR
+)
+
+var errDoQID = errors.New("doq: message ID is not 0")
+
+// runDoQ listens for DNS over QUIC on addr until s.done is closed.
+func (s *server) runDoQ(addr string) error {
+	tc := s.config.serverTLS.Clone()
+	tc.NextProtos = []string{doqALPN}
+	l, err := quic.ListenAddr(addr, tc, &quic.Config{})
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-s.done
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				select {
+				case <-s.done:
+				default:
+					s.config.log.Errorf("doq listener failed: %s", err.Error())
+				}
+				return
+			}
+			go s.serveDoQConn(conn)
+		}
+	}()
+	return nil
+}
+
+// serveDoQConn serves the streams of conn until the client closes it.
+func (s *server) serveDoQConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := s.serveDoQStream(stream, conn.LocalAddr(), conn.RemoteAddr()); err != nil {
+				conn.CloseWithError(doqProtocolError, err.Error())
+			}
+		}()
+	}
+}
+
+// serveDoQStream answers the query on stream. It returns an error when the
+// client broke the protocol, the connection must then be closed.
+func (s *server) serveDoQStream(stream io.ReadWriteCloser, local, remote net.Addr) error {
+	defer stream.Close()
+	req, err := readDoQ(stream)
+	if err != nil {
+		return err
+	}
+	if a, ok := remote.(*net.UDPAddr); ok {
+		remote = &net.TCPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	cw := &captureWriter{local: local, remote: remote}
+	s.ServeDNS(cw, req)
+	if cw.m == nil {
+		return nil
+	}
+	cw.m.Id = 0
+	return writeDoQ(stream, cw.m)
+}
+
+// readDoQ reads a length prefixed query, which must have ID 0.
+func readDoQ(r io.Reader) (*dns.Msg, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if m.Id != 0 {
+		return nil, errDoQID
+	}
+	return m, nil
+}
+
+// writeDoQ writes m prefixed with its length.
+func writeDoQ(w io.Writer, m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 2, 2+len(buf))
+	binary.BigEndian.PutUint16(b, uint16(len(buf)))
+	_, err = w.Write(append(b, buf...))
+	return err
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoQFraming(t *testing.T) {
+	query := func(id uint16) []byte {
+		m := new(dns.Msg)
+		m.SetQuestion("skydns.test.", dns.TypeA)
+		m.Id = id
+		var b bytes.Buffer
+		if err := writeDoQ(&b, m); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	tests := []struct {
+		name string
+		in   []byte
+		ok   bool
+	}{
+		{"id 0", query(0), true},
+		{"id not 0", query(1234), false},
+		{"short length", []byte{0}, false},
+		{"short message", query(0)[:10], false},
+		{"empty", nil, false},
+	}
+	for _, tc := range tests {
+		m, err := readDoQ(bytes.NewReader(tc.in))
+		if tc.ok && err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+		if tc.ok && (m == nil || m.Question[0].Name != "skydns.test.") {
+			t.Errorf("%s: got %v", tc.name, m)
+		}
+	}
+}
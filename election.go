@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/coreos/go-log/log"
+)
+
+// electionKey is the etcd key the SkyDNS replicas compete for. The value is
+// the id of the leader and it expires when the leader stops refreshing it.
+const electionKey = "/skydns/leader"
+
+// elector runs an election in etcd among the SkyDNS replicas. All replicas
+// serve queries, but only the leader should do things that have side effects
+// outside SkyDNS, like syncing the PTR records, these check isLeader.
+type elector struct {
+	client *etcd.Client
+	id     string
+	ttl    time.Duration
+	leader int32 // use atomically
+	log    *log.Logger
+}
+
+func newElector(client *etcd.Client, ttl time.Duration, addr string, l *log.Logger) *elector {
+	hostname, _ := os.Hostname()
+	id := fmt.Sprintf("%s/%s/%d", hostname, addr, os.Getpid())
+	return &elector{client: client, id: id, ttl: ttl, log: l}
+}
+
+// isLeader returns true when we are the leader, e is nil when there is no
+// election: then every replica is the leader.
+func (e *elector) isLeader() bool {
+	return e == nil || atomic.LoadInt32(&e.leader) == 1
+}
+
+// run takes part in the election until stop is closed. The leader refreshes
+// the key every third of the ttl, the others try to create it. While etcd
+// can't be reached the tries back off.
+func (e *elector) run(stop chan struct{}) {
+	ttl := uint64(e.ttl / time.Second)
+	bo := &backoff{min: e.ttl / 3, max: etcdBackoffMax}
+	failing := false
+	for {
+		var err error
+		if e.isLeader() {
+			if _, err = e.client.CompareAndSwap(electionKey, e.id, ttl, e.id, 0); err != nil {
+				e.log.Warningf("lost the leadership: %s", err.Error())
+				e.setLeader(false)
+			}
+		} else {
+			if _, err = e.client.Create(electionKey, e.id, ttl); err == nil {
+				e.log.Infof("elected leader as %s", e.id)
+				e.setLeader(true)
+			} else if ee, ok := err.(*etcd.EtcdError); ok && ee.ErrorCode == 105 { // 105: key exists
+				err = nil
+			} else if !failing {
+				e.log.Errorf("failure to take part in the election: %s", err.Error())
+			}
+		}
+		wait := e.ttl / 3
+		switch {
+		case etcdFailure(err):
+			failing = true
+			wait = bo.next()
+		case failing:
+			e.log.Infof("taking part in the election again")
+			failing = false
+			bo.reset()
+		}
+		select {
+		case <-stop:
+			if e.isLeader() {
+				e.setLeader(false)
+				e.client.CompareAndDelete(electionKey, e.id, 0)
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (e *elector) setLeader(leader bool) {
+	if leader {
+		atomic.StoreInt32(&e.leader, 1)
+		return
+	}
+	atomic.StoreInt32(&e.leader, 0)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// With ExistenceFilter a Bloom filter of the names below the domain is kept,
+// rebuilt from etcd on every change below the domain and at least every
+// minute. A name the filter doesn't hold, and that isn't below a wildcard it
+// holds, gets NXDOMAIN without an etcd lookup. A Bloom filter has no false
+// negatives, so a name that exists is never denied; a name registered since
+// the last rebuild may be, until the watch sees it.
+
+// The fraction of names that don't exist the filter lets through, to etcd.
+const bloomFalsePositives = 0.01
+
+// bloom is a Bloom filter of names.
+type bloom struct {
+	bits []uint64
+	k    uint32 // hash functions
+}
+
+// newBloom returns a filter sized for n names.
+func newBloom(n int) *bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(bloomFalsePositives) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Ceil(float64(m) / float64(n) * math.Ln2))
+	return &bloom{bits: make([]uint64, (m+63)/64), k: k}
+}
+
+// bloomHashes returns the two hashes the k bit positions of name are made from.
+func bloomHashes(name string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (b *bloom) add(name string) {
+	h1, h2 := bloomHashes(name)
+	m := uint32(len(b.bits) * 64)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// has returns false when name was surely not added.
+func (b *bloom) has(name string) bool {
+	h1, h2 := bloomHashes(name)
+	m := uint32(len(b.bits) * 64)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// existence holds the filter of the names below a domain.
+type existence struct {
+	sync.RWMutex
+	domain string
+	names  *bloom // nil until the names are loaded
+}
+
+func (e *existence) set(domain string, b *bloom) {
+	e.Lock()
+	defer e.Unlock()
+	e.domain, e.names = domain, b
+}
+
+// absent returns true when name, below domain, surely doesn't exist: neither
+// the name nor a wildcard above it is in the filter. Names with a "*" label,
+// or a label starting with an underscore as in _http._tcp SRV queries, are
+// not decided by the filter.
+func (e *existence) absent(name, domain string) bool {
+	e.RLock()
+	defer e.RUnlock()
+	if e.names == nil || e.domain != domain || name == domain || !dns.IsSubDomain(domain, name) {
+		return false
+	}
+	labels := dns.SplitDomainName(name)
+	for _, l := range labels {
+		if l == "*" || strings.HasPrefix(l, "_") {
+			return false
+		}
+	}
+	if e.names.has(name) {
+		return false
+	}
+	for i := 1; i < len(labels); i++ {
+		a := dns.Fqdn(strings.Join(labels[i:], "."))
+		if e.names.has("*." + a) {
+			return false
+		}
+		if a == domain {
+			break
+		}
+	}
+	return true
+}
+
+// existenceNames returns the names of n and the nodes below it.
+func existenceNames(n *etcd.Node) []string {
+	if n == nil {
+		return nil
+	}
+	names := []string{strings.ToLower(Domain(n.Key))}
+	for _, c := range n.Nodes {
+		names = append(names, existenceNames(c)...)
+	}
+	return names
+}
+
+// syncExistence rebuilds the filter of the names in config.Domain, on every
+// change below it, until stop is closed. After a failure the next try backs off.
+func (s *server) syncExistence(config *Config, stop chan struct{}) {
+	p, _ := Path(config.Domain)
+	bo := &backoff{min: time.Second, max: etcdBackoffMax}
+	index := uint64(0)
+	for {
+		r, err := s.client.Get(p, false, true)
+		if err != nil && !notFound(err) {
+			config.log.Errorf("failure to load the names for the existence filter: %s", err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(bo.next()):
+			}
+			continue
+		}
+		bo.reset()
+		var names []string
+		if err == nil {
+			names = existenceNames(r.Node)
+		}
+		b := newBloom(len(names))
+		for _, n := range names {
+			b.add(n)
+		}
+		s.exists.set(config.Domain, b)
+		var ok bool
+		if index, ok = s.waitChange(p, index, time.Minute, stop); !ok {
+			return
+		}
+	}
+}
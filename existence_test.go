@@ -0,0 +1,75 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestBloom(t *testing.T) {
+	b := newBloom(1000)
+	for i := 0; i < 1000; i++ {
+		b.add(fmt.Sprintf("%d.web.skydns.local.", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !b.has(fmt.Sprintf("%d.web.skydns.local.", i)) {
+			t.Fatalf("%d.web.skydns.local. is added, but not in the filter", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if b.has(fmt.Sprintf("%d.db.skydns.local.", i)) {
+			fp++
+		}
+	}
+	if fp > 300 {
+		t.Errorf("%d false positives in 10000, want about 100", fp)
+	}
+}
+
+func TestExistenceAbsent(t *testing.T) {
+	root := &etcd.Node{Key: "/skydns/local/skydns", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/web", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/skydns/web/1", Value: `{"host":"10.0.0.1"}`},
+		}},
+		{Key: "/skydns/local/skydns/preview", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/skydns/preview/*", Value: `{"host":"10.0.0.2"}`},
+		}},
+	}}
+	b := newBloom(1000) // roomy, so the names below are no false positives
+	for _, n := range existenceNames(root) {
+		b.add(n)
+	}
+	e := new(existence)
+	if e.absent("db.skydns.local.", "skydns.local.") {
+		t.Error("absent before the names are loaded")
+	}
+	e.set("skydns.local.", b)
+	tests := []struct {
+		name   string
+		absent bool
+	}{
+		{"web.skydns.local.", false},
+		{"1.web.skydns.local.", false},
+		{"2.web.skydns.local.", true},
+		{"db.skydns.local.", true},
+		{"a.b.preview.skydns.local.", false}, // below the wildcard
+		{"*.web.skydns.local.", false},
+		{"_http._tcp.web.skydns.local.", false},
+		{"skydns.local.", false},
+		{"example.org.", false},
+	}
+	for _, tc := range tests {
+		if got := e.absent(tc.name, "skydns.local."); got != tc.absent {
+			t.Errorf("absent(%s) = %t, want %t", tc.name, got, tc.absent)
+		}
+	}
+	if e.absent("db.skydns.test.", "skydns.test.") {
+		t.Error("absent for another domain than the filter's")
+	}
+}
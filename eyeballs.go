@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The happy_eyeballs forward policy works like Happy Eyeballs (RFC 8305) does
+// for connections: the IPv6 and IPv4 nameservers are tried interleaved, a next
+// one every RaceDelay until there is a valid reply. The family that gave the
+// last valid reply goes first, so a broken IPv6 path costs a delay once, not
+// on every query.
+
+// ipv6 returns true if the address of nameserver is an IPv6 address.
+func ipv6(nameserver string) bool {
+	host, _, err := net.SplitHostPort(strings.TrimPrefix(nameserver, "tls://"))
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// interleave returns nameservers with the IPv6 and IPv4 ones alternating,
+// starting with IPv6 when v6first is true. The order within a family is kept.
+func interleave(nameservers []string, v6first bool) []string {
+	var first, second []string
+	for _, n := range nameservers {
+		if ipv6(n) == v6first {
+			first = append(first, n)
+		} else {
+			second = append(second, n)
+		}
+	}
+	ordered := make([]string, 0, len(nameservers))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// exchangeEyeballs sends req to the nameservers in the order of interleave, a
+// next one every RaceDelay or as soon as one fails. The first valid reply, not
+// a SERVFAIL or REFUSED, is returned, or else the last reply received.
+func (s *server) exchangeEyeballs(c *dns.Client, req *dns.Msg, nameservers []string) (*dns.Msg, error) {
+	nameservers = interleave(nameservers, atomic.LoadInt32(&s.preferIPv4) == 0)
+	results := make(chan exchangeResult, len(nameservers))
+	next := 0
+	start := func() {
+		nameserver := nameservers[next]
+		next++
+		go func() {
+			r, err := s.exchange(c, req, nameserver)
+			if err == nil && r.Rcode != dns.RcodeServerFailure && r.Rcode != dns.RcodeRefused {
+				prefer := int32(1)
+				if ipv6(nameserver) {
+					prefer = 0
+				}
+				atomic.StoreInt32(&s.preferIPv4, prefer)
+			}
+			results <- exchangeResult{r, err}
+		}()
+	}
+	start()
+
+	ticker := time.NewTicker(s.config.RaceDelay)
+	defer ticker.Stop()
+
+	var last exchangeResult
+	for running := 1; running > 0; {
+		select {
+		case <-ticker.C:
+			if next < len(nameservers) {
+				start()
+				running++
+			}
+		case res := <-results:
+			running--
+			if res.err == nil && res.r.Rcode != dns.RcodeServerFailure && res.r.Rcode != dns.RcodeRefused {
+				return res.r, nil
+			}
+			if res.err == nil || last.r == nil {
+				last = res
+			}
+			if next < len(nameservers) {
+				// Failed fast, don't wait for the ticker.
+				start()
+				running++
+			}
+		}
+	}
+	return last.r, last.err
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterleave(t *testing.T) {
+	nameservers := []string{"8.8.8.8:53", "8.8.4.4:53", "[2001:4860:4860::8888]:53", "9.9.9.9:53", "tls://[2001:4860:4860::8844]:853"}
+	v6 := []string{"[2001:4860:4860::8888]:53", "8.8.8.8:53", "tls://[2001:4860:4860::8844]:853", "8.8.4.4:53", "9.9.9.9:53"}
+	if got := interleave(nameservers, true); !reflect.DeepEqual(got, v6) {
+		t.Errorf("expected %v, got %v", v6, got)
+	}
+	v4 := []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53", "8.8.4.4:53", "tls://[2001:4860:4860::8844]:853", "9.9.9.9:53"}
+	if got := interleave(nameservers, false); !reflect.DeepEqual(got, v4) {
+		t.Errorf("expected %v, got %v", v4, got)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// sharedExchange is forwardExchange, done once for the identical queries that
+// come in while it is going on. Each of them gets its own copy of the reply.
+func (s *server) sharedExchange(ctx context.Context, c *dns.Client, req *dns.Msg, nameservers []string) (*dns.Msg, error) {
+	key := c.Net + "/" + msgKey(req, "")
+	v, err, shared := s.forwards.Do(key, func() (interface{}, error) {
+		return s.forwardExchange(ctx, c, req, nameservers)
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := v.(*dns.Msg)
+	if shared {
+		r = r.Copy()
+		r.Id = req.Id
+		echoCase(r, req.Question[0].Name)
+	}
+	return r, nil
+}
+
+// forwardExchange sends req to the nameservers, according to ForwardPolicy,
+// and returns the reply of the first one that answers.
+func (s *server) forwardExchange(ctx context.Context, c *dns.Client, req *dns.Msg, nameservers []string) (*dns.Msg, error) {
+	// Use request Id for "random" nameserver selection
+	nsid := int(req.Id) % len(nameservers)
+	if (s.config.ForwardPolicy == "race" || s.config.ForwardPolicy == "happy_eyeballs") && len(nameservers) > 1 {
+		var (
+			r   *dns.Msg
+			err error
+		)
+		if s.config.ForwardPolicy == "race" {
+			r, err = s.exchangeRace(c, req, nameservers, nsid)
+		} else {
+			r, err = s.exchangeEyeballs(c, req, nameservers)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.dns64(c, req, r, nameservers[nsid]), nil
+	}
+	try := 0
+Redo:
+	c.ReadTimeout = timeout(ctx, s.config.ReadTimeout)
+	r, err := s.exchange(c, req, nameservers[nsid])
+	if err == nil {
+		return s.dns64(c, req, r, nameservers[nsid]), nil
+	}
+	// Seen an error, this can only mean, "server not reached", try again
+	// but only if we have not exausted our nameservers
+	if try < len(nameservers) && ctx.Err() == nil {
+		try++
+		nsid = (nsid + 1) % len(nameservers)
+		goto Redo
+	}
+	return nil, err
+}
+
+// exchange sends req to nameserver using c. If Forward0x20 is set the case of the
+// question name is randomized and must be echoed back unchanged by the nameserver.
+func (s *server) exchange(c *dns.Client, req *dns.Msg, nameserver string) (*dns.Msg, error) {
+	if !s.config.Forward0x20 || len(req.Question) == 0 {
+		return s.exchangeRaw(c, req, nameserver)
+	}
+	name := req.Question[0].Name
+	req0x20 := req.Copy()
+	req0x20.Question[0].Name = randomizeCase(name)
+
+	r, err := s.exchangeRaw(c, req0x20, nameserver)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Question) == 0 || r.Question[0].Name != req0x20.Question[0].Name {
+		return nil, fmt.Errorf("case of question name not preserved by %s", nameserver)
+	}
+	echoCase(r, name)
+	return r, nil
+}
+
+// exchangeRaw sends req to nameserver using c. When a reply over UDP comes back
+// truncated, the query is retried over TCP, so the client gets the full answer.
+func (s *server) exchangeRaw(c *dns.Client, req *dns.Msg, nameserver string) (*dns.Msg, error) {
+	if strings.HasPrefix(nameserver, "tls://") {
+		s.tapper.tap(tapForwarderQuery, req, nil, nameserverAddr(nameserver, true), true)
+		r, err := s.exchangeTLS(req, strings.TrimPrefix(nameserver, "tls://"), c.ReadTimeout)
+		if err == nil {
+			s.tapper.tap(tapForwarderResponse, r, nil, nameserverAddr(nameserver, true), true)
+		}
+		return r, err
+	}
+	tcp := c.Net == "tcp"
+	s.tapper.tap(tapForwarderQuery, req, nil, nameserverAddr(nameserver, tcp), tcp)
+	var (
+		r   *dns.Msg
+		err error
+	)
+	if tcp {
+		r, err = s.exchangeTCP(req, nameserver, c.ReadTimeout)
+	} else {
+		r, _, err = s.config.sourceClient(c, nameserver).Exchange(req, nameserver)
+	}
+	if err == nil {
+		s.tapper.tap(tapForwarderResponse, r, nil, nameserverAddr(nameserver, tcp), tcp)
+	}
+	if err != nil || !r.Truncated || tcp {
+		return r, err
+	}
+	s.tapper.tap(tapForwarderQuery, req, nil, nameserverAddr(nameserver, true), true)
+	rt, err := s.exchangeTCP(req, nameserver, c.ReadTimeout)
+	if err != nil {
+		// Better a truncated reply than none at all.
+		s.config.log.Warningf("failure to retry truncated reply over tcp: %s", err.Error())
+		return r, nil
+	}
+	s.tapper.tap(tapForwarderResponse, rt, nil, nameserverAddr(nameserver, true), true)
+	return rt, nil
+}
+
+// exchangeTCP sends req to nameserver over TCP, on the open connection to it
+// with ForwardReuse.
+func (s *server) exchangeTCP(req *dns.Msg, nameserver string, timeout time.Duration) (*dns.Msg, error) {
+	if s.conns != nil {
+		return s.conns.exchange(req, nameserver, timeout, func() (net.Conn, error) {
+			d := s.dialer(nameserver, timeout)
+			return d.Dial("tcp", nameserver)
+		})
+	}
+	c := &dns.Client{Net: "tcp", ReadTimeout: timeout, Dialer: s.config.forwardDialer(nameserver, true)}
+	r, _, err := c.Exchange(req, nameserver)
+	return r, err
+}
+
+type exchangeResult struct {
+	r   *dns.Msg
+	err error
+}
+
+// exchangeRace sends req to nameserver nsid of nameservers and, when no valid reply is seen
+// within RaceDelay, also to the next nameserver. The first valid reply is
+// returned. A reply is valid when it is not a SERVFAIL or REFUSED. If neither
+// nameserver gives a valid reply the last reply received is returned.
+func (s *server) exchangeRace(c *dns.Client, req *dns.Msg, nameservers []string, nsid int) (*dns.Msg, error) {
+	results := make(chan exchangeResult, 2)
+	exchange := func(nameserver string) {
+		r, err := s.exchange(c, req, nameserver)
+		results <- exchangeResult{r, err}
+	}
+	go exchange(nameservers[nsid])
+
+	timer := time.NewTimer(s.config.RaceDelay)
+	defer timer.Stop()
+
+	var (
+		last    exchangeResult
+		sent    = 1
+		started = false
+	)
+	for sent > 0 {
+		select {
+		case <-timer.C:
+			if !started {
+				started = true
+				sent++
+				go exchange(nameservers[(nsid+1)%len(nameservers)])
+			}
+		case res := <-results:
+			sent--
+			if res.err == nil && res.r.Rcode != dns.RcodeServerFailure && res.r.Rcode != dns.RcodeRefused {
+				return res.r, nil
+			}
+			if res.err == nil || last.r == nil {
+				last = res
+			}
+			if !started {
+				// The first one failed fast, don't wait for the timer.
+				started = true
+				sent++
+				go exchange(nameservers[(nsid+1)%len(nameservers)])
+			}
+		}
+	}
+	return last.r, last.err
+}
+
+// exchangeTLS sends req to the nameserver at addr using DNS-over-TLS (RFC 7858),
+// on the open connection to it with ForwardReuse.
+func (s *server) exchangeTLS(req *dns.Msg, addr string, timeout time.Duration) (*dns.Msg, error) {
+	if s.conns != nil {
+		return s.conns.exchange(req, "tls://"+addr, timeout, func() (net.Conn, error) { return s.dialTLS(addr, timeout) })
+	}
+	conn, err := s.dialTLS(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	co := &dns.Conn{Conn: conn}
+	if err := co.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	return co.ReadMsg()
+}
+
+// dialTLS connects to the nameserver at addr with TLS and checks its certificate.
+func (s *server) dialTLS(addr string, timeout time.Duration) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	config := s.config.forwardTLS.Clone()
+	if config == nil {
+		return nil, fmt.Errorf("%s: no TLS configuration for the tls:// nameservers", addr)
+	}
+	config.ServerName = host
+
+	conn, err := tls.DialWithDialer(s.dialer(addr, timeout), "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.config.ForwardTLSPins) > 0 {
+		if err := verifyPins(conn.ConnectionState().PeerCertificates, s.config.ForwardTLSPins); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %s", addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// dialer returns the dialer for TCP connections to nameserver, see forwardDialer.
+func (s *server) dialer(nameserver string, timeout time.Duration) *net.Dialer {
+	d := s.config.forwardDialer(nameserver, true)
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	d.Timeout = timeout
+	return d
+}
+
+// verifyPins checks that one of the certificates has a SubjectPublicKeyInfo
+// matching one of the pins.
+func verifyPins(certs []*x509.Certificate, pins []string) error {
+	for _, c := range certs {
+		h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		spki := base64.StdEncoding.EncodeToString(h[:])
+		for _, p := range pins {
+			if p == spki {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate matches the configured pins")
+}
+
+// randomizeCase randomizes the case of the letters in name, see
+// draft-vixie-dnsext-dns0x20.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	bits := uint16(0)
+	for i, c := range b {
+		if i%16 == 0 {
+			bits = dns.Id()
+		}
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			if bits&1 == 1 {
+				b[i] = c ^ 0x20
+			}
+		}
+		bits >>= 1
+	}
+	return string(b)
+}
+
+// echoCase sets the question name and the owner names in r that are equal to
+// name, ignoring case, to name. So the client gets back the exact name it asked for.
+func echoCase(r *dns.Msg, name string) {
+	if len(r.Question) > 0 {
+		r.Question[0].Name = name
+	}
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name != name && strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+// forwardRequest returns the request to forward for req. The client's EDNS0
+// record, with its DO bit and options, and the CD bit go upstream as they are,
+// so the nameserver returns the DNSSEC records the client asked for. With
+// ForwardDo the DO bit is set in every forwarded query.
+func (s *server) forwardRequest(req *dns.Msg) *dns.Msg {
+	if !s.config.ForwardDo {
+		return req
+	}
+	opt := req.IsEdns0()
+	if opt != nil && opt.Do() {
+		return req
+	}
+	up := req.Copy()
+	if opt = up.IsEdns0(); opt == nil {
+		size := s.config.EdnsUdpSize
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+		up.SetEdns0(size, true)
+		return up
+	}
+	opt.SetDo()
+	return up
+}
+
+// forwardReply returns the reply r of the nameserver as it is, unless DO was
+// forced by forwardRequest and the client didn't set it. Then the DNSSEC records
+// the client didn't ask for are removed (RFC 3225) and the EDNS0 record is made
+// to match the one of the client again.
+func (s *server) forwardReply(req, r *dns.Msg) *dns.Msg {
+	opt := req.IsEdns0()
+	if !s.config.ForwardDo || (opt != nil && opt.Do()) {
+		return r
+	}
+	qtype := req.Question[0].Qtype
+	r.Answer = stripDnssec(r.Answer, qtype)
+	r.Ns = stripDnssec(r.Ns, 0)
+	r.Extra = stripDnssec(r.Extra, 0)
+	if !req.AuthenticatedData {
+		r.AuthenticatedData = false
+	}
+	if o := r.IsEdns0(); o != nil {
+		if opt == nil {
+			extra := r.Extra[:0]
+			for _, rr := range r.Extra {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					extra = append(extra, rr)
+				}
+			}
+			r.Extra = extra
+		} else {
+			o.SetDo(false)
+		}
+	}
+	return r
+}
+
+// stripDnssec removes the RRSIG, NSEC and NSEC3 records from rrs, except those of
+// type qtype, which were asked for.
+func stripDnssec(rrs []dns.RR, qtype uint16) []dns.RR {
+	j := 0
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		rrs[j] = rr
+		j++
+	}
+	return rrs[:j]
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestForwardDo(t *testing.T) {
+	s := NewServer(&Config{ForwardDo: true, EdnsUdpSize: 4096}, nil)
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+
+	up := s.forwardRequest(req)
+	if opt := up.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatal("expected DO in the forwarded query")
+	}
+	if req.IsEdns0() != nil {
+		t.Fatal("expected the query of the client to be left alone")
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(up)
+	r.AuthenticatedData = true
+	r.Answer = []dns.RR{
+		new(Service).NewA("www.example.org.", 60, net.ParseIP("10.0.0.1").To4()),
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "www.example.org.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60}, TypeCovered: dns.TypeA},
+	}
+	r.SetEdns0(4096, true)
+	r = s.forwardReply(req, r)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("expected only the A record, got %v", r.Answer)
+	}
+	if r.IsEdns0() != nil || r.AuthenticatedData {
+		t.Error("expected no EDNS0 record and no AD bit for a client without EDNS0")
+	}
+
+	req.SetEdns0(4096, true)
+	if s.forwardRequest(req) != req {
+		t.Error("expected the query of a DO client to be forwarded as it is")
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	tests := []struct {
+		name   string
+		random bool // the case must change in 20 tries
+	}{
+		{"", false},
+		{".", false},
+		{"1.2.3.4.", false},
+		{"www.example.org.", true},
+		{"WWW.Example.ORG.", true},
+		{"_http._tcp.a-1.example.org.", true},
+		{"a-very-long-name-with-more-than-sixteen-letters.example.org.", true},
+	}
+	for _, tc := range tests {
+		changed := false
+		for i := 0; i < 20; i++ {
+			r := randomizeCase(tc.name)
+			if !strings.EqualFold(r, tc.name) {
+				t.Fatalf("%q: randomized to %q, which is another name", tc.name, r)
+			}
+			changed = changed || r != tc.name
+		}
+		if changed != tc.random {
+			t.Errorf("%q: expected the case to change to be %t", tc.name, tc.random)
+		}
+	}
+}
+
+func TestEchoCase(t *testing.T) {
+	tests := []struct {
+		owner, name, want string
+	}{
+		{"www.example.org.", "WwW.ExAmPlE.oRg.", "WwW.ExAmPlE.oRg."},
+		{"WWW.EXAMPLE.ORG.", "www.example.org.", "www.example.org."},
+		{"www.example.org.", "www.example.org.", "www.example.org."},
+		// Other names, like a CNAME target, keep their case.
+		{"Web.Example.org.", "www.example.org.", "Web.Example.org."},
+		{"example.org.", "WWW.example.org.", "example.org."},
+	}
+	for _, tc := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(strings.ToLower(tc.name), dns.TypeA)
+		r.Answer = []dns.RR{newA(tc.owner + " IN A 10.0.0.1")}
+		r.Ns = []dns.RR{newA(tc.owner + " IN A 10.0.0.2")}
+		r.Extra = []dns.RR{newA(tc.owner + " IN A 10.0.0.3")}
+		echoCase(r, tc.name)
+		if r.Question[0].Name != tc.name {
+			t.Errorf("%s: question name %s, want %s", tc.name, r.Question[0].Name, tc.name)
+		}
+		for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+			if got := section[0].Header().Name; got != tc.want {
+				t.Errorf("%s: owner name %s, want %s", tc.name, got, tc.want)
+			}
+		}
+	}
+	// A message without a question is left alone.
+	echoCase(new(dns.Msg), "www.example.org.")
+}
+
+func TestVerifyPins(t *testing.T) {
+	pin := func(spki string) string {
+		h := sha256.Sum256([]byte(spki))
+		return base64.StdEncoding.EncodeToString(h[:])
+	}
+	leaf := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("leaf key")}
+	ca := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("ca key")}
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+		pins  []string
+		ok    bool
+	}{
+		{"leaf", []*x509.Certificate{leaf, ca}, []string{pin("leaf key")}, true},
+		{"ca", []*x509.Certificate{leaf, ca}, []string{pin("ca key")}, true},
+		{"second pin", []*x509.Certificate{leaf}, []string{pin("old key"), pin("leaf key")}, true},
+		{"no match", []*x509.Certificate{leaf, ca}, []string{pin("other key")}, false},
+		{"hex pin", []*x509.Certificate{leaf}, []string{fmt.Sprintf("%x", sha256.Sum256([]byte("leaf key")))}, false},
+		{"no certificates", nil, []string{pin("leaf key")}, false},
+		{"no pins", []*x509.Certificate{leaf}, nil, false},
+	}
+	for _, tc := range tests {
+		if err := verifyPins(tc.certs, tc.pins); tc.ok != (err == nil) {
+			t.Errorf("%s: expected ok to be %t, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// group returns the services in sx that have the group of the first service,
+// in key order, with a group. When none has a group sx is returned as is.
+// This splits the services below a name into subsets, only one of which is
+// used. When a group has a traffic percentage the group is picked at random
+// for each query instead, see pickGroup, and split is true.
+func group(sx []*Service) (gx []*Service, split bool) {
+	first, key := "", ""
+	for _, serv := range sx {
+		if serv.Group != "" && (first == "" || serv.key < key) {
+			first, key = serv.Group, serv.key
+		}
+	}
+	if first == "" {
+		return sx, false
+	}
+	if g := pickGroup(sx, rand.Intn(100)); g != "" {
+		first, split = g, true
+	}
+	for _, serv := range sx {
+		if serv.Group == first {
+			gx = append(gx, serv)
+		}
+	}
+	return gx, split
+}
+
+// pickGroup returns the group for the roll r, 0 <= r < 100, when one of the
+// groups in sx has a traffic percentage, or "" when none has. The percentage
+// of a group is the traffic of its first service, in key order, that sets one.
+// What the percentages leave goes to the first group without one, when all
+// have one they are relative to their sum.
+func pickGroup(sx []*Service, r int) string {
+	sorted := make([]*Service, len(sx))
+	copy(sorted, sx)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+
+	var groups []string
+	traffic := make(map[string]int)
+	for _, serv := range sorted {
+		if serv.Group == "" {
+			continue
+		}
+		if _, ok := traffic[serv.Group]; !ok {
+			groups = append(groups, serv.Group)
+			traffic[serv.Group] = 0
+		}
+		if traffic[serv.Group] == 0 {
+			traffic[serv.Group] = serv.Traffic
+		}
+	}
+	sum, rest := 0, ""
+	for _, g := range groups {
+		sum += traffic[g]
+		if traffic[g] == 0 && rest == "" {
+			rest = g
+		}
+	}
+	if sum == 0 {
+		return ""
+	}
+	if rest != "" && sum < 100 {
+		traffic[rest] = 100 - sum
+		sum = 100
+	}
+	r = r * sum / 100
+	for _, g := range groups {
+		if r < traffic[g] {
+			return g
+		}
+		r -= traffic[g]
+	}
+	return groups[len(groups)-1]
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	sx := []*Service{
+		{Host: "10.0.0.1", key: "/skydns/local/skydns/web/3"},
+		{Host: "10.0.0.2", Group: "blue", key: "/skydns/local/skydns/web/2"},
+		{Host: "10.0.0.3", Group: "green", key: "/skydns/local/skydns/web/1"},
+		{Host: "10.0.0.4", Group: "green", key: "/skydns/local/skydns/web/4"},
+	}
+	gx, split := group(sx)
+	if len(gx) != 2 || gx[0].Host != "10.0.0.3" || gx[1].Host != "10.0.0.4" || split {
+		t.Errorf("group = %v, want the green services", gx)
+	}
+	if gx, _ := group(sx[:1]); len(gx) != 1 {
+		t.Errorf("group without groups = %v, want all services", gx)
+	}
+}
+
+func TestPickGroup(t *testing.T) {
+	sx := []*Service{
+		{Group: "stable", key: "/skydns/local/skydns/web/1"},
+		{Group: "stable", key: "/skydns/local/skydns/web/2"},
+		{Group: "canary", Traffic: 5, key: "/skydns/local/skydns/web/3"},
+	}
+	tests := []struct {
+		r    int
+		want string
+	}{{0, "stable"}, {94, "stable"}, {95, "canary"}, {99, "canary"}}
+	for _, tc := range tests {
+		if g := pickGroup(sx, tc.r); g != tc.want {
+			t.Errorf("pickGroup(%d) = %q, want %q", tc.r, g, tc.want)
+		}
+	}
+	sx[0].Traffic = 20 // 20/5, relative to the sum
+	if g := pickGroup(sx, 79); g != "stable" {
+		t.Errorf("pickGroup(79) = %q, want stable", g)
+	}
+	if g := pickGroup(sx, 80); g != "canary" {
+		t.Errorf("pickGroup(80) = %q, want canary", g)
+	}
+	if g := pickGroup(sx[:2], 50); g != "stable" {
+		t.Errorf("pickGroup of one group = %q, want stable", g)
+	}
+	sx[0].Traffic = 0
+	if g := pickGroup(sx[:2], 50); g != "" {
+		t.Errorf("pickGroup without traffic = %q, want none", g)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// runHealth starts the HTTP server for the health and readiness endpoints on addr.
+func (s *server) runHealth(addr string) {
+	mux := http.NewServeMux()
+	s.healthHandlers(mux)
+	if s.config.PrometheusSd {
+		mux.HandleFunc("/prometheus/targets", s.prometheusTargets)
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			s.config.log.Errorf("health endpoint failed: %s", err.Error())
+		}
+	}()
+}
+
+// healthHandlers registers /healthz and /readyz on mux.
+func (s *server) healthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+}
+
+// listening returns true when all DNS listeners are bound.
+func (s *server) listening() bool {
+	s.mu.RLock()
+	n := len(s.dnsServers)
+	s.mu.RUnlock()
+	return n > 0 && int(atomic.LoadInt32(&s.started)) >= n
+}
+
+// healthz reports OK when all DNS listeners are bound.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	if !s.listening() {
+		http.Error(w, "listeners not started", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports OK when we are healthy, etcd can be reached, the configuration
+// (and blocklists) are loaded and the DNSSEC key, if configured, is parsed and
+// the signatures are warmed up.
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	if !s.listening() {
+		http.Error(w, "listeners not started", http.StatusServiceUnavailable)
+		return
+	}
+	config := s.current().config
+	if config.DNSSEC != "" && (config.PubKey == nil || config.PrivKey == nil) {
+		http.Error(w, "dnssec key not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if atomic.LoadInt32(&s.warming) == 1 {
+		http.Error(w, "dnssec signatures warming up", http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := s.client.Get("/skydns", false, false); err != nil {
+		if e, ok := err.(*etcd.EtcdError); !ok || e.ErrorCode != 100 {
+			http.Error(w, "etcd unreachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
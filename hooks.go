@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"plugin"
+
+	"github.com/miekg/dns"
+)
+
+// Hooks are query firewalls loaded from Go plugins (go build -buildmode=plugin).
+// A plugin exports either or both of:
+//
+//	func Query(client net.IP, req *dns.Msg) (next, reply *dns.Msg)
+//	func Reply(client net.IP, req, reply *dns.Msg) *dns.Msg
+//
+// Query is called before the lookup. When it returns a reply that is written
+// and nothing else is done, otherwise the query goes on with next (req itself
+// or a changed copy). Returning neither refuses the query. Reply is called
+// before a reply is written, with the query as the client sent it, and returns
+// the reply to write instead, nil refuses the query. The hooks are called in
+// the order of Config.Hooks.
+
+type hook struct {
+	file  string
+	query func(net.IP, *dns.Msg) (*dns.Msg, *dns.Msg)
+	reply func(net.IP, *dns.Msg, *dns.Msg) *dns.Msg
+}
+
+// setHooks loads the plugins in config.Hooks.
+func setHooks(config *Config) error {
+	config.hooks = nil
+	for _, file := range config.Hooks {
+		p, err := plugin.Open(file)
+		if err != nil {
+			return fmt.Errorf("hook %s: %s", file, err)
+		}
+		h := &hook{file: file}
+		if sym, err := p.Lookup("Query"); err == nil {
+			f, ok := sym.(func(net.IP, *dns.Msg) (*dns.Msg, *dns.Msg))
+			if !ok {
+				return fmt.Errorf("hook %s: Query has the wrong type %T", file, sym)
+			}
+			h.query = f
+		}
+		if sym, err := p.Lookup("Reply"); err == nil {
+			f, ok := sym.(func(net.IP, *dns.Msg, *dns.Msg) *dns.Msg)
+			if !ok {
+				return fmt.Errorf("hook %s: Reply has the wrong type %T", file, sym)
+			}
+			h.reply = f
+		}
+		if h.query == nil && h.reply == nil {
+			return fmt.Errorf("hook %s: exports neither Query nor Reply", file)
+		}
+		config.hooks = append(config.hooks, h)
+	}
+	return nil
+}
+
+// queryHooks runs the Query hooks on req. It returns the request to go on
+// with, or nil when a hook answered or refused the query, which has then been
+// written to w.
+func (s *server) queryHooks(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	client := clientIP(w.RemoteAddr())
+	for _, h := range s.config.hooks {
+		if h.query == nil {
+			continue
+		}
+		next, reply := h.query(client, req)
+		switch {
+		case reply != nil:
+			reply.Id = req.Id
+			w.WriteMsg(reply)
+			return nil
+		case next == nil || len(next.Question) == 0:
+			refused(w, req)
+			return nil
+		}
+		req = next
+	}
+	return req
+}
+
+// hookWriter runs the Reply hooks on the replies written through it.
+type hookWriter struct {
+	dns.ResponseWriter
+	hooks []*hook
+	req   *dns.Msg
+}
+
+func (w *hookWriter) WriteMsg(m *dns.Msg) error {
+	client := clientIP(w.RemoteAddr())
+	for _, h := range w.hooks {
+		if h.reply == nil {
+			continue
+		}
+		if m = h.reply(client, w.req, m); m == nil {
+			StatsRefusedCount.Inc(1)
+			m = new(dns.Msg)
+			m.SetRcode(w.req, dns.RcodeRefused)
+			break
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
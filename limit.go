@@ -0,0 +1,57 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// limiter limits the number of UDP queries that are handled concurrently. The
+// dns package starts a goroutine for every packet, when all slots are in use
+// the query is answered according to the overload policy right away, instead
+// of piling up goroutines that all wait on etcd.
+type limiter struct {
+	h      dns.Handler
+	slots  chan struct{}
+	policy string
+}
+
+func newLimiter(h dns.Handler, workers int, policy string) *limiter {
+	return &limiter{h: h, slots: make(chan struct{}, workers), policy: policy}
+}
+
+func (l *limiter) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		l.h.ServeDNS(w, req)
+		return
+	}
+	select {
+	case l.slots <- struct{}{}:
+		defer func() { <-l.slots }()
+		l.h.ServeDNS(w, req)
+	default:
+		StatsOverloadCount.Inc(1)
+		l.overloaded(w, req)
+	}
+}
+
+// overloaded answers req when there is no slot free: not at all (drop), with
+// SERVFAIL (servfail) or with an empty truncated reply, so the client retries
+// over TCP (truncate).
+func (l *limiter) overloaded(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	switch l.policy {
+	case "servfail":
+		m.SetRcode(req, dns.RcodeServerFailure)
+	case "truncate":
+		m.SetReply(req)
+		m.Truncated = true
+	default:
+		return
+	}
+	w.WriteMsg(m)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// newDNSServers returns the DNS servers for the TCP and UDP sockets we should
+// serve on. These are the sockets passed by systemd (socket activation) or
+// new ones bound to each of addrs, with SO_REUSEPORT set when reusePort is true.
+// Binding each address on its own makes the replies come from the address
+// the query was sent to.
+func newDNSServers(handler dns.Handler, addrs []string, config *Config) ([]*dns.Server, error) {
+	listeners, packetConns, err := activationSockets()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 && len(packetConns) == 0 {
+		if !config.ReusePort {
+			servers := []*dns.Server{}
+			for _, addr := range addrs {
+				for _, net := range []string{"tcp", "udp"} {
+					servers = append(servers, &dns.Server{Addr: addr, Net: config.network(net), Handler: handler, ReadTimeout: config.ReadTimeout})
+				}
+			}
+			return servers, nil
+		}
+		lc := net.ListenConfig{Control: reusePort}
+		for _, addr := range addrs {
+			l, err := lc.Listen(context.Background(), config.network("tcp"), addr)
+			if err != nil {
+				closeSockets(listeners, packetConns)
+				return nil, err
+			}
+			listeners = append(listeners, l)
+			p, err := lc.ListenPacket(context.Background(), config.network("udp"), addr)
+			if err != nil {
+				closeSockets(listeners, packetConns)
+				return nil, err
+			}
+			packetConns = append(packetConns, p)
+		}
+	}
+	servers := []*dns.Server{}
+	for _, l := range listeners {
+		servers = append(servers, &dns.Server{Listener: l, Net: "tcp", Handler: handler, ReadTimeout: config.ReadTimeout})
+	}
+	for _, p := range packetConns {
+		servers = append(servers, &dns.Server{PacketConn: p, Net: "udp", Handler: handler, ReadTimeout: config.ReadTimeout})
+	}
+	return servers, nil
+}
+
+func closeSockets(listeners []net.Listener, packetConns []net.PacketConn) {
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, p := range packetConns {
+		p.Close()
+	}
+}
+
+// activationSockets returns the sockets passed by systemd, see sd_listen_fds(3).
+func activationSockets() ([]net.Listener, []net.PacketConn, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n == 0 {
+		return nil, nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	var (
+		listeners   []net.Listener
+		packetConns []net.PacketConn
+	)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		if l, err := net.FileListener(f); err == nil {
+			listeners = append(listeners, l)
+			f.Close()
+			continue
+		}
+		if p, err := net.FilePacketConn(f); err == nil {
+			packetConns = append(packetConns, p)
+			f.Close()
+			continue
+		}
+		return nil, nil, fmt.Errorf("socket activation: fd %d is not a TCP or UDP socket", fd)
+	}
+	return listeners, packetConns, nil
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/coreos/go-log/log"
+)
+
+// logLevel is the highest priority that is logged, use atomically. It is shared
+// by all loggers, so a level set at runtime survives a reload of the configuration.
+var logLevel = int32(log.PriInfo)
+
+var logLevels = map[string]log.Priority{
+	"debug": log.PriDebug,
+	"info":  log.PriInfo,
+	"warn":  log.PriWarning,
+	"error": log.PriErr,
+}
+
+// parseLogLevel parses one of debug, info, warn or error.
+func parseLogLevel(s string) (log.Priority, error) {
+	if p, ok := logLevels[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
+func setLogLevel(p log.Priority) { atomic.StoreInt32(&logLevel, int32(p)) }
+
+func getLogLevel() string {
+	p := log.Priority(atomic.LoadInt32(&logLevel))
+	for s, p1 := range logLevels {
+		if p1 == p {
+			return s
+		}
+	}
+	return p.String()
+}
+
+// levelSink drops the messages below the current log level.
+type levelSink struct {
+	log.Sink
+}
+
+func (l levelSink) Log(f log.Fields) {
+	if p, ok := f["priority"].(log.Priority); ok && int32(p) > atomic.LoadInt32(&logLevel) {
+		return
+	}
+	l.Sink.Log(f)
+}
+
+// newLogger returns a logger that logs to standard error. It is verbose, the
+// filtering is done by levelSink.
+func newLogger() *log.Logger {
+	return log.New("skydns", true,
+		levelSink{log.CombinedSink(os.Stderr, "[%s] %s %-9s | %s\n", []string{"prefix", "time", "priority", "message"})})
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// With Machines the names below machines.<domain> are the hosts of the cluster,
+// so they are resolvable by name alongside the services. <n>.machines.<domain>
+// is the n-th etcd machine, in the order of the member list, and
+// machines.<domain> has all of them. Other hosts, i.e. the nodes running the
+// services, are added below machinesKey with a host, like a service:
+//
+//	/skydns/machines/node1 {"host":"10.0.0.5"}
+//
+// is node1.machines.<domain>. The names below machines.<domain> are all ours, a
+// machine we don't know is an NXDOMAIN.
+
+const machinesKey = "/skydns/machines"
+
+// machinesName returns the name of the machine, "" for machines.<domain>
+// itself. Ok is false when name is not below machines.<domain>.
+func (config *Config) machinesName(name string) (machine string, ok bool) {
+	if !config.Machines {
+		return "", false
+	}
+	zone := "machines." + config.Domain
+	if name == zone {
+		return "", true
+	}
+	if !strings.HasSuffix(name, "."+zone) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+zone), true
+}
+
+// clusterAddrs returns the addresses of the etcd machines with the URLs in
+// cluster, "" for the ones without an IP address.
+func clusterAddrs(cluster []string) []string {
+	addrs := make([]string, len(cluster))
+	for i, c := range cluster {
+		u, err := url.Parse(c)
+		if err != nil {
+			continue
+		}
+		h, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			continue
+		}
+		addrs[i] = h
+	}
+	return addrs
+}
+
+// machineRecords returns the records of type q.Qtype for the machine, found is
+// false when there is no such machine.
+func (s *server) machineRecords(q dns.Question, machine string) (records []dns.RR, found bool, err error) {
+	var addrs []string
+	ttl := s.config.Ttl
+	cluster := clusterAddrs(s.client.GetCluster())
+	n, err := strconv.Atoi(machine)
+	switch {
+	case machine == "":
+		addrs = cluster
+	case err == nil && n >= 1 && n <= len(cluster):
+		addrs = cluster[n-1 : n]
+	case strings.Contains(machine, ".") || strings.Contains(machine, "/"):
+		return nil, false, nil
+	default:
+		r, err := s.client.Get(machinesKey+"/"+machine, false, false)
+		if err != nil {
+			if notFound(err) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		if r == nil || r.Node == nil || r.Node.Dir {
+			return nil, false, nil
+		}
+		serv, err := s.config.decodeService(r.Node)
+		if err != nil {
+			return nil, false, err
+		}
+		addrs, ttl = []string{serv.Host}, serv.ttl
+	}
+
+	serv := new(Service)
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		found = true
+		switch {
+		case ip.To4() != nil && q.Qtype == dns.TypeA:
+			records = append(records, serv.NewA(q.Name, ttl, ip.To4()))
+		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
+			records = append(records, serv.NewAAAA(q.Name, ttl, ip.To16()))
+		}
+	}
+	// machines.<domain> exists, even without machines.
+	return records, found || machine == "", nil
+}
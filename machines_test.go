@@ -0,0 +1,31 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMachinesName(t *testing.T) {
+	config := &Config{Domain: "skydns.local.", Machines: true}
+	for _, tc := range []struct {
+		name, machine string
+		ok            bool
+	}{
+		{"machines.skydns.local.", "", true},
+		{"1.machines.skydns.local.", "1", true},
+		{"node1.machines.skydns.local.", "node1", true},
+		{"xmachines.skydns.local.", "", false},
+		{"web.skydns.local.", "", false},
+	} {
+		if machine, ok := config.machinesName(tc.name); machine != tc.machine || ok != tc.ok {
+			t.Errorf("machinesName(%q) = %q, %t, want %q, %t", tc.name, machine, ok, tc.machine, tc.ok)
+		}
+	}
+	if addrs := clusterAddrs([]string{"http://10.0.0.1:4001", "http://[2001:db8::1]:4001", "bad"}); !reflect.DeepEqual(addrs, []string{"10.0.0.1", "2001:db8::1", ""}) {
+		t.Errorf("clusterAddrs = %v", addrs)
+	}
+}
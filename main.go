@@ -5,22 +5,96 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 )
 
 var (
-	machines = strings.Split(os.Getenv("ETCD_MACHINES"), ",") // List of URLs to etcd
-	tlskey   = os.Getenv("ETCD_TLSKEY")                       // TLS private key path
-	tlspem   = os.Getenv("ETCD_TLSPEM")                       // X509 certificate
+	machines       []string      // List of URLs to etcd
+	tlskey         string        // TLS private key path
+	tlspem         string        // X509 certificate
+	configFile     string        // Local configuration file
+	validateConfig bool          // Only check the configuration
+	exportZone     bool          // Write the zone to standard output
+	importZone     string        // Zone file to create the services from
+	dryRun         bool          // Only report what importZone would do
+	checkRecords   bool          // Check the services in etcd
+	migrateRecords bool          // Upgrade the services in etcd to the current version
+	benchFile      string        // Query file to benchmark with
+	benchAddr      string        // Nameserver to benchmark, an in-process server when empty
+	benchClients   int           // Concurrent clients of the benchmark
+	benchDuration  time.Duration // How long the benchmark runs
+	chrootDir      string        // Directory to chroot to after binding the ports
+	runAs          string        // User to become after binding the ports
+	configFlags    Config        // Options set on the command line, these override the configuration
 )
 
+func init() {
+	flag.Var((*listFlag)(&machines), "machines", "comma separated list of etcd machines (ETCD_MACHINES)")
+	flag.StringVar(&tlskey, "tls-key", os.Getenv("ETCD_TLSKEY"), "TLS private key path (ETCD_TLSKEY)")
+	flag.StringVar(&tlspem, "tls-pem", os.Getenv("ETCD_TLSPEM"), "X509 certificate path (ETCD_TLSPEM)")
+	flag.StringVar(&configFile, "config", "", "configuration file, JSON only (not TOML or YAML), overrides the configuration in etcd")
+	flag.BoolVar(&validateConfig, "validate-config", false, "check the configuration and exit")
+	flag.BoolVar(&exportZone, "export", false, "write the services as a zone master file to standard output and exit")
+	flag.StringVar(&importZone, "import", "", "create the services from this zone master file and exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "with -import or -migrate, only report what would be done")
+	flag.BoolVar(&checkRecords, "check", false, "check the services in etcd, report the problems and exit")
+	flag.BoolVar(&migrateRecords, "migrate", false, "upgrade the services in etcd to the current version and exit")
+	flag.StringVar(&benchFile, "bench", "", "replay the queries in this file (dnsperf format), report the performance and exit")
+	flag.StringVar(&benchAddr, "bench-addr", "", "with -bench, the ip:port of the nameserver to query, defaults to an in-process SkyDNS")
+	flag.IntVar(&benchClients, "bench-clients", 10, "with -bench, the number of concurrent clients")
+	flag.DurationVar(&benchDuration, "bench-duration", 10*time.Second, "with -bench, how long to run")
+	flag.StringVar(&chrootDir, "chroot", "", "chroot to this directory after binding the ports")
+	flag.StringVar(&runAs, "user", "", "become this user after binding the ports")
+	flag.StringVar(&configFlags.LogLevel, "log-level", "", "log level: debug, info, warn or error (log_level)")
+
+	flag.Var((*addrFlag)(&configFlags.DnsAddr), "addr", "ip:port to listen on, may be repeated (dns_addr)")
+	flag.StringVar(&configFlags.Domain, "domain", "", "domain to be authoritative for (domain)")
+	flag.StringVar(&configFlags.Hostmaster, "hostmaster", "", "hostmaster in the SOA record (hostmaster)")
+	flag.StringVar(&configFlags.DNSSEC, "dnssec", "", "basename of the DNSSEC key files (dnssec)")
+	flag.Var((*listFlag)(&configFlags.Nameservers), "nameservers", "comma separated list of nameservers to forward to (nameservers)")
+	flag.StringVar(&configFlags.AdminAddr, "admin", "", "loopback ip:port for the admin API (admin_addr)")
+	flag.StringVar(&configFlags.HealthAddr, "health", "", "ip:port for the health endpoints (health_addr)")
+
+	if m := os.Getenv("ETCD_MACHINES"); m != "" {
+		machines = strings.Split(m, ",")
+	}
+}
+
+// listFlag is a comma separated list of strings.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = strings.Split(s, ",")
+	return nil
+}
+
+// addrFlag is a string flag that may be repeated, the values are joined with commas.
+type addrFlag string
+
+func (a *addrFlag) String() string { return string(*a) }
+
+func (a *addrFlag) Set(s string) error {
+	if *a != "" {
+		*a += ","
+	}
+	*a += addrFlag(s)
+	return nil
+}
+
 func newClient() (client *etcd.Client) {
-	if len(machines) == 1 && machines[0] == "" {
-		machines[0] = "http://127.0.0.1:4001"
+	if len(machines) == 0 {
+		machines = []string{"http://127.0.0.1:4001"}
 	}
 	if strings.HasPrefix(machines[0], "https://") {
 		var err error
@@ -34,18 +108,154 @@ func newClient() (client *etcd.Client) {
 	return client
 }
 
+// setFromEnv sets the flags from the SKYDNS_* environment variables, i.e. -nameservers
+// from SKYDNS_NAMESERVERS. Flags given on the command line take precedence, so it
+// is called after flag.Parse and leaves those alone.
+func setFromEnv() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		env := "SKYDNS_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v := os.Getenv(env); v != "" {
+			if err := f.Value.Set(v); err != nil {
+				log.Fatalf("bad value for %s: %s", env, err)
+			}
+		}
+	})
+}
+
 func main() {
+	flag.Parse()
+	setFromEnv()
+	if configFlags.LogLevel != "" {
+		level, err := parseLogLevel(configFlags.LogLevel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setLogLevel(level)
+	}
+	if benchFile != "" && benchAddr != "" {
+		if err := benchmark(nil, benchFile, benchAddr, benchClients, benchDuration); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	client := newClient()
 
 	config, err := LoadConfig(client)
 	if err != nil {
 		log.Fatal(err)
 	}
+	setLogLevel(logLevels[config.LogLevel])
+	if validateConfig {
+		if _, err := loadBlocklist(config); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("configuration ok")
+		return
+	}
 	s := NewServer(config, client)
+	if s.audit, err = newAuditLog(config, client); err != nil {
+		log.Fatal(err)
+	}
+	if exportZone {
+		if err := s.exportZone(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if checkRecords {
+		problems, err := s.checkZone(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if problems > 0 {
+			fmt.Printf("%d problems found\n", problems)
+			os.Exit(1)
+		}
+		fmt.Println("services ok")
+		return
+	}
+	if benchFile != "" {
+		if err := benchmark(s, benchFile, "", benchClients, benchDuration); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if migrateRecords {
+		failed, err := s.migrateZone(os.Stdout, dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if importZone != "" {
+		f, err := os.Open(importZone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := s.importZone(f, importZone, dryRun, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+		return
+	}
 
 	statsCollect()
 
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := s.Reload(); err != nil {
+				log.Printf("failure to reload configuration: %s", err)
+			}
+		}
+	}()
+	go func() {
+		// SIGUSR1 turns on debug logging, SIGUSR2 sets the level back to the configured one.
+		usr := make(chan os.Signal, 1)
+		signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+		for sig := range usr {
+			if sig == syscall.SIGUSR1 {
+				setLogLevel(logLevels["debug"])
+			} else {
+				setLogLevel(logLevels[s.logLevel()])
+			}
+			config.log.Noticef("log level set to %s", getLogLevel())
+		}
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+		<-term
+		log.Printf("shutting down")
+		s.Stop()
+		close(stopped)
+	}()
+
+	if chrootDir != "" || runAs != "" {
+		go func() {
+			for !s.listening() {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err := dropPrivileges(chrootDir, runAs); err != nil {
+				log.Fatalf("failure to drop privileges: %s", err)
+			}
+			log.Printf("dropped privileges, user %q, root directory %q", runAs, chrootDir)
+		}()
+	}
+
 	if err := s.Run(); err != nil {
 		log.Fatal(err)
 	}
+	// Run returns as soon as the listeners are closed, wait for Stop to finish.
+	<-stopped
 }
@@ -0,0 +1,89 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Multicast DNS (RFC 6762) responder. It answers the questions for names in
+// our domain from the same records as the unicast server, all other names are
+// left to the other responders on the link. As mDNS requires, negative answers
+// are never sent.
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// newMDNSServer returns the DNS server for the mDNS group.
+func newMDNSServer(s *server) (*dns.Server, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Server{PacketConn: conn, Net: "udp", Handler: &mdnsHandler{s: s, conn: conn}}, nil
+}
+
+type mdnsHandler struct {
+	s    *server
+	conn *net.UDPConn
+}
+
+func (h *mdnsHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if req.Response || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return
+	}
+	q := req.Question[0]
+	unicast := q.Qclass&(1<<15) != 0 // the QU bit, the question wants a unicast reply
+	q.Qclass &^= 1 << 15
+	if q.Qclass != dns.ClassINET || !dns.IsSubDomain(h.s.current().config.Domain, strings.ToLower(q.Name)) {
+		return
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(q.Name, q.Qtype)
+	r.Id = req.Id
+	cw := &captureWriter{local: w.LocalAddr(), remote: w.RemoteAddr()}
+	h.s.ServeDNS(cw, r)
+	m := cw.m
+	if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		return
+	}
+	m.RecursionAvailable = false
+	// A one-shot query from a port other than 5353 gets a normal reply, see
+	// section 6.7 of RFC 6762, all others the mDNS form of it.
+	if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok && addr.Port != mdnsGroup.Port {
+		w.WriteMsg(m)
+		return
+	}
+	m.Id = 0
+	m.Question = nil
+	if unicast {
+		w.WriteMsg(m)
+		return
+	}
+	buf, err := m.Pack()
+	if err != nil {
+		return
+	}
+	if _, err := h.conn.WriteToUDP(buf, mdnsGroup); err != nil {
+		h.s.config.log.Errorf("failure to send mdns reply: %s", err.Error())
+	}
+}
+
+// captureWriter is a dns.ResponseWriter that only keeps the message written.
+type captureWriter struct {
+	local, remote net.Addr
+	m             *dns.Msg
+}
+
+func (w *captureWriter) LocalAddr() net.Addr         { return w.local }
+func (w *captureWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *captureWriter) WriteMsg(m *dns.Msg) error   { w.m = m.Copy(); return nil }
+func (w *captureWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *captureWriter) Close() error                { return nil }
+func (w *captureWriter) TsigStatus() error           { return nil }
+func (w *captureWriter) TsigTimersOnly(bool)         {}
+func (w *captureWriter) Hijack()                     {}
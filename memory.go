@@ -0,0 +1,42 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Rough number of bytes a cache entry takes besides its records: the map
+// entry, the key and the structs around them.
+const entryOverhead = 200
+
+// memory is the budget shared by the signature cache, the response cache
+// and the cache of forwarded answers.
+var memory = new(budget)
+
+// budget accounts the bytes the caches use, a cache that would go over max
+// evicts its own entries first. The sizes are estimates: the length of the
+// records on the wire plus entryOverhead per entry.
+type budget struct {
+	max  int64 // 0 is no limit, use atomically
+	used int64 // use atomically
+}
+
+// limit sets the maximum number of bytes, 0 means there is no limit.
+func (b *budget) limit(max int64) {
+	atomic.StoreInt64(&b.max, max)
+	StatsCacheMemoryLimit.Update(max)
+}
+
+// fits returns true when n more bytes fit in the budget.
+func (b *budget) fits(n int) bool {
+	max := atomic.LoadInt64(&b.max)
+	return max == 0 || atomic.LoadInt64(&b.used)+int64(n) <= max
+}
+
+// add accounts n bytes, n is negative for bytes that are freed.
+func (b *budget) add(n int) {
+	StatsCacheMemory.Update(atomic.AddInt64(&b.used, int64(n)))
+}
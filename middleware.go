@@ -0,0 +1,189 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A query goes through the stages in Config.Stages, in order, and then to
+// serveBackend, which answers it from etcd. A stage either answers the query
+// itself or hands it, possibly with another request or writer, to the next one.
+
+// query is the state of a query on its way through the stages.
+type query struct {
+	ctx      context.Context
+	start    time.Time
+	id       string // the client ID, see clientID
+	root     *span
+	source   string // where the answer came from, for the query log
+	search   string // the name in our domain a single label is for, see search.go
+	prefetch bool
+}
+
+// handler handles a query, it is a stage with the rest of the chain behind it.
+type handler func(w dns.ResponseWriter, req *dns.Msg, qs *query)
+
+// stages are the stages Config.Stages can list.
+var stages = map[string]func(s *server, next handler) handler{
+	"log":       (*server).logStage,
+	"acl":       (*server).aclStage,
+	"quota":     (*server).quotaStage,
+	"hooks":     (*server).hooksStage,
+	"blocklist": (*server).blocklistStage,
+	"rewrite":   (*server).rewriteStage,
+	"forward":   (*server).forwardStage,
+	"cache":     (*server).cacheStage,
+}
+
+// defaultStages is the order of the stages when Config.Stages is empty.
+var defaultStages = []string{"log", "acl", "quota", "hooks", "blocklist", "rewrite", "forward", "cache"}
+
+// setStages checks the stages in config.
+func setStages(config *Config) error {
+	if len(config.Stages) == 0 {
+		config.Stages = defaultStages
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, st := range config.Stages {
+		if _, ok := stages[st]; !ok || seen[st] {
+			return fmt.Errorf("unknown or duplicate stage: %q", st)
+		}
+		seen[st] = true
+	}
+	return nil
+}
+
+// chain returns the handler that runs the stages in names and then serveBackend.
+func (s *server) chain(names []string) handler {
+	if len(names) == 0 {
+		names = defaultStages
+	}
+	h := s.serveBackend
+	for i := len(names) - 1; i >= 0; i-- {
+		h = stages[names[i]](s, h)
+	}
+	return h
+}
+
+// logStage writes the query log and the dnstap messages.
+func (s *server) logStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		if s.queryLog != nil && !qs.prefetch {
+			lw := &logWriter{ResponseWriter: w}
+			w = lw
+			defer func(req *dns.Msg) { s.queryLog.log(lw, req, qs.id, qs.source, time.Since(qs.start)) }(req)
+		}
+		if s.tapper != nil && !qs.prefetch {
+			_, tcp := w.RemoteAddr().(*net.TCPAddr)
+			s.tapper.tap(tapClientQuery, req, w.LocalAddr(), w.RemoteAddr(), tcp)
+			w = &tapWriter{w, s.tapper}
+		}
+		next(w, req, qs)
+	}
+}
+
+// aclStage refuses the queries the query ACL, or the one of their operation, denies.
+func (s *server) aclStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		if !s.allowed(ACLQuery, w.RemoteAddr(), qs.id) {
+			qs.source = "acl"
+			refused(w, req)
+			return
+		}
+		if op := aclOperation(req); op != ACLQuery && !s.allowed(op, w.RemoteAddr(), qs.id) {
+			qs.source = "acl"
+			refused(w, req)
+			return
+		}
+		next(w, req, qs)
+	}
+}
+
+// hooksStage runs the hooks, see hooks.go.
+func (s *server) hooksStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		if len(s.config.hooks) > 0 {
+			w = &hookWriter{ResponseWriter: w, hooks: s.config.hooks, req: req}
+			if req = s.queryHooks(w, req); req == nil {
+				qs.source = "hook"
+				return
+			}
+		}
+		next(w, req, qs)
+	}
+}
+
+// blocklistStage answers the blocked names.
+func (s *server) blocklistStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		if p := s.blocklist.match(strings.ToLower(req.Question[0].Name)); p != nil && p.action != policyPassthru {
+			qs.source = "blocklist"
+			s.ServeDNSBlocked(w, req, p)
+			return
+		}
+		next(w, req, qs)
+	}
+}
+
+// rewriteStage applies the rewrite rules.
+func (s *server) rewriteStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		w, req = s.rewrite(w, req)
+		next(w, req, qs)
+	}
+}
+
+// forwardStage forwards the queries for names outside our domain, and the
+// reverse names we keep (see reverse.go), that no template answers. Neither
+// are single labels that a search suffix turns into one of our names.
+func (s *server) forwardStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		name := strings.ToLower(req.Question[0].Name)
+		if _, tmpl := s.templateAnswer(req.Question[0]); tmpl || strings.HasSuffix(name, s.config.Domain) || s.config.isReverse(name) {
+			next(w, req, qs)
+			return
+		}
+		if base := s.search(qs.ctx, name, s.view(w.RemoteAddr(), req)); base != "" {
+			qs.search = base
+			next(w, req, qs)
+			return
+		}
+		if !s.allowed(ACLRecursion, w.RemoteAddr(), qs.id) {
+			qs.source = "acl"
+			refused(w, req)
+			return
+		}
+		qs.source = "forward"
+		sp := qs.root.child("forward", spanKindClient)
+		s.ServeDNSForward(qs.ctx, w, req)
+		sp.finish()
+	}
+}
+
+// cacheStage answers from the response cache.
+func (s *server) cacheStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		if !qs.prefetch {
+			if m, refresh := s.rcache.get(req, s.view(w.RemoteAddr(), req)); m != nil && s.config.fits(w, req, m) {
+				qs.source = "cache"
+				qs.root.attr("dns.cache", "hit")
+				if refresh {
+					s.prefetch(w, req)
+				}
+				w.WriteMsg(m)
+				return
+			}
+		}
+		next(w, req, qs)
+	}
+}
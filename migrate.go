@@ -0,0 +1,104 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// serviceVersion is the version of the service JSON written by this SkyDNS.
+// Values without a version field are version 0, from before it was added.
+const serviceVersion = 1
+
+// migrations[i] upgrades the JSON of a version i service to version i+1. They
+// work on the raw fields, so fields SkyDNS doesn't know (written by other
+// tools) survive the migration.
+var migrations = []func(v map[string]json.RawMessage) error{
+	// 0 -> 1: only the version is added.
+	func(v map[string]json.RawMessage) error { return nil },
+}
+
+// migrate returns value upgraded to serviceVersion and true, or value and false
+// when it is already at that version.
+func migrate(value string) (string, bool, error) {
+	v := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return value, false, err
+	}
+	version := 0
+	if raw, ok := v["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return value, false, fmt.Errorf("bad version %s", raw)
+		}
+	}
+	switch {
+	case version > serviceVersion:
+		return value, false, fmt.Errorf("version %d is newer than %d", version, serviceVersion)
+	case version == serviceVersion:
+		return value, false, nil
+	}
+	for ; version < serviceVersion; version++ {
+		if err := migrations[version](v); err != nil {
+			return value, false, fmt.Errorf("migration to version %d: %s", version+1, err)
+		}
+	}
+	v["version"] = json.RawMessage(fmt.Sprint(serviceVersion))
+	b, err := json.Marshal(v)
+	if err != nil {
+		return value, false, err
+	}
+	return string(b), true, nil
+}
+
+// migrateZone upgrades the services under the domain that have an older version
+// in place and reports what it does (or would do, with dryRun) to w. A key is
+// only swapped when it didn't change since it was read, its TTL is kept. It
+// returns the number of keys that could not be migrated.
+func (s *server) migrateZone(w io.Writer, dryRun bool) (int, error) {
+	p, _ := Path(s.config.Domain)
+	r, err := s.client.Get(p, true, true)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+			return 0, nil
+		}
+		return 0, err
+	}
+	migrated, failed := 0, 0
+	var walk func(nodes etcd.Nodes)
+	walk = func(nodes etcd.Nodes) {
+		for _, n := range nodes {
+			if n.Dir {
+				walk(n.Nodes)
+				continue
+			}
+			value, changed, err := migrate(n.Value)
+			if err != nil {
+				fmt.Fprintf(w, "%s: %s\n", n.Key, err)
+				failed++
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if !dryRun {
+				if _, err := s.client.CompareAndSwap(n.Key, value, uint64(n.TTL), n.Value, n.ModifiedIndex); err != nil {
+					fmt.Fprintf(w, "%s: %s\n", n.Key, err)
+					failed++
+					continue
+				}
+				s.audit.record("migrate", "swap", n.Key, n.Value, value, uint64(n.TTL))
+			}
+			fmt.Fprintf(w, "migrate %s %s\n", n.Key, value)
+			migrated++
+		}
+	}
+	walk(r.Node.Nodes)
+	fmt.Fprintf(w, "%d keys migrated, %d failed\n", migrated, failed)
+	return failed, nil
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		value, migrated string
+		changed, err    bool
+	}{
+		{`{"host":"10.0.0.1","port":80,"weight":5}`, `{"host":"10.0.0.1","port":80,"version":1,"weight":5}`, true, false},
+		{`{"host":"10.0.0.1","version":1}`, `{"host":"10.0.0.1","version":1}`, false, false},
+		{`{"host":"10.0.0.1","version":2}`, `{"host":"10.0.0.1","version":2}`, false, true},
+		{`{"host":`, `{"host":`, false, true},
+	}
+	for _, tc := range tests {
+		migrated, changed, err := migrate(tc.value)
+		if migrated != tc.migrated || changed != tc.changed || (err != nil) != tc.err {
+			t.Errorf("migrate(%s) = %s, %t, %v, want %s, %t, error %t", tc.value, migrated, changed, err, tc.migrated, tc.changed, tc.err)
+		}
+	}
+}
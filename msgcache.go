@@ -0,0 +1,293 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// msgCache caches complete (and signed) responses, so a repeated query does
+// not need to go to etcd or sign anything. Negative responses (NXDOMAIN and
+// NODATA) are cached too, for at most negTtl seconds. Responses that had at
+// least prefetch hits are refreshed before they expire. The bytes used count
+// against the memory budget and are shown in gauge.
+type msgCache struct {
+	sync.RWMutex
+	size     int
+	negTtl   uint32
+	prefetch int32
+	m        map[string]*msgEntry
+	bytes    int64
+	gauge    metrics.Gauge
+}
+
+type msgEntry struct {
+	msg      *dns.Msg
+	ttl      time.Duration
+	expire   time.Time
+	negative bool
+	size     int // estimated, in bytes
+
+	hits        int32 // use atomically
+	prefetching int32 // use atomically
+}
+
+// newMsgCache returns a cache that holds at most size responses, or nil when size is 0.
+func newMsgCache(size int, negTtl uint32, prefetch int, gauge metrics.Gauge) *msgCache {
+	if size <= 0 {
+		return nil
+	}
+	return &msgCache{size: size, negTtl: negTtl, prefetch: int32(prefetch), m: make(map[string]*msgEntry), gauge: gauge}
+}
+
+// msgKey returns the cache key for req: the view, qname, qtype, CD and DO bits
+// and the EDNS0 client subnet, if any.
+func msgKey(req *dns.Msg, view string) string {
+	q := req.Question[0]
+	key := view + "/" + strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype))
+	if req.CheckingDisabled {
+		// A validating nameserver answers SERVFAIL to a bogus name, unless CD is set.
+		key += "/cd"
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		return key
+	}
+	if opt.Do() {
+		key += "/do"
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			key += "/" + e.Address.String() + "/" + strconv.Itoa(int(e.SourceNetmask))
+		}
+	}
+	return key
+}
+
+// get returns a copy of the cached response for req in view, with the id and
+// question of req and the TTLs lowered by the time it was cached, or nil.
+// Prefetch is true when the caller should refresh the response, because it is
+// popular and about to expire. Only one caller gets true.
+func (c *msgCache) get(req *dns.Msg, view string) (m *dns.Msg, prefetch bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := msgKey(req, view)
+	c.RLock()
+	e, ok := c.m[key]
+	c.RUnlock()
+	if !ok {
+		StatsCacheMiss.Inc(1)
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(e.expire) {
+		c.Lock()
+		if c.m[key] == e {
+			c.drop(key)
+		}
+		c.Unlock()
+		StatsCacheMiss.Inc(1)
+		return nil, false
+	}
+	hits := atomic.AddInt32(&e.hits, 1)
+	if c.prefetch > 0 && hits >= c.prefetch && e.expire.Sub(now) <= e.ttl/10 {
+		prefetch = atomic.CompareAndSwapInt32(&e.prefetching, 0, 1)
+	}
+	if e.negative {
+		StatsNegativeCacheHit.Inc(1)
+	} else {
+		StatsCacheHit.Inc(1)
+	}
+	m = e.msg.Copy()
+	m.Id = req.Id
+	ageTtl(m, uint32(now.Sub(e.expire.Add(-e.ttl))/time.Second))
+	echoCase(m, req.Question[0].Name)
+	return m, prefetch
+}
+
+// ageTtl lowers the TTLs in m by age seconds, so the caches of the clients
+// don't keep the records longer than the first one that got them.
+func ageTtl(m *dns.Msg, age uint32) {
+	if age == 0 {
+		return
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range section {
+			h := r.Header()
+			switch {
+			case h.Rrtype == dns.TypeOPT:
+			case h.Ttl > age:
+				h.Ttl -= age
+			default:
+				h.Ttl = 0
+			}
+		}
+	}
+}
+
+// uncachedKey is the context key of the flag that keeps a response out of the
+// response cache, see uncached.
+type uncachedKey struct{}
+
+// withUncached returns ctx with a new flag for uncached, and the flag.
+func withUncached(ctx context.Context) (context.Context, *int32) {
+	flag := new(int32)
+	return context.WithValue(ctx, uncachedKey{}, flag), flag
+}
+
+// uncached keeps the response to the query of ctx out of the response cache, for
+// answers that are picked for each query.
+func uncached(ctx context.Context) {
+	if flag, ok := ctx.Value(uncachedKey{}).(*int32); ok {
+		atomic.StoreInt32(flag, 1)
+	}
+}
+
+// insert caches m as the response to req in view. Positive answers expire with the
+// lowest TTL in the message, negative ones with the lowest of the SOA's TTL and
+// minimum and negTtl. Other responses are not cached.
+func (c *msgCache) insert(req *dns.Msg, view string, m *dns.Msg) {
+	if c == nil || m.Truncated {
+		return
+	}
+	var (
+		ttl      uint32
+		ok       bool
+		negative bool
+	)
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		ttl, ok = minTtl(m)
+	case m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError:
+		ttl, ok = negativeTtl(m)
+		if ttl > c.negTtl {
+			ttl = c.negTtl
+		}
+		negative = true
+		StatsNegativeCacheMiss.Inc(1)
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+	key := msgKey(req, view)
+	d := time.Duration(ttl) * time.Second
+	c.Lock()
+	defer c.Unlock()
+	c.add(key, &msgEntry{msg: m.Copy(), ttl: d, expire: time.Now().Add(d), negative: negative})
+}
+
+// add stores e under key. When the cache is full, or e does not fit in the
+// memory budget, random entries are evicted. It returns false if e still does
+// not fit, because the other caches use the budget. The caller holds the lock.
+func (c *msgCache) add(key string, e *msgEntry) bool {
+	if _, ok := c.m[key]; ok {
+		c.drop(key)
+	}
+	e.size = e.msg.Len() + len(key) + entryOverhead
+	for k := range c.m {
+		if len(c.m) < c.size && memory.fits(e.size) {
+			break
+		}
+		StatsCacheEvictCount.Inc(1)
+		c.drop(k)
+	}
+	if !memory.fits(e.size) {
+		return false
+	}
+	c.m[key] = e
+	c.account(e.size)
+	return true
+}
+
+// drop removes the entry for key. The caller holds the lock.
+func (c *msgCache) drop(key string) {
+	if e, ok := c.m[key]; ok {
+		delete(c.m, key)
+		c.account(-e.size)
+	}
+}
+
+func (c *msgCache) account(n int) {
+	c.bytes += int64(n)
+	memory.add(n)
+	if c.gauge != nil {
+		c.gauge.Update(c.bytes)
+	}
+}
+
+// flush removes all responses from the cache.
+func (c *msgCache) flush() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.m = make(map[string]*msgEntry)
+	c.account(-int(c.bytes))
+}
+
+// minTtl returns the lowest TTL of the records in m, the OPT record excluded.
+func minTtl(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range section {
+			if r.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || r.Header().Ttl < ttl {
+				ttl = r.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// negativeTtl returns the TTL for the negative response m: the lowest of the
+// TTL and the minimum of the SOA record in the authority section.
+func negativeTtl(m *dns.Msg) (uint32, bool) {
+	for _, r := range m.Ns {
+		if soa, ok := r.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl, true
+			}
+			return soa.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
+
+// prefetchWriter is the dns.ResponseWriter used to refresh a cached response,
+// the response is only inserted in the cache. It has the address of the client
+// whose query triggered the prefetch, so the same ACLs apply.
+type prefetchWriter struct {
+	local, remote net.Addr
+}
+
+func (w *prefetchWriter) LocalAddr() net.Addr         { return w.local }
+func (w *prefetchWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *prefetchWriter) WriteMsg(m *dns.Msg) error   { return nil }
+func (w *prefetchWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *prefetchWriter) Close() error                { return nil }
+func (w *prefetchWriter) TsigStatus() error           { return nil }
+func (w *prefetchWriter) TsigTimersOnly(bool)         {}
+func (w *prefetchWriter) Hijack()                     {}
+
+// prefetch refreshes the cached response to req in the background.
+func (s *server) prefetch(w dns.ResponseWriter, req *dns.Msg) {
+	StatsPrefetchCount.Inc(1)
+	go s.ServeDNS(&prefetchWriter{local: w.LocalAddr(), remote: w.RemoteAddr()}, req.Copy())
+}
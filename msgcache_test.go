@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMsgCache(t *testing.T) {
+	c := newMsgCache(2, 30, 0, nil)
+	req := new(dns.Msg)
+	req.SetQuestion("www.skydns.test.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{new(Service).NewA("www.skydns.test.", 60, net.ParseIP("10.0.0.1").To4())}
+	c.insert(req, "", m)
+
+	req1 := new(dns.Msg)
+	req1.SetQuestion("WWW.skydns.test.", dns.TypeA)
+	m1, _ := c.get(req1, "")
+	if m1 == nil {
+		t.Fatal("expected a cached response")
+	}
+	if m1.Id != req1.Id || m1.Question[0].Name != "WWW.skydns.test." {
+		t.Fatalf("id and question are not from the request: %s", m1)
+	}
+
+	req1.CheckingDisabled = true
+	if m, _ := c.get(req1, ""); m != nil {
+		t.Fatal("expected no cached response with the CD bit")
+	}
+	req1.CheckingDisabled = false
+	req1.SetEdns0(4096, true)
+	if m, _ := c.get(req1, ""); m != nil {
+		t.Fatal("expected no cached response with the DO bit")
+	}
+
+	req.Question[0].Qtype = dns.TypeAAAA
+	nx := new(dns.Msg)
+	nx.SetRcode(req, dns.RcodeNameError)
+	c.insert(req, "", nx)
+	if m, _ := c.get(req, ""); m != nil {
+		t.Fatal("expected no cached negative response without a SOA")
+	}
+	nx.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "skydns.test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600}, Minttl: 300}}
+	c.insert(req, "", nx)
+	if m, _ := c.get(req, ""); m == nil {
+		t.Fatal("expected a cached negative response")
+	}
+	if e := c.m[msgKey(req, "")]; e.expire.After(time.Now().Add(30 * time.Second)) {
+		t.Fatalf("negative response cached longer than the cap: %s", e.expire)
+	}
+}
+
+func TestMsgCacheMemory(t *testing.T) {
+	c := newMsgCache(10, 30, 0, nil)
+	defer c.flush()
+	defer memory.limit(0)
+	req := new(dns.Msg)
+	req.SetQuestion("www.skydns.test.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{new(Service).NewA("www.skydns.test.", 60, net.ParseIP("10.0.0.1").To4())}
+	c.insert(req, "", m)
+	// Room for one more response.
+	memory.limit(memory.used + int64(c.bytes))
+
+	for _, name := range []string{"a.skydns.test.", "b.skydns.test."} {
+		req := req.Copy()
+		req.Question[0].Name = name
+		m := m.Copy()
+		m.Question[0].Name = name
+		m.Answer[0].Header().Name = name
+		c.insert(req, "", m)
+	}
+	if len(c.m) != 2 {
+		t.Fatalf("expected 2 cached responses, got %d", len(c.m))
+	}
+	if memory.used > memory.max {
+		t.Fatalf("used %d bytes of %d", memory.used, memory.max)
+	}
+}
+
+func TestMsgCacheAge(t *testing.T) {
+	c := newMsgCache(1, 30, 0, nil)
+	req := new(dns.Msg)
+	req.SetQuestion("www.skydns.test.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{new(Service).NewA("www.skydns.test.", 60, net.ParseIP("10.0.0.1").To4())}
+	c.insert(req, "", m)
+
+	e := c.m[msgKey(req, "")]
+	e.expire = e.expire.Add(-25 * time.Second)
+	m1, _ := c.get(req, "")
+	if m1 == nil {
+		t.Fatal("expected a cached response")
+	}
+	if ttl := m1.Answer[0].Header().Ttl; ttl != 35 {
+		t.Errorf("TTL of the cached answer = %d, want 35", ttl)
+	}
+	if ttl := e.msg.Answer[0].Header().Ttl; ttl != 60 {
+		t.Errorf("TTL in the cache = %d, want 60", ttl)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// NSRecord is a nameserver for the domain, with its address for the glue records.
+type NSRecord struct {
+	Name string `json:"name"`
+	Addr string `json:"addr,omitempty"`
+}
+
+// nsRecords returns the NS records for the domain and the A and AAAA records
+// for the nameservers. These are the configured nameservers or, when none are
+// configured, ns1.dns.<domain>, ns2.dns.<domain>, etc. with the addresses of
+// the etcd machines.
+func (s *server) nsRecords() (ns, glue []dns.RR) {
+	servers := s.config.NS
+	if len(servers) == 0 {
+		for i, h := range clusterAddrs(s.client.GetCluster()) {
+			if h == "" {
+				continue
+			}
+			servers = append(servers, NSRecord{Name: fmt.Sprintf("ns%d.dns.%s", i+1, s.config.Domain), Addr: h})
+		}
+	}
+	serv := new(Service)
+	for _, n := range servers {
+		ns = append(ns, serv.NewNS(s.config.Domain, s.config.Ttl, n.Name))
+		ip := net.ParseIP(n.Addr)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			glue = append(glue, serv.NewA(n.Name, s.config.Ttl, ip.To4()))
+		default:
+			glue = append(glue, serv.NewAAAA(n.Name, s.config.Ttl, ip.To16()))
+		}
+	}
+	return ns, glue
+}
+
+// isNS returns true when name is one of the configured nameservers.
+func (s *server) isNS(name string) bool {
+	for _, n := range s.config.NS {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setNSID adds our NSID (RFC 5001) to m when the client asked for it in req.
+func (s *server) setNSID(req, m *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil || s.config.NSID == "" {
+		return
+	}
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0NSID {
+			continue
+		}
+		o1 := m.IsEdns0()
+		if o1 == nil {
+			m.SetEdns0(s.config.EdnsUdpSize, false)
+			o1 = m.IsEdns0()
+		}
+		o1.Option = append(o1.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(s.config.NSID))})
+		return
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// What SkyDNS reads from etcd and the question names it looks up there pass
+// through here, so the limits in the configuration (MaxLabels, MaxValueSize
+// and MaxAnswers) are applied in one place. A zero limit is no limit.
+
+// decodeService decodes the service stored in n, with its TTL and key set. A
+// value longer than MaxValueSize, or one that is not a JSON object, is an error.
+func (config *Config) decodeService(n *etcd.Node) (*Service, error) {
+	if config.MaxValueSize > 0 && len(n.Value) > config.MaxValueSize {
+		return nil, fmt.Errorf("value of %s is longer than %d bytes", n.Key, config.MaxValueSize)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(n.Value), "{") {
+		return nil, fmt.Errorf("value of %s is not a JSON object", n.Key)
+	}
+	serv := new(Service)
+	if err := json.Unmarshal([]byte(n.Value), serv); err != nil {
+		return nil, err
+	}
+	serv.ttl = uint32(n.TTL)
+	if serv.ttl == 0 {
+		serv.ttl = config.Ttl
+	}
+	serv.key = n.Key
+	return serv, nil
+}
+
+// badName returns true when name, in our domain, can't have services: it has
+// more than MaxLabels labels or a label with a slash, which would change the
+// etcd path it maps to.
+func (config *Config) badName(name string) bool {
+	if config.MaxLabels > 0 && dns.CountLabel(name) > config.MaxLabels {
+		return true
+	}
+	return strings.Contains(name, "/")
+}
+
+// limitAnswers cuts the answer section of m to MaxAnswers records.
+func (config *Config) limitAnswers(m *dns.Msg) {
+	if config.MaxAnswers > 0 && len(m.Answer) > config.MaxAnswers {
+		m.Answer = m.Answer[:config.MaxAnswers]
+	}
+}
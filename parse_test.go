@@ -0,0 +1,43 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestDecodeService(t *testing.T) {
+	config := &Config{Ttl: 3600, MaxValueSize: 64}
+	serv, err := config.decodeService(&etcd.Node{Key: "/skydns/test/skydns/web", Value: `{"host":"10.0.0.1"}`})
+	if err != nil || serv.Host != "10.0.0.1" || serv.ttl != 3600 || serv.key != "/skydns/test/skydns/web" {
+		t.Fatalf("decodeService = %v, %v", serv, err)
+	}
+	for _, bad := range []string{"null", `"10.0.0.1"`, "[]", `{"host":`, `{"host":"` + strings.Repeat("a", 64) + `"}`} {
+		if _, err := config.decodeService(&etcd.Node{Key: "/skydns/test/skydns/web", Value: bad}); err == nil {
+			t.Errorf("decodeService(%s) gives no error", bad)
+		}
+	}
+}
+
+// FuzzDecodeService checks that no value from etcd makes SkyDNS panic when it
+// builds the records of the service.
+func FuzzDecodeService(f *testing.F) {
+	f.Add(`{"host":"10.0.0.1","port":80}`)
+	f.Add(`{"host":"web.skydns.test","rr":["TXT hello"]}`)
+	f.Add(`{"tlsa":{"certificate":"zz"},"sshfp":[{}]}`)
+	f.Add(`null`)
+	config := &Config{Ttl: 3600, MaxValueSize: 65536}
+	f.Fuzz(func(t *testing.T, value string) {
+		serv, err := config.decodeService(&etcd.Node{Key: "/skydns/test/skydns/web", Value: value})
+		if err != nil {
+			return
+		}
+		serv.validate("web.skydns.test.")
+		serv.NewSRV("web.skydns.test.", serv.ttl, 10)
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Pools for the reply messages and the buffers we pack messages into, to
+// take some pressure off the garbage collector when there are many queries.
+var (
+	msgPool = sync.Pool{New: func() interface{} { return new(dns.Msg) }}
+	bufPool = sync.Pool{New: func() interface{} { return make([]byte, dns.DefaultMsgSize) }}
+)
+
+// getMsg returns an empty message from the pool.
+func getMsg() *dns.Msg { return msgPool.Get().(*dns.Msg) }
+
+// putMsg returns m to the pool. The sections keep their capacity, but the
+// records are cleared so they can be garbage collected. M must not be used
+// afterwards.
+func putMsg(m *dns.Msg) {
+	if m == nil {
+		return
+	}
+	m.MsgHdr = dns.MsgHdr{}
+	m.Compress = false
+	m.Question = m.Question[:0]
+	m.Answer = clearRRs(m.Answer)
+	m.Ns = clearRRs(m.Ns)
+	m.Extra = clearRRs(m.Extra)
+	msgPool.Put(m)
+}
+
+func clearRRs(rrs []dns.RR) []dns.RR {
+	for i := range rrs {
+		rrs[i] = nil
+	}
+	return rrs[:0]
+}
+
+// pack packs m into a buffer from the pool, return it with putBuf when done.
+func pack(m *dns.Msg) ([]byte, error) {
+	buf := bufPool.Get().([]byte)
+	b, err := m.PackBuffer(buf)
+	if err != nil {
+		putBuf(buf)
+	}
+	return b, err
+}
+
+func putBuf(b []byte) { bufPool.Put(b[:cap(b)]) }
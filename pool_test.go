@@ -0,0 +1,41 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func benchmarkReply(b *testing.B, pooled bool) {
+	req := new(dns.Msg)
+	req.SetQuestion("1.rails.production.east.skydns.local.", dns.TypeA)
+	ip := net.ParseIP("10.0.0.1").To4()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var m *dns.Msg
+		if pooled {
+			m = getMsg()
+		} else {
+			m = new(dns.Msg)
+		}
+		m.SetReply(req)
+		for j := 0; j < 4; j++ {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: ip})
+		}
+		if pooled {
+			buf, _ := pack(m)
+			putBuf(buf)
+			putMsg(m)
+		} else {
+			m.Pack()
+		}
+	}
+}
+
+func BenchmarkReply(b *testing.B)       { benchmarkReply(b, false) }
+func BenchmarkReplyPooled(b *testing.B) { benchmarkReply(b, true) }
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// An SRV query for _<name>._<protocol>.<service name>, the form of RFC 2782,
+// that has no key of its own is answered with the named ports of the services
+// of service name, i.e. _http._tcp.web.skydns.local with the ports named http
+// with protocol tcp of the services of web.skydns.local.
+
+// splitSRVName returns the port name, protocol and service name of the RFC 2782
+// SRV name, or empty strings when name is not one.
+func splitSRVName(name string) (port, proto, base string) {
+	l := dns.SplitDomainName(name)
+	if len(l) < 3 || !strings.HasPrefix(l[0], "_") || !strings.HasPrefix(l[1], "_") {
+		return "", "", ""
+	}
+	return l[0][1:], l[1][1:], dns.Fqdn(strings.Join(l[2:], "."))
+}
+
+// namedPortRecords returns the SRV records of the ports named port with protocol
+// proto of the services of base, and the addresses of their targets.
+func (s *server) namedPortRecords(ctx context.Context, q dns.Question, port, proto, base, root string) (records []dns.RR, extra []dns.RR, err error) {
+	sx, err := s.services(ctx, base, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	type match struct {
+		serv *Service
+		port int
+	}
+	var mx []match
+	for _, serv := range sx {
+		if serv.Host == "" {
+			continue
+		}
+		for _, p := range serv.Ports {
+			if strings.EqualFold(p.Name, port) && strings.EqualFold(p.Protocol, proto) {
+				mx = append(mx, match{serv, p.Port})
+			}
+		}
+	}
+	if len(mx) == 0 {
+		return nil, nil, nil
+	}
+	weight := uint16(math.Floor(float64(100 / len(mx))))
+	for _, m := range mx {
+		serv := *m.serv
+		serv.Port = m.port
+		if serv.Priority == 0 {
+			serv.Priority = int(s.config.Priority)
+		}
+		ip := net.ParseIP(serv.Host)
+		if ip != nil {
+			// A wildcard key has no name of its own, use the one looked up.
+			if serv.Host = Domain(serv.key); strings.Contains(serv.Host, "*") {
+				serv.Host = base
+			}
+		}
+		records = append(records, serv.NewSRV(q.Name, serv.ttl, weight))
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			extra = append(extra, serv.NewA(serv.Host, serv.ttl, ip.To4()))
+		default:
+			extra = append(extra, serv.NewAAAA(serv.Host, serv.ttl, ip.To16()))
+		}
+	}
+	return records, extra, nil
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestSplitSRVName(t *testing.T) {
+	tests := []struct {
+		name, port, proto, base string
+	}{
+		{"_http._tcp.web.skydns.local.", "http", "tcp", "web.skydns.local."},
+		{"_http.web.skydns.local.", "", "", ""},
+		{"web.skydns.local.", "", "", ""},
+		{"_http._tcp.", "", "", ""},
+	}
+	for _, tc := range tests {
+		port, proto, base := splitSRVName(tc.name)
+		if port != tc.port || proto != tc.proto || base != tc.base {
+			t.Errorf("%s: expected %q %q %q, got %q %q %q", tc.name, tc.port, tc.proto, tc.base, port, proto, base)
+		}
+	}
+}
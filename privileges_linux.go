@@ -0,0 +1,58 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges changes the root directory to dir and then becomes name, when
+// these are not empty. The user's primary group becomes the only group. Since
+// Go 1.16 Setuid applies to all threads, after it there is no way back to
+// root, which is checked. The sockets are bound by then, so no capability,
+// not even CAP_NET_BIND_SERVICE, is kept.
+func dropPrivileges(dir, name string) error {
+	uid, gid := -1, -1
+	if name != "" {
+		// Looked up before the chroot, as /etc/passwd may not be in it.
+		u, err := user.Lookup(name)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("user %s: bad uid %q", name, u.Uid)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("user %s: bad gid %q", name, u.Gid)
+		}
+	}
+	if dir != "" {
+		if err := syscall.Chroot(dir); err != nil {
+			return fmt.Errorf("chroot %s: %s", dir, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %s", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %s", uid, err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("could become root again after setuid %d", uid)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func dropPrivileges(dir, name string) error {
+	return errors.New("-chroot and -user are not supported on this platform")
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// With PrometheusSd the services are served as Prometheus HTTP service
+// discovery targets (http_sd_config), on /prometheus/targets of the admin API
+// and of HealthAddr. The format is that of file_sd_config too, so a file can be
+// made with curl. Every service with a host is a target, host:port when it has a
+// port. The services of a name with the same tags share a target group, the
+// tags are its labels, with __meta_skydns_name set to the name.
+
+// labelName is what Prometheus allows as a label name.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// prometheusTargets serves the target groups of the services in our domain, or
+// below the name parameter.
+func (s *server) prometheusTargets(w http.ResponseWriter, r *http.Request) {
+	s = s.current()
+	name := s.config.Domain
+	if n := r.URL.Query().Get("name"); n != "" {
+		name = strings.ToLower(dns.Fqdn(n))
+	}
+	resp, err := s.client.Get(PathNoWildcard(name), true, true)
+	if err != nil && !notFound(err) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	groups := []*targetGroup{}
+	if err == nil {
+		groups = s.targetGroups(resp.Node)
+	}
+	b, _ := json.MarshalIndent(groups, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// targetGroups returns the target groups for the services in n and below it,
+// in key order.
+func (s *server) targetGroups(n *etcd.Node) []*targetGroup {
+	var groups []*targetGroup
+	var walk func(n *etcd.Node)
+	walk = func(n *etcd.Node) {
+		if n.Dir {
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+			return
+		}
+		serv, err := s.config.decodeService(n)
+		if err != nil || serv.Host == "" {
+			return
+		}
+		labels := map[string]string{"__meta_skydns_name": serviceName(n.Key)}
+		for k, v := range serv.Tags {
+			labels[k] = v
+		}
+		target := serv.Host
+		if serv.Port > 0 {
+			target = net.JoinHostPort(serv.Host, strconv.Itoa(serv.Port))
+		}
+		for _, g := range groups {
+			if reflect.DeepEqual(g.Labels, labels) {
+				g.Targets = append(g.Targets, target)
+				return
+			}
+		}
+		groups = append(groups, &targetGroup{Targets: []string{target}, Labels: labels})
+	}
+	walk(n)
+	return groups
+}
+
+// serviceName returns the name of the service at key: the name of the key
+// without its last label when that is a number, as in web/1, web/2, ...
+func serviceName(key string) string {
+	if i := strings.LastIndex(key, "/"); i > 0 {
+		if _, err := strconv.Atoi(key[i+1:]); err == nil {
+			key = key[:i]
+		}
+	}
+	return Domain(key)
+}
+
+// validTags returns the problems with the tags of a service.
+func validTags(tags map[string]string) (problems []string) {
+	for k := range tags {
+		if !labelName.MatchString(k) || strings.HasPrefix(k, "__") {
+			problems = append(problems, fmt.Sprintf("tag %q is not a label name", k))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestTargetGroups(t *testing.T) {
+	s := NewServer(&Config{Ttl: 3600}, nil)
+	root := &etcd.Node{Key: "/skydns/local/skydns", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/web", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/skydns/web/1", Value: `{"host":"10.0.0.1","port":9100,"tags":{"job":"web"}}`},
+			{Key: "/skydns/local/skydns/web/2", Value: `{"host":"2001:db8::1","port":9100,"tags":{"job":"web"}}`},
+			{Key: "/skydns/local/skydns/web/3", Value: `{"host":"10.0.0.3"}`},
+		}},
+		{Key: "/skydns/local/skydns/txt", Value: `{"rr":["TXT hello"]}`},
+	}}
+	groups := s.targetGroups(root)
+	want := []*targetGroup{
+		{Targets: []string{"10.0.0.1:9100", "[2001:db8::1]:9100"}, Labels: map[string]string{"__meta_skydns_name": "web.skydns.local.", "job": "web"}},
+		{Targets: []string{"10.0.0.3"}, Labels: map[string]string{"__meta_skydns_name": "web.skydns.local."}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("targetGroups = %v, want %v", groups, want)
+	}
+	if p := validTags(map[string]string{"__name__": "x", "a-b": "y", "env": "prod"}); len(p) != 2 {
+		t.Errorf("validTags = %v, want two problems", p)
+	}
+}
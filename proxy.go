@@ -0,0 +1,174 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Support for the PROXY protocol (v1 and v2) of HAProxy, see
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt. Connections from
+// a trusted load balancer must start with a PROXY header, the address in it is
+// the client's. Connections from elsewhere are used as is.
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener is a net.Listener that reads the PROXY header of the
+// connections coming from trusted addresses.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return c, nil
+	}
+	for _, n := range l.trusted {
+		if n.Contains(addr.IP) {
+			return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+		}
+	}
+	return c, nil
+}
+
+// proxyConn reads the PROXY header on first use. Reading it lazily keeps a slow
+// client from blocking Accept, the read deadline of the DNS server applies.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) header() {
+	c.once.Do(func() {
+		c.remote, c.err = readProxyHeader(c.r)
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.header()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client, as given in the PROXY header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.header()
+	return c.remote
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from r and returns the source
+// address in it. The address is nil for LOCAL (v2) and UNKNOWN (v1) connections.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("connection from a trusted proxy without PROXY header")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("bad PROXY v1 header")
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("bad PROXY v1 header")
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("bad PROXY v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("bad PROXY v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 { // LOCAL, i.e. a health check of the proxy itself
+		return nil, nil
+	}
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
+
+// proxyServers makes the TCP servers read the PROXY header from config.ProxyProtocol.
+func proxyServers(servers []*dns.Server, config *Config) error {
+	if len(config.proxyNets) == 0 {
+		return nil
+	}
+	for _, s := range servers {
+		if !strings.HasPrefix(s.Net, "tcp") {
+			continue
+		}
+		if s.Listener == nil {
+			l, err := net.Listen(s.Net, s.Addr)
+			if err != nil {
+				return err
+			}
+			s.Listener = l
+		}
+		s.Listener = &proxyListener{Listener: s.Listener, trusted: config.proxyNets}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a v2 header with command cmd, family fam and body.
+func proxyV2(cmd, fam byte, body string) string {
+	return string(proxyV2Signature) + string([]byte{0x20 | cmd, fam, 0, byte(len(body))}) + body
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := "\x0a\x00\x00\x01" + "\x0a\x00\x00\x02" + "\x30\x39" + "\x00\x35"
+	v6 := "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01" + strings.Repeat("\x00", 16) + "\x30\x39" + "\x00\x35"
+	tests := []struct {
+		name string
+		in   string
+		addr string // "" for no address
+		ok   bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 10.0.0.1 10.0.0.2 12345 53\r\n", "10.0.0.1:12345", true},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 53\r\n", "[2001:db8::1]:12345", true},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", true},
+		{"v1 no crlf", "PROXY TCP4 10.0.0.1 10.0.0.2 12345 53\n", "", false},
+		{"v1 bad ip", "PROXY TCP4 10.0.0 10.0.0.2 12345 53\r\n", "", false},
+		{"v1 bad port", "PROXY TCP4 10.0.0.1 10.0.0.2 port 53\r\n", "", false},
+		{"v1 udp", "PROXY UDP4 10.0.0.1 10.0.0.2 12345 53\r\n", "", false},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", false},
+		{"v2 tcp4", proxyV2(1, 0x11, v4), "10.0.0.1:12345", true},
+		{"v2 tcp6", proxyV2(1, 0x21, v6), "[2001:db8::1]:12345", true},
+		{"v2 local", proxyV2(0, 0x11, v4), "", true},
+		{"v2 unix", proxyV2(1, 0x31, strings.Repeat("\x00", 216)), "", true},
+		{"v2 short tcp4", proxyV2(1, 0x11, v4[:8]), "", false},
+		{"v2 short body", proxyV2(1, 0x11, v4)[:20], "", false},
+		{"v2 bad version", string(proxyV2Signature) + "\x11\x11\x00\x00", "", false},
+		{"no header", "\x00\x1dsome dns message here", "", false},
+	}
+	for _, tc := range tests {
+		r := bufio.NewReader(strings.NewReader(tc.in + "query"))
+		addr, err := readProxyHeader(r)
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: expected ok to be %t, got %v", tc.name, tc.ok, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.addr {
+			t.Errorf("%s: expected address %q, got %q", tc.name, tc.addr, got)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "query" {
+			t.Errorf("%s: expected the query after the header, got %q", tc.name, rest)
+		}
+	}
+}
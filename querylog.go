@@ -0,0 +1,94 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/miekg/dns"
+)
+
+// queryLog writes a JSON line for (a sample of) the queries.
+type queryLog struct {
+	sync.Mutex
+	w      io.Writer
+	sample float64       // fraction of the queries to log
+	slow   time.Duration // queries slower than this are always logged
+}
+
+type queryLogEntry struct {
+	Time    string  `json:"time"`
+	Client  string  `json:"client"`
+	ID      string  `json:"client_id,omitempty"`
+	Name    string  `json:"qname"`
+	Type    string  `json:"qtype"`
+	Rcode   string  `json:"rcode"`
+	Latency float64 `json:"latency_ms"`
+	Answers int     `json:"answers"`
+	Source  string  `json:"source"`
+	Slow    bool    `json:"slow,omitempty"`
+}
+
+// newQueryLog returns a queryLog that writes to dest, see openLog.
+func newQueryLog(dest string, sample float64, slow time.Duration, lg *log.Logger) (*queryLog, error) {
+	w, err := openLog(dest, "query", lg)
+	if err != nil {
+		return nil, err
+	}
+	return &queryLog{w: w, sample: sample, slow: slow}, nil
+}
+
+// log logs the reply, as seen by w, to the query req from the client with ID
+// id. Source tells where the answer came from.
+func (l *queryLog) log(w *logWriter, req *dns.Msg, id, source string, latency time.Duration) {
+	slow := l.slow > 0 && latency >= l.slow
+	if !slow && (l.sample <= 0 || (l.sample < 1 && rand.Float64() >= l.sample)) {
+		return
+	}
+	e := queryLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Latency: float64(latency) / float64(time.Millisecond),
+		ID:      id,
+		Source:  source,
+		Slow:    slow,
+	}
+	if ip := clientIP(w.RemoteAddr()); ip != nil {
+		e.Client = ip.String()
+	}
+	if len(req.Question) > 0 {
+		e.Name = req.Question[0].Name
+		e.Type = dns.TypeToString[req.Question[0].Qtype]
+	}
+	if w.written {
+		e.Rcode = dns.RcodeToString[w.rcode]
+		e.Answers = w.answers
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.Lock()
+	l.w.Write(append(b, '\n'))
+	l.Unlock()
+}
+
+// logWriter is a dns.ResponseWriter that remembers what it needs to log of
+// the reply. It doesn't keep the reply itself, as it may be reused.
+type logWriter struct {
+	dns.ResponseWriter
+	written bool
+	rcode   int
+	answers int
+}
+
+func (w *logWriter) WriteMsg(m *dns.Msg) error {
+	w.written, w.rcode, w.answers = true, m.Rcode, len(m.Answer)
+	return w.ResponseWriter.WriteMsg(m)
+}
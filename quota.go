@@ -0,0 +1,156 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The kinds of quota, a query must be within all of them.
+const (
+	quotaClient  = "client"  // per client address
+	quotaNetwork = "network" // per /24 (IPv4) or /56 (IPv6) of the client
+	quotaName    = "name"    // per question name
+)
+
+// quotaBuckets is the number of buckets a quota keeps before it removes the
+// full ones, so a stream of new clients doesn't grow it without bound. When
+// none are full the queries of new keys are over the quota. The buckets are
+// swept at most once per quotaSweep.
+const (
+	quotaBuckets = 65536
+	quotaSweep   = time.Second
+)
+
+// quota is a token bucket per key, each filling at rate tokens per second up
+// to a second's worth. A nil *quota allows everything.
+type quota struct {
+	sync.Mutex
+	rate    float64
+	buckets map[string]*bucket
+	swept   time.Time // last sweep
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newQuota returns a quota of rate queries per second, or nil when rate is 0.
+func newQuota(rate float64) *quota {
+	if rate <= 0 {
+		return nil
+	}
+	return &quota{rate: rate, buckets: make(map[string]*bucket)}
+}
+
+// burst is the size of the buckets, at least one query.
+func (q *quota) burst() float64 {
+	if q.rate < 1 {
+		return 1
+	}
+	return q.rate
+}
+
+// allow takes a token from the bucket of key and returns true, or false when
+// the bucket is empty.
+func (q *quota) allow(key string, now time.Time) bool {
+	if q == nil {
+		return true
+	}
+	q.Lock()
+	defer q.Unlock()
+	b, ok := q.buckets[key]
+	if !ok {
+		if len(q.buckets) >= quotaBuckets {
+			if now.Sub(q.swept) >= quotaSweep {
+				q.sweep(now)
+			}
+			if len(q.buckets) >= quotaBuckets {
+				return false
+			}
+		}
+		b = &bucket{tokens: q.burst(), last: now}
+		q.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * q.rate
+	if b.tokens > q.burst() {
+		b.tokens = q.burst()
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes the buckets that are full again, the caller holds the lock.
+func (q *quota) sweep(now time.Time) {
+	q.swept = now
+	for k, b := range q.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*q.rate >= q.burst() {
+			delete(q.buckets, k)
+		}
+	}
+}
+
+// quotas are the quotas of the configuration, by kind.
+type quotas map[string]*quota
+
+func newQuotas(config *Config) quotas {
+	return quotas{
+		quotaClient:  newQuota(config.QuotaClient),
+		quotaNetwork: newQuota(config.QuotaNetwork),
+		quotaName:    newQuota(config.QuotaName),
+	}
+}
+
+// exceeded returns the kind of the first quota the query req from ip is over,
+// or "" when it is within all of them.
+func (qs quotas) exceeded(ip net.IP, req *dns.Msg, now time.Time) string {
+	if ip != nil {
+		if !qs[quotaClient].allow(ip.String(), now) {
+			return quotaClient
+		}
+		network := ip.Mask(net.CIDRMask(56, 128))
+		if ip4 := ip.To4(); ip4 != nil {
+			network = ip4.Mask(net.CIDRMask(24, 32))
+		}
+		if !qs[quotaNetwork].allow(network.String(), now) {
+			return quotaNetwork
+		}
+	}
+	if !qs[quotaName].allow(strings.ToLower(req.Question[0].Name), now) {
+		return quotaName
+	}
+	return ""
+}
+
+// quotaStage refuses, or drops, the queries over one of the quotas.
+func (s *server) quotaStage(next handler) handler {
+	return func(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+		if qs.prefetch {
+			next(w, req, qs)
+			return
+		}
+		kind := s.quotas.exceeded(clientIP(w.RemoteAddr()), req, time.Now())
+		if kind == "" {
+			next(w, req, qs)
+			return
+		}
+		StatsQuotaCount[kind].Inc(1)
+		qs.source = "quota"
+		if s.config.QuotaPolicy == "drop" {
+			return
+		}
+		refused(w, req)
+	}
+}
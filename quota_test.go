@@ -0,0 +1,58 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQuotas(t *testing.T) {
+	qs := newQuotas(&Config{QuotaClient: 2, QuotaNetwork: 3})
+	req := new(dns.Msg)
+	req.SetQuestion("web.skydns.test.", dns.TypeA)
+	now := time.Now()
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	for i, want := range []string{"", "", quotaClient} {
+		if kind := qs.exceeded(a, req, now); kind != want {
+			t.Errorf("query %d from %s: exceeded = %q, want %q", i, a, kind, want)
+		}
+	}
+	// The queries of a took two of the three tokens of their /24.
+	for i, want := range []string{"", quotaNetwork} {
+		if kind := qs.exceeded(b, req, now); kind != want {
+			t.Errorf("query %d from %s: exceeded = %q, want %q", i, b, kind, want)
+		}
+	}
+	if kind := qs.exceeded(a, req, now.Add(time.Second)); kind != "" {
+		t.Errorf("query from %s a second later: exceeded = %q, want none", a, kind)
+	}
+}
+
+func TestQuotaBuckets(t *testing.T) {
+	q := newQuota(1)
+	now := time.Now()
+	for i := 0; i < quotaBuckets; i++ {
+		q.allow(strconv.Itoa(i), now)
+	}
+	// All buckets are empty, there is nothing to sweep.
+	if q.allow("new", now) {
+		t.Error("new key allowed with all buckets in use")
+	}
+	if len(q.buckets) != quotaBuckets {
+		t.Errorf("expected %d buckets, got %d", quotaBuckets, len(q.buckets))
+	}
+	// A second later they are full again and swept.
+	if !q.allow("new", now.Add(time.Second)) {
+		t.Error("new key refused after the sweep")
+	}
+	if len(q.buckets) != 1 {
+		t.Errorf("expected 1 bucket after the sweep, got %d", len(q.buckets))
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// services returns the services for name from etcd, found the same way as
+// for A and SRV queries, see lookup.
+func (s *server) services(ctx context.Context, name, root string) ([]*Service, error) {
+	r, parts, star, _, err := s.lookup(ctx, name, root)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Node.Dir { // single element
+		serv, err := s.config.decodeService(r.Node)
+		if err != nil {
+			s.config.log.Warningf("failed to parse json: %s", err.Error())
+			return nil, err
+		}
+		return []*Service{serv}, nil
+	}
+	sx, err := s.loopNodes(&r.Node.Nodes, parts, star)
+	if err != nil {
+		s.config.log.Warningf("failed to parse json: %s", err.Error())
+	}
+	sx, split := group(sx)
+	if split {
+		uncached(ctx)
+	}
+	return sx, err
+}
+
+// otherRecord returns true for the types answered by OtherRecords: all but
+// the ones AddressRecords and SRVRecords handle.
+func otherRecord(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeANY:
+		return false
+	}
+	return true
+}
+
+// OtherRecords returns the records of type q.Qtype, other than A, AAAA and
+// SRV, the services for q.Name publish, as typed fields or as raw records.
+func (s *server) OtherRecords(ctx context.Context, q dns.Question, root string) (records []dns.RR, err error) {
+	sx, err := s.services(ctx, strings.ToLower(q.Name), root)
+	if err != nil {
+		return nil, err
+	}
+	for _, serv := range sx {
+		switch {
+		case q.Qtype == dns.TypeNAPTR && serv.Naptr != nil:
+			records = append(records, serv.NewNAPTR(q.Name, serv.ttl))
+		case q.Qtype == dns.TypeTLSA && serv.Tlsa != nil:
+			records = append(records, serv.NewTLSA(q.Name, serv.ttl))
+		case q.Qtype == dns.TypeSSHFP:
+			records = append(records, serv.NewSSHFP(q.Name, serv.ttl)...)
+		}
+		rrs, err := serv.NewRR(q.Name, serv.ttl, q.Qtype)
+		if err != nil {
+			s.config.log.Warningf("%s", err.Error())
+		}
+		records = append(records, rrs...)
+	}
+	return records, nil
+}
+
+// indexCleared returns true when err is etcd's "index outdated and cleared": a
+// watch fell so far behind that the changes it missed are no longer in etcd's
+// history, and the watcher has to read everything again.
+func indexCleared(err error) bool {
+	e, ok := err.(*etcd.EtcdError)
+	return ok && e.ErrorCode == 401
+}
+
+// resyncIndex returns the index to watch from after a full read, following
+// the "index outdated" error err.
+func resyncIndex(err error) uint64 {
+	StatsEtcdResyncCount.Inc(1)
+	if e, ok := err.(*etcd.EtcdError); ok {
+		return e.Index + 1
+	}
+	return 0
+}
+
+// notFound returns true when err is etcd's "key not found".
+func notFound(err error) bool {
+	e, ok := err.(*etcd.EtcdError)
+	return ok && e.ErrorCode == 100
+}
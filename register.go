@@ -0,0 +1,89 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// With SelfName every replica registers itself as a service, with the address
+// SelfAddr and the port of (the first address in) DnsAddr, so clients and
+// secondaries can find the live nameservers in SkyDNS itself. The key gets a
+// TTL of SelfTtl and is refreshed every third of it, so a replica that dies
+// drops out. Giving the
+// replicas names below one parent (ns1.ns.skydns.local, ns2.ns.skydns.local)
+// makes the parent list all of them. On a clean stop the key is deleted.
+
+// setSelf checks the options for the self-registration.
+func setSelf(config *Config) error {
+	if config.SelfName == "" {
+		return nil
+	}
+	config.SelfName = dns.Fqdn(strings.ToLower(config.SelfName))
+	if !strings.HasSuffix(config.SelfName, "."+config.Domain) {
+		return fmt.Errorf("self_name %q is not in domain %s", config.SelfName, config.Domain)
+	}
+	host, _, err := net.SplitHostPort(config.dnsAddrs()[0])
+	if err != nil {
+		return fmt.Errorf("bad dns_addr %q: %s", config.DnsAddr, err)
+	}
+	if config.SelfAddr == "" {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			config.SelfAddr = host
+		}
+	}
+	if net.ParseIP(config.SelfAddr) == nil {
+		return fmt.Errorf("self_addr is not an IP address: %q, it is needed when dns_addr has none", config.SelfAddr)
+	}
+	if config.SelfTtl < 3*time.Second {
+		config.SelfTtl = 30 * time.Second
+	}
+	return nil
+}
+
+// selfService returns the key and the value we register ourselves under.
+func (config *Config) selfService() (key, value string) {
+	_, p, _ := net.SplitHostPort(config.dnsAddrs()[0])
+	port, _ := strconv.Atoi(p)
+	b, _ := json.Marshal(&Service{Version: serviceVersion, Host: config.SelfAddr, Port: port})
+	key, _ = Path(config.SelfName)
+	return key, string(b)
+}
+
+// register keeps us registered until stop is closed, then the key is deleted.
+// While etcd can't be reached the tries back off.
+func (s *server) register(config *Config, stop chan struct{}) {
+	key, value := config.selfService()
+	ttl := uint64(config.SelfTtl / time.Second)
+	bo := &backoff{min: config.SelfTtl / 3, max: etcdBackoffMax}
+	failing := false
+	for {
+		wait := config.SelfTtl / 3
+		if _, err := s.client.Set(key, value, ttl); err != nil {
+			if !failing {
+				config.log.Errorf("failure to register as %s: %s", config.SelfName, err.Error())
+			}
+			failing = true
+			wait = bo.next()
+		} else if failing {
+			config.log.Infof("registered as %s again", config.SelfName)
+			failing = false
+			bo.reset()
+		}
+		select {
+		case <-stop:
+			s.client.CompareAndDelete(key, value, 0)
+			return
+		case <-time.After(wait):
+		}
+	}
+}
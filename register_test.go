@@ -0,0 +1,27 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestSelfService(t *testing.T) {
+	config := &Config{Domain: "skydns.local.", DnsAddr: "10.0.0.1:53", SelfName: "ns1.ns.skydns.local"}
+	if err := setSelf(config); err != nil {
+		t.Fatal(err)
+	}
+	key, value := config.selfService()
+	if key != "/skydns/local/skydns/ns/ns1" || value != `{"version":1,"host":"10.0.0.1","port":53}` {
+		t.Errorf("selfService = %s %s", key, value)
+	}
+
+	config = &Config{Domain: "skydns.local.", DnsAddr: "0.0.0.0:53", SelfName: "ns1.ns.skydns.local"}
+	if err := setSelf(config); err == nil {
+		t.Error("setSelf: want an error without self_addr when dns_addr has no address")
+	}
+	config = &Config{Domain: "skydns.local.", DnsAddr: "127.0.0.1:53", SelfName: "ns1.example.org"}
+	if err := setSelf(config); err == nil {
+		t.Error("setSelf: want an error for a name outside the domain")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "time"
+
+// watch starts the goroutines that watch the files used by s.config, the DNSSEC
+// key among them, for changes, and the ones that keep the PTR records and the
+// Consul catalog. They stop when s.stop is closed. The caller holds s.mu.
+func (s *server) watch() {
+	if s.config.resolvConf {
+		s.startResolvConf()
+	} else {
+		s.stopResolvConf()
+	}
+	if s.blocklist != nil {
+		go s.blocklist.watch(s.config, 30*time.Second, s.stop)
+	}
+	if len(s.config.reverse) > 0 {
+		go s.syncReverse(s.config, 30*time.Second, s.stop)
+	}
+	if s.config.ConsulAddr != "" {
+		go s.syncConsul(s.config, s.stop)
+	}
+	if s.config.PubKey != nil {
+		go s.watchKey(s.config, 5*time.Second, s.stop)
+	}
+	go s.syncSerial(s.config, s.stop)
+	if s.config.ExistenceFilter {
+		go s.syncExistence(s.config, s.stop)
+	} else {
+		s.exists.set("", nil)
+	}
+}
+
+// Reload loads the configuration from etcd again and swaps it in. Queries in
+// flight are finished with the old configuration. The listening address, dnstap
+// and the query log can not be changed this way, they need a restart.
+func (s *server) Reload() error {
+	config, err := LoadConfig(s.client)
+	if err != nil {
+		return err
+	}
+	b, err := loadBlocklist(config)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.current()
+	if config.DnsAddr != cur.config.DnsAddr {
+		config.log.Warningf("dns_addr changed to %s, this needs a restart", config.DnsAddr)
+		config.DnsAddr = cur.config.DnsAddr
+	}
+	if cur.stop != nil {
+		close(cur.stop)
+	}
+	st := &state{config: config, blocklist: b, breaker: cur.breaker, stop: make(chan struct{})}
+	if config.BreakerFailures != cur.config.BreakerFailures || config.StaleTtl != cur.config.StaleTtl {
+		st.breaker = newBreaker(config.BreakerFailures, config.StaleTtl, s.probe)
+	}
+	if config.LogLevel != cur.config.LogLevel {
+		setLogLevel(logLevels[config.LogLevel])
+	}
+	// Flushed first, so their memory is accounted as free.
+	cur.rcache.flush()
+	cur.fcache.flush()
+	cur.scache.flush()
+	memory.limit(config.CacheMemory)
+	st.rcache = newMsgCache(config.CacheSize, config.CacheNegativeTtl, config.CachePrefetch, StatsMsgCacheMemory)
+	st.fcache = newStaleCache(config)
+	st.scache = newFailCache(config)
+	st.quotas = newQuotas(config)
+	s.publish(st).watch()
+	// The DNSSEC key may have changed, so the signatures could be wrong.
+	cache.flush()
+	config.log.Info("reloaded configuration")
+	return nil
+}
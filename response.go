@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// The response policies of a name, for clients that don't cope well with
+// many addresses in an answer.
+const (
+	policyAll    = "all"    // all addresses, the default
+	policyRandom = "random" // Count addresses picked at random
+	policyBest   = "best"   // the Count addresses with the highest weight
+)
+
+// responsePolicy returns the response policy, and its count, of the first
+// service in sx, in key order, that has one. The default is policyAll.
+func responsePolicy(sx []*Service) (string, int) {
+	var first *Service
+	for _, serv := range sx {
+		if serv.Policy != "" && (first == nil || serv.key < first.key) {
+			first = serv
+		}
+	}
+	if first == nil {
+		return policyAll, 0
+	}
+	count := first.Count
+	if count < 1 {
+		count = 1
+	}
+	return first.Policy, count
+}
+
+// answer applies the response policy to the address records rrs, rrs[i] is
+// the record of the service sx[i].
+func answer(policy string, count int, sx []*Service, rrs []dns.RR) []dns.RR {
+	if policy == policyAll || count >= len(rrs) {
+		return rrs
+	}
+	picked := make([]dns.RR, 0, count)
+	switch policy {
+	case policyRandom:
+		for _, i := range rand.Perm(len(rrs))[:count] {
+			picked = append(picked, rrs[i])
+		}
+	case policyBest:
+		order := make([]int, len(rrs))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return sx[order[i]].Weight > sx[order[j]].Weight })
+		for _, i := range order[:count] {
+			picked = append(picked, rrs[i])
+		}
+	}
+	return picked
+}
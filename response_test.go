@@ -0,0 +1,38 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnswer(t *testing.T) {
+	sx := []*Service{
+		{Host: "10.0.0.1", Weight: 10, key: "/skydns/local/skydns/web/1"},
+		{Host: "10.0.0.2", Weight: 30, Policy: policyBest, Count: 2, key: "/skydns/local/skydns/web/2"},
+		{Host: "10.0.0.3", Weight: 20, key: "/skydns/local/skydns/web/3"},
+	}
+	var rrs []dns.RR
+	for _, serv := range sx {
+		rrs = append(rrs, serv.NewA("web.skydns.local.", 60, net.ParseIP(serv.Host).To4()))
+	}
+	p, count := responsePolicy(sx)
+	if p != policyBest || count != 2 {
+		t.Fatalf("policy = %s, %d, want %s, 2", p, count, policyBest)
+	}
+	best := answer(p, count, sx, rrs)
+	if len(best) != 2 || best[0].(*dns.A).A.String() != "10.0.0.2" || best[1].(*dns.A).A.String() != "10.0.0.3" {
+		t.Errorf("best = %v, want 10.0.0.2 and 10.0.0.3", best)
+	}
+	if random := answer(policyRandom, 1, sx, rrs); len(random) != 1 {
+		t.Errorf("random = %v, want one address", random)
+	}
+	if all := answer(policyAll, 0, sx, rrs); len(all) != 3 {
+		t.Errorf("all = %v, want three addresses", all)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !mips && !mipsle && !mips64 && !mips64le
+// +build !mips,!mipsle,!mips64,!mips64le
+
+package main
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define for every
+// architecture.
+const soReusePort = 0xf
+
+// reusePort sets SO_REUSEPORT on the socket, so multiple processes can bind the same address.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	return err
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// For the addresses of the services in our domain that are in one of the
+// prefixes of Config.Reverse, IPv4 or IPv6, the PTR records are kept in etcd,
+// at the key reverseKey below the path of the reverse name. A PTR record goes
+// away when the last service with its address does: it is deleted by the next
+// sync, or expires with the services, as it gets the lowest TTL of them. Other
+// keys below a reverse name are left alone, so PTR records can still be added
+// by hand.
+//
+// The reverse names of a prefix are ours from its zone cut down: the first
+// octet (in-addr.arpa) or nibble (ip6.arpa) boundary at or after the prefix
+// length, so 10.0.0.0/8 from 10.in-addr.arpa. and 2001:db8::/30 from
+// the four /32 zones 8.b.d.0.1.0.0.2.ip6.arpa. to b.b.d.0.1.0.0.2.ip6.arpa.
+// Names above the cut are forwarded.
+
+const reverseKey = "skydns-ptr"
+
+// reverseIP returns the address of the in-addr.arpa or ip6.arpa name, 4 bytes
+// for IPv4, and the length in bits of the prefix it names. A name with fewer
+// labels than a full address has the rest set to zero, so 2.0.10.in-addr.arpa.
+// is 10.0.2.0 and 24. It returns nil when name is not a reverse name.
+func reverseIP(name string) (net.IP, int) {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		l := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(l) > net.IPv4len {
+			return nil, 0
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range l {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || (len(label) > 1 && label[0] == '0') {
+				return nil, 0
+			}
+			ip[len(l)-1-i] = byte(b)
+		}
+		return ip, 8 * len(l)
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		l := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(l) > 2*net.IPv6len {
+			return nil, 0
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range l {
+			v, err := strconv.ParseUint(label, 16, 8)
+			if err != nil || len(label) != 1 {
+				return nil, 0
+			}
+			// The last label is the first nibble.
+			n := len(l) - 1 - i
+			if n%2 == 0 {
+				v <<= 4
+			}
+			ip[n/2] |= byte(v)
+		}
+		return ip, 4 * len(l)
+	}
+	return nil, 0
+}
+
+// isReverse returns true when name is a reverse name below the zone cut of one
+// of the prefixes of Config.Reverse, these are answered from etcd.
+func (config *Config) isReverse(name string) bool {
+	if len(config.reverse) == 0 {
+		return false
+	}
+	ip, bits := reverseIP(name)
+	if ip == nil {
+		return false
+	}
+	for _, n := range config.reverse {
+		if len(n.IP) != len(ip) {
+			continue
+		}
+		step := 4
+		if len(ip) == net.IPv4len {
+			step = 8
+		}
+		ones, _ := n.Mask.Size()
+		if bits >= (ones+step-1)/step*step && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *Config) inReverse(ip net.IP) bool {
+	for _, n := range config.reverse {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncReverse updates the PTR records every interval, on the leader only, until
+// stop is closed. After a failure the next try backs off.
+func (s *server) syncReverse(config *Config, interval time.Duration, stop chan struct{}) {
+	bo := &backoff{min: interval, max: etcdBackoffMax}
+	for {
+		wait := interval
+		if s.elector.isLeader() {
+			if err := s.updateReverse(config); err != nil {
+				config.log.Errorf("failure to update the PTR records: %s", err.Error())
+				wait = bo.next()
+			} else {
+				bo.reset()
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ptrSet are the names with an address, ttl is the lowest TTL of their keys,
+// 0 when one of them doesn't expire.
+type ptrSet struct {
+	names []string
+	ttl   int64
+}
+
+// updateReverse writes the PTR records for the addresses of the services in our
+// domain and deletes the ones of addresses no service has anymore.
+func (s *server) updateReverse(config *Config) error {
+	want := make(map[string]*ptrSet)
+	p, _ := Path(config.Domain)
+	r, err := s.client.Get(p, true, true)
+	if err != nil && !notFound(err) {
+		return err
+	}
+	var walk func(n *etcd.Node)
+	walk = func(n *etcd.Node) {
+		if n.Dir {
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+			return
+		}
+		serv, err := config.decodeService(n)
+		if err != nil {
+			return
+		}
+		ip := net.ParseIP(serv.Host)
+		if ip == nil || !config.inReverse(ip) {
+			return
+		}
+		arpa, _ := dns.ReverseAddr(ip.String())
+		key := PathNoWildcard(arpa) + "/" + reverseKey
+		ps, ok := want[key]
+		if !ok {
+			ps = &ptrSet{ttl: n.TTL}
+			want[key] = ps
+		}
+		ps.names = append(ps.names, Domain(n.Key))
+		if n.TTL == 0 || (ps.ttl != 0 && n.TTL < ps.ttl) {
+			ps.ttl = n.TTL
+		}
+	}
+	if err == nil {
+		walk(r.Node)
+	}
+
+	have := make(map[string]string)
+	var found func(n *etcd.Node)
+	found = func(n *etcd.Node) {
+		for _, c := range n.Nodes {
+			if c.Dir {
+				found(c)
+			} else if strings.HasSuffix(c.Key, "/"+reverseKey) {
+				have[c.Key] = c.Value
+			}
+		}
+	}
+	for _, tree := range []string{"/skydns/arpa/in-addr", "/skydns/arpa/ip6"} {
+		r, err = s.client.Get(tree, false, true)
+		if err != nil && !notFound(err) {
+			return err
+		}
+		if err == nil {
+			found(r.Node)
+		}
+	}
+
+	for key, ps := range want {
+		sort.Strings(ps.names)
+		serv := &Service{Version: serviceVersion}
+		for i, name := range ps.names {
+			if i > 0 && name == ps.names[i-1] {
+				continue
+			}
+			serv.Rr = append(serv.Rr, "PTR "+name)
+		}
+		b, err := json.Marshal(serv)
+		if err != nil {
+			return err
+		}
+		// Keys with a TTL are refreshed, so they expire with the services.
+		if have[key] == string(b) && ps.ttl == 0 {
+			continue
+		}
+		if _, err := s.client.Set(key, string(b), uint64(ps.ttl)); err != nil {
+			config.log.Warningf("failure to write %s: %s", key, err.Error())
+		}
+	}
+	for key := range have {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if _, err := s.client.Delete(key, false); err != nil && !notFound(err) {
+			config.log.Warningf("failure to delete %s: %s", key, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReverse(t *testing.T) {
+	nets, _ := parseCIDRs([]string{"10.0.0.0/8", "172.16.0.0/12", "2001:db8::/30"})
+	config := &Config{reverse: nets}
+	tests := []struct {
+		name string
+		ip   string
+		bits int
+		ours bool
+	}{
+		{"1.2.0.10.in-addr.arpa.", "10.0.2.1", 32, true},
+		{"1.2.0.11.in-addr.arpa.", "11.0.2.1", 32, false},
+		{"2.0.10.in-addr.arpa.", "10.0.2.0", 24, true},
+		{"10.in-addr.arpa.", "10.0.0.0", 8, true},
+		{"16.172.in-addr.arpa.", "172.16.0.0", 16, true}, // the cut of a /12 is at /16
+		{"172.in-addr.arpa.", "172.0.0.0", 8, false},
+		{"a.2.0.10.in-addr.arpa.", "", 0, false},
+		{"01.2.0.10.in-addr.arpa.", "", 0, false},
+		{"1.2.0.10.skydns.local.", "", 0, false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::1", 128, true},
+		{"8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::", 32, true},
+		{"b.b.d.0.1.0.0.2.ip6.arpa.", "2001:dbb::", 32, true},
+		{"c.b.d.0.1.0.0.2.ip6.arpa.", "2001:dbc::", 32, false},
+		{"b.d.0.1.0.0.2.ip6.arpa.", "2001:db0::", 28, false}, // above the cut
+		{"bb.d.0.1.0.0.2.ip6.arpa.", "", 0, false},
+	}
+	for _, tc := range tests {
+		ip, bits := reverseIP(tc.name)
+		if (ip == nil && tc.ip != "") || (ip != nil && (ip.String() != tc.ip || bits != tc.bits)) {
+			t.Errorf("%s: expected address %q/%d, got %v/%d", tc.name, tc.ip, tc.bits, ip, bits)
+		}
+		if ours := config.isReverse(tc.name); ours != tc.ours {
+			t.Errorf("%s: expected %t, got %t", tc.name, tc.ours, ours)
+		}
+	}
+	if !config.inReverse(net.ParseIP("2001:db9::5")) {
+		t.Error("expected 2001:db9::5 in the reverse prefixes")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RewriteRule rewrites the queries for the names matching Name. Before the
+// lookup the question name can be replaced, after it the addresses in From
+// are mapped to To, keeping the host part, and the TTLs can be set.
+type RewriteRule struct {
+	// Regular expression the (lower case) question name must match, all names when empty.
+	Name string `json:"name,omitempty"`
+	// The name to look up instead, $1 etc. refer to the groups in Name.
+	Replacement string `json:"replacement,omitempty"`
+	// Map the addresses in From to the ones in To, a prefix of the same family and length.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Set the TTL of the records in the reply.
+	Ttl uint32 `json:"ttl,omitempty"`
+
+	re       *regexp.Regexp
+	from, to *net.IPNet
+}
+
+// setRewrites checks and compiles the rewrite rules in config. The rules
+// change the replies after they are signed, so they can't be used with DNSSEC.
+func setRewrites(config *Config) (err error) {
+	if len(config.Rewrite) > 0 && config.DNSSEC != "" {
+		return fmt.Errorf("rewrite can't be used with dnssec")
+	}
+	for _, r := range config.Rewrite {
+		if r.re, err = regexp.Compile(r.Name); err != nil {
+			return fmt.Errorf("bad rewrite name %q: %s", r.Name, err)
+		}
+		if r.From == "" && r.To == "" {
+			continue
+		}
+		if _, r.from, err = net.ParseCIDR(r.From); err != nil {
+			return fmt.Errorf("bad rewrite from %q: %s", r.From, err)
+		}
+		if _, r.to, err = net.ParseCIDR(r.To); err != nil {
+			return fmt.Errorf("bad rewrite to %q: %s", r.To, err)
+		}
+		fi, fb := r.from.Mask.Size()
+		ti, tb := r.to.Mask.Size()
+		if fi != ti || fb != tb {
+			return fmt.Errorf("rewrite from %s and to %s differ in family or length", r.From, r.To)
+		}
+	}
+	return nil
+}
+
+// rewriteRule returns the first rule that matches name, or nil.
+func (config *Config) rewriteRule(name string) *RewriteRule {
+	for _, r := range config.Rewrite {
+		if r.re.MatchString(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// rewriteWriter applies a rewrite rule to the reply, the question and the
+// owner names of the replaced name get the original name back. The DNSSEC
+// records no longer match the rewritten ones and are removed.
+type rewriteWriter struct {
+	dns.ResponseWriter
+	rule     *RewriteRule
+	question dns.Question // the original one
+	name     string       // the name looked up instead
+}
+
+func (w *rewriteWriter) WriteMsg(m *dns.Msg) error {
+	if w.name != "" {
+		if len(m.Question) > 0 {
+			m.Question[0] = w.question
+		}
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			for _, rr := range section {
+				if strings.EqualFold(rr.Header().Name, w.name) {
+					rr.Header().Name = w.question.Name
+				}
+			}
+		}
+	}
+	qt := w.question.Qtype
+	m.Answer, m.Ns, m.Extra = stripDnssec(m.Answer, qt), stripDnssec(m.Ns, qt), stripDnssec(m.Extra, qt)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if w.rule.Ttl > 0 {
+				rr.Header().Ttl = w.rule.Ttl
+			}
+			if w.rule.from == nil {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				rr.A = w.rule.mapIP(rr.A)
+			case *dns.AAAA:
+				rr.AAAA = w.rule.mapIP(rr.AAAA)
+			}
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// mapIP returns ip with the prefix From replaced by To, or ip when it isn't in From.
+func (r *RewriteRule) mapIP(ip net.IP) net.IP {
+	if !r.from.Contains(ip) {
+		return ip
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	to := r.to.IP
+	if len(to) != len(ip) {
+		return ip
+	}
+	mapped := make(net.IP, len(ip))
+	for i := range ip {
+		mapped[i] = to[i]&r.to.Mask[i] | ip[i]&^r.to.Mask[i]
+	}
+	return mapped
+}
+
+// rewrite returns the request and writer to use for req: when a rule matches,
+// a writer that rewrites the reply and, if the rule replaces the name, a copy of
+// req for the new name.
+func (s *server) rewrite(w dns.ResponseWriter, req *dns.Msg) (dns.ResponseWriter, *dns.Msg) {
+	if len(s.config.Rewrite) == 0 {
+		return w, req
+	}
+	q := req.Question[0]
+	r := s.config.rewriteRule(strings.ToLower(q.Name))
+	if r == nil {
+		return w, req
+	}
+	rw := &rewriteWriter{ResponseWriter: w, rule: r, question: q}
+	if r.Replacement == "" {
+		return rw, req
+	}
+	rw.name = dns.Fqdn(r.re.ReplaceAllString(strings.ToLower(q.Name), r.Replacement))
+	req = req.Copy()
+	req.Question[0].Name = rw.name
+	return rw, req
+}
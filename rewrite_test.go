@@ -0,0 +1,44 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSetRewritesDNSSEC(t *testing.T) {
+	config := &Config{DNSSEC: "Kskydns.local.+005+38250", Rewrite: []*RewriteRule{{Name: "legacy"}}}
+	if err := setRewrites(config); err == nil {
+		t.Fatal("rewrite accepted together with dnssec")
+	}
+}
+
+func TestRewriteStripsDnssec(t *testing.T) {
+	config := &Config{Rewrite: []*RewriteRule{{Name: `\.dmz\.`, From: "10.1.0.0/16", To: "172.16.0.0/16"}}}
+	if err := setRewrites(config); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{state: &state{config: config}}
+	req := new(dns.Msg)
+	req.SetQuestion("www.dmz.skydns.local.", dns.TypeA)
+	cw := new(captureWriter)
+	w, req := s.rewrite(cw, req)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	a, _ := dns.NewRR("www.dmz.skydns.local. 3600 IN A 10.1.2.3")
+	sig, _ := dns.NewRR("www.dmz.skydns.local. 3600 IN RRSIG A 5 4 3600 20300101000000 20200101000000 38250 skydns.local. AAAA")
+	m.Answer = []dns.RR{a, sig}
+	w.WriteMsg(m)
+
+	if len(cw.m.Answer) != 1 {
+		t.Fatalf("expected only the A record, got %v", cw.m.Answer)
+	}
+	if ip := cw.m.Answer[0].(*dns.A).A.String(); ip != "172.16.2.3" {
+		t.Errorf("expected 172.16.2.3, got %s", ip)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// Clients without a search list in resolv.conf (or with ndots:0) send the
+// bare host name, web., as it is. With Search such a single label is tried
+// with each of the suffixes, in order, and the first name that exists in etcd
+// is answered with a CNAME to it. Single labels that are not found are
+// forwarded as usual.
+
+// searchNames returns the names to try for name, nil when name is not a
+// single label or Search is empty.
+func (config *Config) searchNames(name string) []string {
+	if len(config.Search) == 0 || dns.CountLabel(name) != 1 {
+		return nil
+	}
+	names := make([]string, len(config.Search))
+	for i, suffix := range config.Search {
+		names[i] = name + suffix
+	}
+	return names
+}
+
+// search returns the first of the search names of name that has services in
+// etcd, or "" when none has. Root is the tree of the client's view or "".
+func (s *server) search(ctx context.Context, name, root string) string {
+	for _, base := range s.config.searchNames(name) {
+		if sx, err := s.services(ctx, base, root); err == nil && len(sx) > 0 {
+			return base
+		}
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchNames(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Search: []string{"default.svc.cluster.local.", "svc.cluster.local."}}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"web.", []string{"web.default.svc.cluster.local.", "web.svc.cluster.local."}},
+		{"web.default.", nil},
+		{".", nil},
+	}
+	for _, tc := range tests {
+		if got := config.searchNames(tc.name); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("searchNames(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	config.Search = nil
+	if got := config.searchNames("web."); got != nil {
+		t.Errorf("searchNames without search = %v, want none", got)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// The serial in the SOA record is serialBase plus the etcd index of the last
+// change below the domain, so it goes up whenever the zone changes and every
+// replica reports the same one. It starts at the highest modified index in the
+// tree, or at the serial stored in serialKey when that is higher: a deletion
+// leaves no node behind that carries its index. From then on the watch below
+// the domain raises it, deletions included, and the leader stores it.
+//
+// Older versions used the current time, truncated to the hour, as the serial.
+// serialBase lies above those, so the serial goes up on an upgrade too. The
+// time is still the serial until etcd has been read, which Run does before it
+// listens; after that the serial never goes back.
+//
+// SkyDNS doesn't do zone transfers or NOTIFY, so the serial is only seen in
+// the SOA answers and in the zone export.
+
+const serialKey = "/skydns/serial"
+
+// serialBase is added to the etcd index, it is above the time serials of
+// older versions until 2033.
+const serialBase = 2000000000
+
+// serial returns the serial for the SOA record, the time until the etcd index
+// is known.
+func (s *server) serial() uint32 {
+	if n := atomic.LoadUint32(&s.soaSerial); n != 0 {
+		return n
+	}
+	return uint32(time.Now().Truncate(time.Hour).Unix())
+}
+
+// raiseSerial sets the serial to n when that is higher, and returns true when
+// it did. Once set the serial never goes back.
+func (s *server) raiseSerial(n uint32) bool {
+	for {
+		old := atomic.LoadUint32(&s.soaSerial)
+		if n <= old {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&s.soaSerial, old, n) {
+			return true
+		}
+	}
+}
+
+// maxModifiedIndex returns the highest modified index of n and the nodes below it.
+func maxModifiedIndex(n *etcd.Node) uint64 {
+	if n == nil {
+		return 0
+	}
+	max := n.ModifiedIndex
+	for _, c := range n.Nodes {
+		if i := maxModifiedIndex(c); i > max {
+			max = i
+		}
+	}
+	return max
+}
+
+// loadSerial raises the serial to the highest modified index below p, or to
+// the stored one. It returns the index to watch p from.
+func (s *server) loadSerial(p string) (uint64, error) {
+	index := uint64(0)
+	r, err := s.client.Get(p, false, true)
+	switch {
+	case err == nil:
+		s.raiseSerial(serialBase + uint32(maxModifiedIndex(r.Node)))
+		index = r.EtcdIndex + 1
+	case notFound(err):
+		index = err.(*etcd.EtcdError).Index + 1
+	default:
+		return 0, err
+	}
+	r, err = s.client.Get(serialKey, false, false)
+	if err != nil && !notFound(err) {
+		return 0, err
+	}
+	if err == nil {
+		if n, err := strconv.ParseUint(r.Node.Value, 10, 32); err == nil {
+			s.raiseSerial(uint32(n))
+		}
+	}
+	return index, nil
+}
+
+// storeSerial stores the serial in serialKey, when we are the leader.
+func (s *server) storeSerial(config *Config) {
+	if !s.elector.isLeader() {
+		return
+	}
+	n := atomic.LoadUint32(&s.soaSerial)
+	if _, err := s.client.Set(serialKey, strconv.FormatUint(uint64(n), 10), 0); err != nil {
+		config.log.Errorf("failure to store the serial: %s", err.Error())
+	}
+}
+
+// syncSerial keeps the serial at the etcd index of the last change below
+// config.Domain, until stop is closed.
+func (s *server) syncSerial(config *Config, stop chan struct{}) {
+	p, _ := Path(config.Domain)
+	bo := &backoff{min: time.Second, max: etcdBackoffMax}
+	var index uint64
+	for {
+		var err error
+		if index, err = s.loadSerial(p); err == nil {
+			break
+		}
+		config.log.Errorf("failure to load the serial: %s", err.Error())
+		select {
+		case <-stop:
+			return
+		case <-time.After(bo.next()):
+		}
+	}
+	s.storeSerial(config)
+	for {
+		var ok bool
+		if index, ok = s.waitChange(p, index, time.Minute, stop); !ok {
+			return
+		}
+		// Index is one past the change, or 0 when the watch failed.
+		if index > 0 && s.raiseSerial(serialBase+uint32(index-1)) {
+			s.storeSerial(config)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// serialAfter returns true when a is after b in RFC 1982 serial arithmetic.
+func serialAfter(a, b uint32) bool {
+	return a != b && a-b < 1<<31
+}
+
+func TestSerial(t *testing.T) {
+	s := NewServer(new(Config), nil)
+	fallback := s.serial()
+	if fallback != uint32(time.Now().Truncate(time.Hour).Unix()) {
+		t.Errorf("serial = %d before the index is known, want the hour", fallback)
+	}
+	root := &etcd.Node{Key: "/skydns/local/skydns", Dir: true, ModifiedIndex: 4, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/web", Dir: true, ModifiedIndex: 5, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/skydns/web/1", ModifiedIndex: 12},
+		}},
+		{Key: "/skydns/local/skydns/db", ModifiedIndex: 9},
+	}}
+	if !s.raiseSerial(serialBase+uint32(maxModifiedIndex(root))) || s.serial() != serialBase+12 {
+		t.Fatalf("serial = %d, want %d", s.serial(), serialBase+12)
+	}
+	// From the time serial, of an older version or before etcd was read, to
+	// the one of the index the serial goes up.
+	if !serialAfter(s.serial(), fallback) {
+		t.Errorf("serial %d is not after the time serial %d", s.serial(), fallback)
+	}
+	if s.raiseSerial(serialBase+10) || s.serial() != serialBase+12 {
+		t.Errorf("serial = %d after a lower index, want %d", s.serial(), serialBase+12)
+	}
+	if !s.raiseSerial(serialBase+20) || s.serial() != serialBase+20 {
+		t.Errorf("serial = %d, want %d", s.serial(), serialBase+20)
+	}
+}
@@ -5,82 +5,333 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"log"
 	"math"
 	"net"
-	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/miekg/dns"
 )
 
+// server is a server with the state of the configuration that is current
+// when a query starts: the query runs with that state to the end, however
+// long it takes, while a reload or a live update publishes the next one.
 type server struct {
-	client *etcd.Client
-	config *Config
-	group  *sync.WaitGroup
+	*core
+	*state
+}
+
+// core holds what lives as long as the process.
+type core struct {
+	client   *etcd.Client
+	group    *sync.WaitGroup
+	tapper   *tapper
+	queryLog *queryLog
+	tracer   *tracer
+	elector  *elector      // nil when there is no election
+	conns    *upstreams    // open connections to the nameservers, nil without ForwardReuse
+	lookups  single        // the etcd requests going on, see single.go
+	forwards single        // the forwarded queries going on
+	audit    *auditLog     // nil when there is no audit log
+	exists   existence     // the names below the domain, see existence.go
+	done     chan struct{} // closed by Stop
+
+	mu         sync.RWMutex  // protects dnsServers and resolvStop, held while publishing a state
+	cur        atomic.Value  // the current *state, see current
+	resolvStop chan struct{} // closed to stop watchResolvConf, nil when it doesn't run
+
+	dnsServers []*dns.Server
+	queries    int32  // number of queries being served, use atomically
+	started    int32  // number of dnsServers listening, use atomically
+	warming    int32  // 1 while the signatures are warmed up, use atomically
+	preferIPv4 int32  // the happy_eyeballs policy tries IPv4 nameservers first, use atomically
+	etcdDown   int32  // 1 when etcd could not be reached the last time, use atomically
+	soaSerial  uint32 // the etcd index of the last change, 0 until known, use atomically, see serial.go
+}
+
+// state is the configuration and what is made from it. It is not changed
+// once published, a change publishes a copy.
+type state struct {
+	config    *Config
+	blocklist *blocklist
+	handler   handler       // the stages of Config.Stages, see middleware.go
+	rcache    *msgCache     // nil when disabled
+	breaker   *breaker      // nil when disabled
+	fcache    *msgCache     // forwarded answers for serve-stale, nil when disabled
+	scache    *failCache    // queries that failed to forward, nil when disabled
+	quotas    quotas        // by kind, see quota.go
+	stop      chan struct{} // closed when config is replaced by a reload
 }
 
 // Newserver returns a new server.
 func NewServer(config *Config, client *etcd.Client) *server {
-	return &server{client: client, config: config, group: new(sync.WaitGroup)}
+	s := &server{
+		core:  &core{client: client, group: new(sync.WaitGroup), done: make(chan struct{})},
+		state: &state{config: config, stop: make(chan struct{})},
+	}
+	s.cur.Store(s.state)
+	return s
+}
+
+// current returns the server with the current state.
+func (s *server) current() *server {
+	return &server{core: s.core, state: s.cur.Load().(*state)}
+}
+
+// publish makes st the current state and returns the server with it. The
+// caller holds s.mu.
+func (s *server) publish(st *state) *server {
+	ns := &server{core: s.core, state: st}
+	st.handler = ns.chain(st.config.Stages)
+	s.cur.Store(st)
+	return ns
+}
+
+// update publishes a copy of the current state, with a copy of its
+// configuration changed by f. The caller holds s.mu.
+func (s *server) update(f func(config *Config)) *server {
+	cur := s.cur.Load().(*state)
+	config := *cur.config
+	f(&config)
+	st := *cur
+	st.config = &config
+	return s.publish(&st)
 }
 
 // Run is a blocking operation that starts the server listening on the DNS ports.
 func (s *server) Run() error {
 	mux := dns.NewServeMux()
-	mux.Handle(".", s)
+	if s.config.UdpWorkers > 0 {
+		mux.Handle(".", newLimiter(s, s.config.UdpWorkers, s.config.OverloadPolicy))
+	} else {
+		mux.Handle(".", s)
+	}
+
+	if s.config.Dnstap != "" {
+		t, err := newTapper(s.config.Dnstap, s.config.log)
+		if err != nil {
+			return err
+		}
+		s.tapper = t
+		go t.run()
+	}
+	if s.config.TraceEndpoint != "" {
+		s.tracer = newTracer(s.config.TraceEndpoint, s.config.TraceSample, s.config.log)
+		go s.tracer.run()
+	}
+	if s.config.QueryLog != "" {
+		l, err := newQueryLog(s.config.QueryLog, s.config.QueryLogSample, s.config.QueryLogSlow, s.config.log)
+		if err != nil {
+			return err
+		}
+		s.queryLog = l
+	}
+	if s.config.ForwardReuse {
+		s.conns = newUpstreams(s.config.ForwardIdleTimeout)
+	}
+	if s.config.Election {
+		s.elector = newElector(s.client, s.config.ElectionTtl, s.config.DnsAddr, s.config.log)
+		go s.elector.run(s.done)
+	}
+	b, err := loadBlocklist(s.config)
+	if err != nil {
+		return err
+	}
+	s.blocklist = b
+	memory.limit(s.config.CacheMemory)
+	s.rcache = newMsgCache(s.config.CacheSize, s.config.CacheNegativeTtl, s.config.CachePrefetch, StatsMsgCacheMemory)
+	s.fcache = newStaleCache(s.config)
+	s.scache = newFailCache(s.config)
+	s.breaker = newBreaker(s.config.BreakerFailures, s.config.StaleTtl, s.probe)
+	s.quotas = newQuotas(s.config)
+	if s.config.CacheFile != "" {
+		if err := s.loadCaches(s.config.CacheFile); err != nil {
+			s.config.log.Errorf("failure to load the caches from %s: %s", s.config.CacheFile, err.Error())
+		}
+	}
+	// Read the serial before the first SOA record goes out, see serial.go.
+	domainPath, _ := Path(s.config.Domain)
+	if _, err := s.loadSerial(domainPath); err != nil {
+		s.config.log.Errorf("failure to load the serial: %s", err.Error())
+	}
+	s.mu.Lock()
+	s.publish(s.state)
+	s.watch()
+	s.mu.Unlock()
+
+	go s.watchConfig()
+	if s.config.AdminAddr != "" {
+		if err := s.runAdmin(s.config.AdminAddr); err != nil {
+			return err
+		}
+	}
+	if s.config.PubKey != nil && s.config.DnssecWarmup > 0 {
+		s.warming = 1
+		go s.warmup(s.config)
+	}
+
+	servers, err := newDNSServers(mux, s.config.dnsAddrs(), s.config)
+	if err != nil {
+		return err
+	}
+	if err := proxyServers(servers, s.config); err != nil {
+		return err
+	}
+	if s.config.Mdns {
+		server, err := newMDNSServer(s)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+	for _, server := range servers {
+		server.NotifyStartedFunc = func() { atomic.AddInt32(&s.started, 1) }
+	}
+	s.mu.Lock()
+	s.dnsServers = servers
+	s.mu.Unlock()
+	if s.config.HealthAddr != "" {
+		s.runHealth(s.config.HealthAddr)
+	}
+	if s.config.DoqAddr != "" {
+		if err := s.runDoQ(s.config.DoqAddr); err != nil {
+			return err
+		}
+	}
 
-	s.group.Add(2)
-	go runDNSServer(s.group, mux, "tcp", s.config.DnsAddr, s.config.ReadTimeout)
-	go runDNSServer(s.group, mux, "udp", s.config.DnsAddr, s.config.ReadTimeout)
+	if s.config.SelfName != "" {
+		go s.register(s.config, s.done)
+	}
+
+	s.group.Add(len(s.dnsServers))
+	for _, server := range s.dnsServers {
+		go runDNSServer(s.group, server)
+	}
 	s.config.log.Printf("connected to etcd cluster at %s", machines)
 
 	s.group.Wait()
 	return nil
 }
 
-// Stop stops a server.
+// Stop stops a server. It stops listening for new queries and waits, at most
+// ShutdownTimeout, for the queries in flight to finish. The watches are stopped
+// as well.
 func (s *server) Stop() {
-	//s.group.Add(-2)
+	s.mu.RLock()
+	servers := s.dnsServers
+	s.mu.RUnlock()
+	config := s.current().config
+	timeout := config.ShutdownTimeout
+	for _, server := range servers {
+		server.Shutdown()
+	}
+	s.conns.close()
+	if s.done != nil {
+		close(s.done)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&s.queries) > 0 {
+		if time.Now().After(deadline) {
+			config.log.Warningf("queries still in flight after %s, stopping anyway", timeout)
+			if config.CacheFile != "" {
+				config.log.Warningf("not saving the caches to %s", config.CacheFile)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.Lock()
+	cur := s.current()
+	if cur.stop != nil {
+		close(cur.stop)
+		st := *cur.state
+		st.stop = nil
+		s.publish(&st)
+	}
+	s.mu.Unlock()
+	if cur.config.CacheFile != "" {
+		if err := cur.saveCaches(cur.config.CacheFile); err != nil {
+			cur.config.log.Errorf("failure to save the caches to %s: %s", cur.config.CacheFile, err.Error())
+		}
+	}
 }
 
-func runDNSServer(group *sync.WaitGroup, mux *dns.ServeMux, net, addr string, readTimeout time.Duration) {
+func runDNSServer(group *sync.WaitGroup, server *dns.Server) {
 	defer group.Done()
 
-	server := &dns.Server{
-		Addr:        addr,
-		Net:         net,
-		Handler:     mux,
-		ReadTimeout: readTimeout,
+	serve := server.ListenAndServe
+	if server.Listener != nil || server.PacketConn != nil {
+		serve = server.ActivateAndServe
 	}
-	if err := server.ListenAndServe(); err != nil {
+	if err := serve(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-// ServeDNS is the handler for DNS requests, responsible for parsing DNS request, possibly forwarding
-// it to a real dns server and returning a response.
+// ServeDNS is the handler for DNS requests, it hands them to the stages, see
+// middleware.go.
 func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	atomic.AddInt32(&s.queries, 1)
+	defer atomic.AddInt32(&s.queries, -1)
+	s = s.current()
+	ctx, cancel := s.config.queryContext()
+	defer cancel()
 	q := req.Question[0]
 	name := strings.ToLower(q.Name)
-	StatsRequestCount.Inc(1)
+	_, prefetch := w.(*prefetchWriter)
+	if !prefetch {
+		StatsRequestCount.Inc(1)
+	}
 
-	if !strings.HasSuffix(name, s.config.Domain) {
-		s.ServeDNSForward(w, req)
-		return
+	id := s.config.clientID(req)
+	s.config.log.Debugf("query for %s type %d from %s (%s)", q.Name, q.Qtype, w.RemoteAddr(), id)
+
+	root := s.tracer.start("ServeDNS", spanKindServer, nil)
+	root.attr("dns.qname", name)
+	root.attr("dns.qtype", dns.TypeToString[q.Qtype])
+	root.attr("net.peer", w.RemoteAddr().String())
+	if id != "" {
+		root.attr("dns.client_id", id)
 	}
+	defer root.finish()
 
-	m := new(dns.Msg)
+	s.handler(w, req, &query{ctx: ctx, start: start, id: id, root: root, source: "backend", prefetch: prefetch})
+}
+
+// serveBackend answers the queries that made it through the stages from etcd,
+// or from a template, and signs the reply when DNSSEC is on.
+func (s *server) serveBackend(w dns.ResponseWriter, req *dns.Msg, qs *query) {
+	ctx, nocache := withUncached(qs.ctx)
+	root := qs.root
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	tmplAnswer, tmpl := s.templateAnswer(q)
+	view := s.view(w.RemoteAddr(), req)
+
+	m := getMsg()
 	m.SetReply(req)
 	m.Authoritative = true
 	m.RecursionAvailable = true
-	m.Answer = make([]dns.RR, 0, 10)
 	defer func() {
+		if len(m.Answer) > 0 {
+			// Only the address families of IpMode, this may make it a NODATA response.
+			if m.Answer = s.config.familyRRs(m.Answer); len(m.Answer) == 0 && len(m.Ns) == 0 {
+				StatsNoDataCount.Inc(1)
+				m.Ns = []dns.RR{s.NewSOA()}
+				m.Ns[0].Header().Ttl = s.config.MinTtl
+			}
+		}
+		m.Extra = s.config.familyRRs(m.Extra)
+		s.config.limitAnswers(m)
+		echoCase(m, q.Name)
 		// Set TTL to the minimum of the RRset.
 		minttl := s.config.Ttl
 		if len(m.Answer) > 1 {
@@ -97,14 +348,105 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		if opt := req.IsEdns0(); opt != nil && opt.Do() {
 			StatsDnssecOkCount.Inc(1)
 			if s.config.PubKey != nil {
-				s.Denial(m)
-				s.sign(m, opt.UDPSize())
+				sp := root.child("dnssec.sign", spanKindInternal)
+				misses := StatsDnssecCacheMiss.Count()
+				s.Denial(ctx, m)
+				s.sign(ctx, m)
+				// Not exact with concurrent queries, but good enough for a trace.
+				sp.attr("dnssec.cache_misses", strconv.FormatInt(StatsDnssecCacheMiss.Count()-misses, 10))
+				sp.finish()
 			}
 		}
+		if ctx.Err() != nil {
+			qs.source = "timeout"
+			timedOut(w, req)
+			putMsg(m)
+			return
+		}
+		s.setNSID(req, m)
+		if atomic.LoadInt32(nocache) == 0 {
+			s.rcache.insert(req, view, m)
+		}
+		s.config.truncate(w, req, m)
 		w.WriteMsg(m)
+		putMsg(m)
 	}()
 
-	if strings.HasSuffix(name, "dns."+s.config.Domain) || name == s.config.Domain {
+	if tmpl {
+		qs.source = "template"
+		m.Answer = append(m.Answer, tmplAnswer...)
+		if len(m.Answer) == 0 {
+			StatsNoDataCount.Inc(1)
+			m.Ns = []dns.RR{s.NewSOA()}
+			m.Ns[0].Header().Ttl = s.config.MinTtl
+		}
+		return
+	}
+
+	if dn := s.config.debugName(name); dn != "" && q.Qtype == dns.TypeTXT {
+		if !s.allowed(ACLDebug, w.RemoteAddr(), qs.id) {
+			qs.source = "acl"
+			StatsRefusedCount.Inc(1)
+			m.SetRcode(req, dns.RcodeRefused)
+			return
+		}
+		qs.source = "debug"
+		m.Answer = s.debugRecords(ctx, q.Name, dn, view)
+		return
+	}
+
+	if qs.search != "" {
+		sp := root.child("etcd.get", spanKindClient)
+		records, extra, err := s.autopathRecords(ctx, q, qs.search, view)
+		sp.fail(err)
+		sp.finish()
+		if err == nil {
+			qs.source = "search"
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: s.config.Ttl}
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr, Target: qs.search})
+			m.Answer = append(m.Answer, records...)
+			m.Extra = append(m.Extra, extra...)
+			return
+		}
+	}
+
+	if base := s.config.autopath(name); base != "" {
+		sp := root.child("etcd.get", spanKindClient)
+		records, extra, err := s.autopathRecords(ctx, q, base, view)
+		sp.fail(err)
+		sp.finish()
+		if err == nil && len(records) > 0 {
+			qs.source = "autopath"
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: s.config.Ttl}
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr, Target: base})
+			m.Answer = append(m.Answer, records...)
+			m.Extra = append(m.Extra, extra...)
+			return
+		}
+	}
+
+	if machine, ok := s.config.machinesName(name); ok {
+		qs.source = "machines"
+		records, found, err := s.machineRecords(q, machine)
+		switch {
+		case err != nil:
+			s.config.log.Errorf("failure to lookup the machine %s: %s", machine, err.Error())
+			m.SetRcode(req, dns.RcodeServerFailure)
+		case !found:
+			m.SetRcode(req, dns.RcodeNameError)
+			m.Ns = []dns.RR{s.NewSOA()}
+			m.Ns[0].Header().Ttl = s.config.MinTtl
+			StatsNameErrorCount.Inc(1)
+		case len(records) == 0:
+			StatsNoDataCount.Inc(1)
+			m.Ns = []dns.RR{s.NewSOA()}
+			m.Ns[0].Header().Ttl = s.config.MinTtl
+		}
+		m.Answer = append(m.Answer, records...)
+		return
+	}
+
+	if strings.HasSuffix(name, "dns."+s.config.Domain) || name == s.config.Domain || s.isNS(name) {
 		// As we hijack dns.skydns.local we need to return NODATA for that name.
 		if name == "dns."+s.config.Domain {
 			m.Ns = []dns.RR{s.NewSOA()}
@@ -116,7 +458,8 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 		if q.Qtype == dns.TypeDNSKEY && name == s.config.Domain {
 			if s.config.PubKey != nil {
-				m.Answer = append(m.Answer, s.config.PubKey)
+				// A copy, the owner name may get the case of the question.
+				m.Answer = append(m.Answer, dns.Copy(s.config.PubKey))
 				return
 			}
 		}
@@ -136,24 +479,16 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			}
 			return
 		}
-		for i, c := range s.client.GetCluster() {
-			u, e := url.Parse(c)
-			if e != nil {
-				continue
-			}
-			h, _, e := net.SplitHostPort(u.Host)
-			if e != nil {
-				continue
-			}
-			ip := net.ParseIP(h)
-			serv := new(Service)
-			switch {
-			case name == s.config.Domain && q.Qtype == dns.TypeNS:
-				m.Answer = append(m.Answer, serv.NewNS(s.config.Domain, s.config.Ttl, fmt.Sprintf("ns%d.dns.%s", i+1, s.config.Domain)))
-			case ip.To4() != nil && q.Qtype == dns.TypeA && q.Name == fmt.Sprintf("ns%d.dns.%s", i+1, s.config.Domain):
-				m.Answer = append(m.Answer, serv.NewA(q.Name, s.config.Ttl, ip.To4()))
-			case ip.To4() == nil && q.Qtype == dns.TypeAAAA && q.Name == fmt.Sprintf("ns%d.dns.%s", i+1, s.config.Domain):
-				m.Answer = append(m.Answer, serv.NewAAAA(q.Name, s.config.Ttl, ip.To16()))
+		ns, glue := s.nsRecords()
+		switch {
+		case name == s.config.Domain && q.Qtype == dns.TypeNS:
+			m.Answer = append(m.Answer, ns...)
+		case q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA:
+			for _, r := range glue {
+				if r.Header().Rrtype == q.Qtype && strings.ToLower(r.Header().Name) == name {
+					r.Header().Name = q.Name
+					m.Answer = append(m.Answer, r)
+				}
 			}
 		}
 		if len(m.Answer) > 0 {
@@ -161,8 +496,30 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 
+	if s.config.badName(name) {
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Ns = []dns.RR{s.NewSOA()}
+		m.Ns[0].Header().Ttl = s.config.MinTtl
+		StatsNameErrorCount.Inc(1)
+		return
+	}
+
+	// The filter only holds the names in /skydns, not the ones of a view.
+	if view == "" && s.exists.absent(name, s.config.Domain) {
+		qs.source = "filter"
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Ns = []dns.RR{s.NewSOA()}
+		m.Ns[0].Header().Ttl = s.config.MinTtl
+		StatsNameErrorCount.Inc(1)
+		StatsExistenceFilterCount.Inc(1)
+		return
+	}
+
 	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-		records, err := s.AddressRecords(q)
+		sp := root.child("etcd.get", spanKindClient)
+		records, err := s.AddressRecords(ctx, q, view)
+		sp.fail(err)
+		sp.finish()
 		if err != nil {
 			if e, ok := err.(*etcd.EtcdError); ok {
 				if e.ErrorCode == 100 {
@@ -177,7 +534,10 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		m.Answer = append(m.Answer, records...)
 	}
 	if q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY {
-		records, extra, err := s.SRVRecords(q)
+		sp := root.child("etcd.get", spanKindClient)
+		records, extra, err := s.SRVRecords(ctx, q, view)
+		sp.fail(err)
+		sp.finish()
 		if err != nil {
 			if e, ok := err.(*etcd.EtcdError); ok {
 				if e.ErrorCode == 100 {
@@ -191,6 +551,21 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 		m.Answer = append(m.Answer, records...)
 		m.Extra = append(m.Extra, extra...)
+		m.Extra = append(m.Extra, s.additional(ctx, records, m.Extra, w.RemoteAddr(), qs.id, view)...)
+	}
+	if otherRecord(q.Qtype) {
+		sp := root.child("etcd.get", spanKindClient)
+		records, err := s.OtherRecords(ctx, q, view)
+		sp.fail(err)
+		sp.finish()
+		if notFound(err) {
+			m.SetRcode(req, dns.RcodeNameError)
+			m.Ns = []dns.RR{s.NewSOA()}
+			m.Ns[0].Header().Ttl = s.config.MinTtl
+			StatsNameErrorCount.Inc(1)
+			return
+		}
+		m.Answer = append(m.Answer, records...)
 	}
 	if len(m.Answer) == 0 { // NODATA response
 		StatsNoDataCount.Inc(1)
@@ -200,9 +575,12 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 }
 
 // ServeDNSForward forwards a request to a nameservers and returns the response.
-func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
-	StatsDnssecOkCount.Inc(1)
-	if len(s.config.Nameservers) == 0 {
+func (s *server) ServeDNSForward(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		StatsDnssecOkCount.Inc(1)
+	}
+	nameservers := s.config.Nameservers
+	if len(nameservers) == 0 {
 		m := new(dns.Msg)
 		m.SetReply(req)
 		m.SetRcode(req, dns.RcodeServerFailure)
@@ -216,25 +594,37 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
 		network = "tcp"
 	}
 
-	c := &dns.Client{Net: network, ReadTimeout: s.config.ReadTimeout}
+	if s.scache.failed(req) {
+		StatsServfailCacheHit.Inc(1)
+		if s.serveStale(w, req) {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
 
-	// Use request Id for "random" nameserver selection
-	nsid := int(req.Id) % len(s.config.Nameservers)
-	try := 0
-Redo:
-	r, _, err := c.Exchange(req, s.config.Nameservers[nsid])
+	c := &dns.Client{Net: network, ReadTimeout: timeout(ctx, s.config.ReadTimeout)}
+	up := s.forwardRequest(req)
+	r, err := s.sharedExchange(ctx, c, up, nameservers)
 	if err == nil {
-		w.WriteMsg(r)
+		if r.Rcode == dns.RcodeServerFailure {
+			s.scache.insert(req)
+		}
+		s.forwarded(w, req, s.forwardReply(req, r))
 		return
 	}
-	// Seen an error, this can only mean, "server not reached", try again
-	// but only if we have not exausted our nameservers
-	if try < len(s.config.Nameservers) {
-		try++
-		nsid = (nsid + 1) % len(s.config.Nameservers)
-		goto Redo
+	if s.serveStale(w, req) {
+		return
+	}
+	if ctx.Err() != nil {
+		timedOut(w, req)
+		return
 	}
 
+	s.scache.insert(req)
 	s.config.log.Errorf("failure to forward request %q", err)
 	m := new(dns.Msg)
 	m.SetReply(req)
@@ -242,25 +632,22 @@ Redo:
 	w.WriteMsg(m)
 }
 
-func (s *server) AddressRecords(q dns.Question) (records []dns.RR, err error) {
+// AddressRecords returns A or AAAA records from etcd, root is the tree of the
+// client's view or "".
+func (s *server) AddressRecords(ctx context.Context, q dns.Question, root string) (records []dns.RR, err error) {
 	name := strings.ToLower(q.Name)
-	path, star := Path(name)
-	r, err := s.client.Get(path, false, true)
+	r, parts, star, _, err := s.lookup(ctx, name, root)
 	if err != nil {
 		return nil, err
 	}
 	if !r.Node.Dir { // single element
-		var serv *Service
-		if err := json.Unmarshal([]byte(r.Node.Value), &serv); err != nil {
-			s.config.log.Infof("failed to parse json: %s", err.Error())
+		serv, err := s.config.decodeService(r.Node)
+		if err != nil {
+			s.config.log.Warningf("failed to parse json: %s", err.Error())
 			return nil, err
 		}
 		ip := net.ParseIP(serv.Host)
-		ttl := uint32(r.Node.TTL)
-		if ttl == 0 {
-			ttl = s.config.Ttl
-		}
-		serv.key = r.Node.Key
+		ttl := serv.ttl
 		switch {
 		case ip == nil:
 		case ip.To4() != nil && q.Qtype == dns.TypeA:
@@ -270,20 +657,35 @@ func (s *server) AddressRecords(q dns.Question) (records []dns.RR, err error) {
 		}
 		return records, nil
 	}
-	nodes, err := s.loopNodes(&r.Node.Nodes, strings.Split(PathNoWildcard(name), "/"), star)
+	nodes, err := s.loopNodes(&r.Node.Nodes, parts, star)
 	if err != nil {
-		s.config.log.Infof("failed to parse json: %s", err.Error())
+		s.config.log.Warningf("failed to parse json: %s", err.Error())
 		return nil, err
 	}
+	nodes, split := group(nodes)
+	var answered []*Service
 	for _, serv := range nodes {
 		ip := net.ParseIP(serv.Host)
 		switch {
 		case ip == nil:
+			continue
 		case ip.To4() != nil && q.Qtype == dns.TypeA:
 			records = append(records, serv.NewA(q.Name, serv.ttl, ip.To4()))
 		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
 			records = append(records, serv.NewAAAA(q.Name, serv.ttl, ip.To16()))
+		default:
+			continue
 		}
+		answered = append(answered, serv)
+	}
+	if split {
+		uncached(ctx)
+	}
+	p, count := responsePolicy(nodes)
+	records = answer(p, count, answered, records)
+	if p == policyRandom || s.config.RoundRobin && len(records) > 1 {
+		// Another query gets other addresses or another order.
+		uncached(ctx)
 	}
 	if s.config.RoundRobin {
 		switch l := len(records); l {
@@ -308,48 +710,61 @@ func (s *server) AddressRecords(q dns.Question) (records []dns.RR, err error) {
 
 // SRVRecords returns SRV records from etcd.
 // If the Target is not an name but an IP address, an name is created .
-func (s *server) SRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR, err error) {
+func (s *server) SRVRecords(ctx context.Context, q dns.Question, root string) (records []dns.RR, extra []dns.RR, err error) {
 	name := strings.ToLower(q.Name)
-	path, star := Path(name)
-	r, err := s.client.Get(path, false, true)
+	r, parts, star, wildcard, err := s.lookup(ctx, name, root)
+	if notFound(err) {
+		if port, proto, base := splitSRVName(name); base != "" {
+			return s.namedPortRecords(ctx, q, port, proto, base, root)
+		}
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	// The target of a wildcard record is the name itself, the A or AAAA
+	// records for it are synthesized from the same wildcard.
+	target := func(key string) string {
+		if wildcard {
+			return q.Name
+		}
+		return Domain(key)
+	}
 	weight := uint16(100)
 	if !r.Node.Dir { // single element
-		var serv *Service
-		if err := json.Unmarshal([]byte(r.Node.Value), &serv); err != nil {
-			s.config.log.Infof("failed to parse json: %s", err.Error())
+		serv, err := s.config.decodeService(r.Node)
+		if err != nil {
+			s.config.log.Warningf("failed to parse json: %s", err.Error())
 			return nil, nil, err
 		}
 		ip := net.ParseIP(serv.Host)
-		ttl := uint32(r.Node.TTL)
-		if ttl == 0 {
-			ttl = s.config.Ttl
-		}
+		ttl := serv.ttl
 		if serv.Priority == 0 {
 			serv.Priority = int(s.config.Priority)
 		}
-		serv.key = r.Node.Key
 		switch {
+		case serv.Host == "": // only publishes other records
 		case ip == nil:
 			records = append(records, serv.NewSRV(q.Name, ttl, weight))
 		case ip.To4() != nil:
-			serv.Host = Domain(serv.key) // TODO(miek): ugly
+			serv.Host = target(serv.key) // TODO(miek): ugly
 			records = append(records, serv.NewSRV(q.Name, ttl, weight))
-			extra = append(extra, serv.NewA(Domain(r.Node.Key), ttl, ip.To4()))
+			extra = append(extra, serv.NewA(serv.Host, ttl, ip.To4()))
 		case ip.To4() == nil:
-			serv.Host = Domain(serv.key) // TODO(miek): ugly
+			serv.Host = target(serv.key) // TODO(miek): ugly
 			records = append(records, serv.NewSRV(q.Name, ttl, weight))
-			extra = append(extra, serv.NewAAAA(Domain(r.Node.Key), ttl, ip.To16()))
+			extra = append(extra, serv.NewAAAA(serv.Host, ttl, ip.To16()))
 		}
 		return records, extra, nil
 	}
 
-	sx, err := s.loopNodes(&r.Node.Nodes, strings.Split(PathNoWildcard(name), "/"), star)
+	sx, err := s.loopNodes(&r.Node.Nodes, parts, star)
 	if err != nil {
 		return nil, nil, err
 	}
+	sx, split := group(sx)
+	if split {
+		uncached(ctx)
+	}
 	if len(sx) == 0 {
 		return nil, nil, nil
 	}
@@ -357,16 +772,17 @@ func (s *server) SRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR, e
 	for _, serv := range sx {
 		ip := net.ParseIP(serv.Host)
 		switch {
+		case serv.Host == "":
 		case ip == nil:
 			records = append(records, serv.NewSRV(q.Name, serv.ttl, weight))
 		case ip.To4() != nil:
-			serv.Host = Domain(serv.key) // TODO(miek): ugly
+			serv.Host = target(serv.key) // TODO(miek): ugly
 			records = append(records, serv.NewSRV(q.Name, serv.ttl, weight))
-			extra = append(extra, serv.NewA(Domain(serv.key), serv.ttl, ip.To4()))
+			extra = append(extra, serv.NewA(serv.Host, serv.ttl, ip.To4()))
 		case ip.To4() == nil:
-			serv.Host = Domain(serv.key)
+			serv.Host = target(serv.key)
 			records = append(records, serv.NewSRV(q.Name, serv.ttl, weight))
-			extra = append(extra, serv.NewAAAA(Domain(serv.key), serv.ttl, ip.To16()))
+			extra = append(extra, serv.NewAAAA(serv.Host, serv.ttl, ip.To16()))
 		}
 	}
 	return records, extra, nil
@@ -375,13 +791,13 @@ func (s *server) SRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR, e
 // SOA returns a SOA record for this SkyDNS instance.
 func (s *server) NewSOA() dns.RR {
 	return &dns.SOA{Hdr: dns.RR_Header{Name: s.config.Domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.config.Ttl},
-		Ns:      "ns1.dns." + s.config.Domain,
+		Ns:      s.config.SoaNs,
 		Mbox:    s.config.Hostmaster,
-		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
-		Refresh: 28800,
-		Retry:   7200,
-		Expire:  604800,
-		Minttl:  s.config.MinTtl,
+		Serial:  s.serial(),
+		Refresh: s.config.SoaRefresh,
+		Retry:   s.config.SoaRetry,
+		Expire:  s.config.SoaExpire,
+		Minttl:  s.config.SoaMinttl,
 	}
 }
 
@@ -394,7 +810,6 @@ func (s *server) NewSOA() dns.RR {
 // loopNodes recursively loops through the nodes and returns all the values. The nodes' keyname
 // will be match against any wildcards when star is true.
 func (s *server) loopNodes(n *etcd.Nodes, nameParts []string, star bool) (sx []*Service, err error) {
-Nodes:
 	for _, n := range *n {
 		if n.Dir {
 			nodes, err := s.loopNodes(&n.Nodes, nameParts, star)
@@ -404,34 +819,33 @@ Nodes:
 			sx = append(sx, nodes...)
 			continue
 		}
-		if star {
-			keyParts := strings.Split(n.Key, "/")
-			for i, n := range nameParts {
-				if i > len(keyParts)-1 {
-					// name is longer than key
-					continue Nodes
-				}
-				if n == "*" {
-					continue
-				}
-				if keyParts[i] != n {
-					continue Nodes
-				}
-			}
+		if star && !matchStar(n.Key, nameParts) {
+			continue
 		}
-		serv := new(Service)
-		if err := json.Unmarshal([]byte(n.Value), &serv); err != nil {
+		serv, err := s.config.decodeService(n)
+		if err != nil {
 			return nil, err
 		}
-		serv.ttl = uint32(n.TTL)
-		if serv.ttl == 0 {
-			serv.ttl = s.config.Ttl
-		}
 		if serv.Priority == 0 {
 			serv.Priority = int(s.config.Priority)
 		}
-		serv.key = n.Key
 		sx = append(sx, serv)
 	}
 	return sx, nil
 }
+
+// matchStar returns true when key matches the path nameParts, in which a "*"
+// matches any element.
+func matchStar(key string, nameParts []string) bool {
+	keyParts := strings.Split(key, "/")
+	for i, n := range nameParts {
+		if i > len(keyParts)-1 {
+			// name is longer than key
+			return false
+		}
+		if n != "*" && keyParts[i] != n {
+			return false
+		}
+	}
+	return true
+}
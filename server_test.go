@@ -10,7 +10,6 @@ import (
 	"encoding/json"
 	"strconv"
 	"strings"
-	"sync"
 	"testing"
 	"time"
 
@@ -48,17 +47,15 @@ func delService(t *testing.T, s *server, k string) {
 func newTestServer(t *testing.T) *server {
 	Port += 10
 	StrPort = strconv.Itoa(Port)
-	s := new(server)
 	client := etcd.NewClient([]string{"http://127.0.0.1:4001"})
 	client.SyncCluster()
 
-	s.group = new(sync.WaitGroup)
-	s.client = client
-	s.config = new(Config)
+	s := NewServer(new(Config), client)
 	s.config.DnsAddr = "127.0.0.1:" + StrPort
 	s.config.Nameservers = []string{"8.8.4.4:53"}
 	s.config.Domain = "skydns.test."
 	s.config.Hostmaster = "hostmaster.skydns.test."
+	s.config.SoaNs = "ns1.dns.skydns.test."
 	s.config.DomainLabels = 2
 	s.config.Priority = 10
 	s.config.Ttl = 3600
@@ -148,6 +145,39 @@ func TestDNSForward(t *testing.T) {
 		t.Fatal("Answer expected to have A records or rcode not equal to RcodeSuccess")
 	}
 }
+func TestDNSWildcardRecord(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Stop()
+
+	key := PathNoWildcard("*.preview.skydns.test.")
+	if _, err := s.client.Create(key, `{"host":"10.0.2.10"}`, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.client.Delete(key, false)
+	addService(t, s, "pr-1.preview.skydns.test.", 0, &Service{Host: "10.0.2.11"})
+	defer delService(t, s, "pr-1.preview.skydns.test.")
+
+	c := new(dns.Client)
+	for name, rcode := range map[string]int{
+		"pr-42.preview.skydns.test.":    dns.RcodeSuccess,
+		"pr-1.preview.skydns.test.":     dns.RcodeSuccess,
+		"www.pr-1.preview.skydns.test.": dns.RcodeNameError, // pr-1 is the closest encloser
+		"pr-42.elsewhere.skydns.test.":  dns.RcodeNameError,
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		resp, _, err := c.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != rcode {
+			t.Errorf("%s: expected rcode %d, got %d", name, rcode, resp.Rcode)
+		}
+		if rcode == dns.RcodeSuccess && (len(resp.Answer) != 1 || resp.Answer[0].Header().Name != name) {
+			t.Errorf("%s: expected one A record for the name, got %v", name, resp.Answer)
+		}
+	}
+}
 func TestDNSTtlRRset(t *testing.T) {
 	s := newTestServerDNSSEC(t)
 	defer s.Stop()
@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// With ServfailCache a query that could not be forwarded, because the
+// nameservers gave a SERVFAIL or weren't reached, is not forwarded again for
+// that long (RFC 2308, section 7). Meanwhile it gets a SERVFAIL, or a stale
+// answer when there is one, so clients that retry quickly don't flood the
+// nameservers of a broken domain.
+
+// failCacheSize is the most queries kept.
+const failCacheSize = 10000
+
+type failCache struct {
+	sync.Mutex
+	ttl time.Duration
+	m   map[string]time.Time // when the entry expires, by msgKey
+}
+
+// newFailCache returns the cache for the failed queries, or nil when ServfailCache is not set.
+func newFailCache(config *Config) *failCache {
+	if config.ServfailCache == 0 {
+		return nil
+	}
+	return &failCache{ttl: config.ServfailCache, m: make(map[string]time.Time)}
+}
+
+// failed returns true when req failed to forward less than ttl ago.
+func (c *failCache) failed(req *dns.Msg) bool {
+	if c == nil {
+		return false
+	}
+	key := msgKey(req, "")
+	c.Lock()
+	defer c.Unlock()
+	expire, ok := c.m[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expire) {
+		delete(c.m, key)
+		return false
+	}
+	return true
+}
+
+// insert records that req failed to forward. When the cache is full the expired
+// entries are dropped, and random ones when that isn't enough.
+func (c *failCache) insert(req *dns.Msg) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if len(c.m) >= failCacheSize {
+		for k, expire := range c.m {
+			if now.After(expire) {
+				delete(c.m, k)
+			}
+		}
+		for k := range c.m {
+			if len(c.m) < failCacheSize {
+				break
+			}
+			delete(c.m, k)
+		}
+	}
+	c.m[msgKey(req, "")] = now.Add(c.ttl)
+}
+
+func (c *failCache) flush() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.m = make(map[string]time.Time)
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFailCache(t *testing.T) {
+	if c := newFailCache(&Config{}); c != nil || c.failed(new(dns.Msg).SetQuestion("a.example.org.", dns.TypeA)) {
+		t.Fatal("expected no cache when servfail_cache is not set")
+	}
+	c := newFailCache(&Config{ServfailCache: time.Minute})
+	req := new(dns.Msg)
+	req.SetQuestion("broken.example.org.", dns.TypeA)
+	if c.failed(req) {
+		t.Fatal("expected no failure before one is inserted")
+	}
+	c.insert(req)
+	req1 := new(dns.Msg)
+	req1.SetQuestion("BROKEN.example.org.", dns.TypeA)
+	if !c.failed(req1) {
+		t.Fatal("expected the failure, the case of the name doesn't matter")
+	}
+	req1.Question[0].Qtype = dns.TypeAAAA
+	if c.failed(req1) {
+		t.Fatal("expected no failure for another type")
+	}
+	c.m[msgKey(req, "")] = time.Now().Add(-time.Second)
+	if c.failed(req) {
+		t.Fatal("expected the failure to expire")
+	}
+}
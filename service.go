@@ -5,6 +5,8 @@
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
 	"github.com/miekg/dns"
 	"net"
 	"path"
@@ -15,14 +17,74 @@ import (
 // Host (Target in SRV) must be a domain name, but if it looks like an IP
 // address (4/6), we will treat it like an IP address.
 type Service struct {
+	// The version of the JSON, see serviceVersion.
+	Version  int    `json:"version,omitempty"`
 	Host     string `json:"host,omitempty"`
 	Port     int    `json:"port,omitempty"`
 	Priority int    `json:"priority,omitempty"`
+	// Only the services with the same group as the first one with a group
+	// are used, see group.
+	Group string `json:"group,omitempty"`
+	// The percentage of the queries that get the group of this service, see
+	// pickGroup.
+	Traffic int `json:"traffic,omitempty"`
+	// The response policy for A and AAAA queries: "all" (the default),
+	// "random" or "best", see responsePolicy. Count is the number of
+	// addresses for the last two, the ones with the highest Weight are best.
+	Policy string `json:"policy,omitempty"`
+	Count  int    `json:"count,omitempty"`
+	Weight int    `json:"weight,omitempty"`
+	// Named ports, for _<name>._<protocol> SRV queries, see namedPortRecords.
+	Ports []NamedPort `json:"ports,omitempty"`
+	// Tags, the labels of the Prometheus targets, see prometheus.go.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Other record types published by this service.
+	Naptr *NAPTR `json:"naptr,omitempty"`
+	Tlsa  *TLSA  `json:"tlsa,omitempty"`
+	// The SSH host key fingerprints of the host, usually one per key type.
+	Sshfp []SSHFP `json:"sshfp,omitempty"`
+	// Records of any other type in presentation format, without the owner
+	// name, i.e. "LOC 52 22 23.000 N 4 53 32.000 E -2.00m 0.00m 10000m 10m".
+	Rr []string `json:"rr,omitempty"`
 
 	ttl uint32
 	key string
 }
 
+// NamedPort is a port of a service with its name and protocol, i.e. http and tcp.
+type NamedPort struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// NAPTR is the rdata of a NAPTR record (RFC 3403), i.e. for SIP or ENUM.
+type NAPTR struct {
+	Order       uint16 `json:"order"`
+	Preference  uint16 `json:"preference"`
+	Flags       string `json:"flags,omitempty"`
+	Service     string `json:"service,omitempty"`
+	Regexp      string `json:"regexp,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// TLSA is the rdata of a TLSA record (RFC 6698), for DANE. Certificate is the
+// certificate association data in hex.
+type TLSA struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+// SSHFP is the rdata of a SSHFP record (RFC 4255). Fingerprint is in hex.
+type SSHFP struct {
+	Algorithm   uint8  `json:"algorithm"`
+	Type        uint8  `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
 // NewSRV returns a new SRV record based on the Service.
 func (s *Service) NewSRV(name string, ttl uint32, weight uint16) *dns.SRV {
 	return &dns.SRV{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
@@ -44,6 +106,116 @@ func (s *Service) NewNS(name string, ttl uint32, target string) *dns.NS {
 	return &dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl}, Ns: target}
 }
 
+// NewNAPTR returns a new NAPTR record based on the Service.
+func (s *Service) NewNAPTR(name string, ttl uint32) *dns.NAPTR {
+	replacement := "."
+	if s.Naptr.Replacement != "" {
+		replacement = dns.Fqdn(s.Naptr.Replacement)
+	}
+	return &dns.NAPTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNAPTR, Class: dns.ClassINET, Ttl: ttl},
+		Order: s.Naptr.Order, Preference: s.Naptr.Preference, Flags: s.Naptr.Flags,
+		Service: s.Naptr.Service, Regexp: s.Naptr.Regexp, Replacement: replacement}
+}
+
+// NewTLSA returns a new TLSA record based on the Service.
+func (s *Service) NewTLSA(name string, ttl uint32) *dns.TLSA {
+	return &dns.TLSA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: ttl},
+		Usage: s.Tlsa.Usage, Selector: s.Tlsa.Selector, MatchingType: s.Tlsa.MatchingType,
+		Certificate: strings.ToLower(s.Tlsa.Certificate)}
+}
+
+// NewSSHFP returns the SSHFP records based on the Service.
+func (s *Service) NewSSHFP(name string, ttl uint32) (records []dns.RR) {
+	for _, f := range s.Sshfp {
+		records = append(records, &dns.SSHFP{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSSHFP, Class: dns.ClassINET, Ttl: ttl},
+			Algorithm: f.Algorithm, Type: f.Type, FingerPrint: strings.ToLower(f.Fingerprint)})
+	}
+	return records
+}
+
+// NewRR returns the records in Rr with type qtype, all of them for ANY. Records
+// that don't parse are returned as an error, after the valid ones.
+func (s *Service) NewRR(name string, ttl uint32, qtype uint16) (records []dns.RR, err error) {
+	for _, r := range s.Rr {
+		rr, e := dns.NewRR(name + " " + r)
+		if e != nil || rr == nil {
+			err = fmt.Errorf("bad record %q for %s: %v", r, name, e)
+			continue
+		}
+		if (qtype != dns.TypeANY && rr.Header().Rrtype != qtype) || rr.Header().Class != dns.ClassINET {
+			continue
+		}
+		rr.Header().Ttl = ttl
+		records = append(records, rr)
+	}
+	return records, err
+}
+
+// validate returns the problems with s, the service for name: an invalid host
+// or address, a port or priority out of range, records that don't parse and a
+// version newer than this SkyDNS knows.
+func (s *Service) validate(name string) (problems []string) {
+	if s.Version > serviceVersion {
+		problems = append(problems, fmt.Sprintf("version %d is newer than %d", s.Version, serviceVersion))
+	}
+	other := s.Naptr != nil || s.Tlsa != nil || len(s.Sshfp) > 0 || len(s.Rr) > 0
+	switch {
+	case s.Host == "":
+		if !other {
+			problems = append(problems, "no host and no other records")
+		}
+	case net.ParseIP(s.Host) != nil:
+	case strings.Contains(s.Host, ":") || strings.Trim(s.Host, "0123456789.") == "":
+		problems = append(problems, fmt.Sprintf("invalid IP address %q", s.Host))
+	default:
+		if _, ok := dns.IsDomainName(s.Host); !ok {
+			problems = append(problems, fmt.Sprintf("invalid host name %q", s.Host))
+		}
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d out of range", s.Port))
+	}
+	for _, p := range s.Ports {
+		if p.Name == "" || p.Protocol == "" || p.Port < 1 || p.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("named port %q/%q %d without a name or protocol or out of range", p.Name, p.Protocol, p.Port))
+		}
+	}
+	problems = append(problems, validTags(s.Tags)...)
+	if s.Priority < 0 || s.Priority > 65535 {
+		problems = append(problems, fmt.Sprintf("priority %d out of range", s.Priority))
+	}
+	switch s.Policy {
+	case "", policyAll, policyRandom, policyBest:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown policy %q", s.Policy))
+	}
+	if s.Traffic < 0 || s.Traffic > 100 {
+		problems = append(problems, fmt.Sprintf("traffic %d is not a percentage", s.Traffic))
+	}
+	if s.Traffic > 0 && s.Group == "" {
+		problems = append(problems, "traffic without a group")
+	}
+	if s.Count < 0 || s.Weight < 0 {
+		problems = append(problems, fmt.Sprintf("negative count %d or weight %d", s.Count, s.Weight))
+	}
+	if s.Tlsa != nil {
+		if _, err := hex.DecodeString(s.Tlsa.Certificate); err != nil || s.Tlsa.Certificate == "" {
+			problems = append(problems, fmt.Sprintf("tlsa certificate %q is not hex", s.Tlsa.Certificate))
+		}
+	}
+	for _, f := range s.Sshfp {
+		if _, err := hex.DecodeString(f.Fingerprint); err != nil || f.Fingerprint == "" {
+			problems = append(problems, fmt.Sprintf("sshfp fingerprint %q is not hex", f.Fingerprint))
+		}
+	}
+	for _, r := range s.Rr {
+		if rr, err := dns.NewRR(name + " " + r); err != nil || rr == nil {
+			problems = append(problems, fmt.Sprintf("bad record %q: %v", r, err))
+		}
+	}
+	return problems
+}
+
 // Path converts a domainname to an etcd path. If s looks like service.staging.skydns.local.,
 // the resulting key will be /skydns/local/skydns/staging/service .
 // If a name contains wildcards (*), the name will be chopped of before the (first) wildcard, and
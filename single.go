@@ -0,0 +1,53 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "sync"
+
+// Identical work that is going on at the same time is done once: signing an
+// RRset, a lookup in etcd and forwarding a query. The callers that come in
+// while it runs wait for it and share the result.
+
+// Adapted from singleinflight.go from the original Go Code. Copyright 2013 The Go Authors.
+type call struct {
+	wg   sync.WaitGroup
+	val  interface{}
+	err  error
+	dups int
+}
+
+type single struct {
+	sync.Mutex
+	m map[string]*call
+}
+
+// Do runs fn for key, unless it is already running, then it waits for that
+// one. Shared is true when the result went to more than one caller.
+func (g *single) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.Unlock()
+		StatsSharedCount.Inc(1)
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := new(call)
+	c.wg.Add(1)
+	g.m[key] = c
+	g.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.Lock()
+	delete(g.m, key)
+	g.Unlock()
+
+	return c.val, c.err, c.dups > 0
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSingle(t *testing.T) {
+	var (
+		g     single
+		calls int32
+		wg    sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, _ := g.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+			if v != "value" || err != nil {
+				t.Errorf("Do = %v, %v, want value", v, err)
+			}
+		}()
+	}
+	// Wait until the other nine are waiting for the first.
+	for {
+		g.Lock()
+		c := g.m["key"]
+		n := 0
+		if c != nil {
+			n = c.dups
+		}
+		g.Unlock()
+		if n == 9 {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("fn ran %d times, want once", calls)
+	}
+}
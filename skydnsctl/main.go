@@ -0,0 +1,233 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Skydnsctl adds, lists, updates and removes SkyDNS services in etcd.
+//
+//	skydnsctl add api.staging 10.0.0.5:8080 -ttl 60
+//	skydnsctl list staging
+//	skydnsctl update api.staging 10.0.0.6:8080
+//	skydnsctl rm api.staging
+//
+// Names are relative to the SkyDNS domain, unless they end in a dot.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// serviceVersion is the version of the service JSON, see serviceVersion in SkyDNS.
+const serviceVersion = 1
+
+// service is the value SkyDNS stores for a service, see Service in SkyDNS.
+type service struct {
+	Version  int      `json:"version,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Rr       []string `json:"rr,omitempty"`
+}
+
+// rrFlag collects the values of a repeated -rr flag.
+type rrFlag []string
+
+func (f *rrFlag) String() string     { return strings.Join(*f, ", ") }
+func (f *rrFlag) Set(v string) error { *f = append(*f, v); return nil }
+
+var (
+	machines = flag.String("machines", os.Getenv("ETCD_MACHINES"), "comma separated list of etcd machines")
+	domain   = flag.String("domain", "", "SkyDNS domain, defaults to the one in the SkyDNS configuration or skydns.local.")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: skydnsctl [flags] <command> [arguments]
+
+commands:
+	add <name> [host[:port]] [-ttl seconds] [-priority n] [-rr record]...
+	update <name> [host[:port]] [-ttl seconds] [-priority n] [-rr record]...
+	list [name]
+	rm <name>
+
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+	m := strings.Split(*machines, ",")
+	if *machines == "" {
+		m = []string{"http://127.0.0.1:4001"}
+	}
+	client := etcd.NewClient(m)
+	if *domain == "" {
+		*domain = configDomain(client)
+	}
+	*domain = dns.Fqdn(strings.ToLower(*domain))
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "add", "update":
+		err = set(client, cmd == "add", args)
+	case "list", "ls":
+		name := ""
+		if len(args) > 0 {
+			name = args[0]
+		}
+		err = list(client, name)
+	case "rm", "remove":
+		if len(args) != 1 {
+			usage()
+		}
+		_, err = client.Delete(keyPath(args[0]), false)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skydnsctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// configDomain returns the domain from the SkyDNS configuration in etcd.
+func configDomain(client *etcd.Client) string {
+	r, err := client.Get("/skydns/config", false, false)
+	if err != nil {
+		return "skydns.local."
+	}
+	var config struct {
+		Domain string `json:"domain"`
+	}
+	if json.Unmarshal([]byte(r.Node.Value), &config) != nil || config.Domain == "" {
+		return "skydns.local."
+	}
+	return config.Domain
+}
+
+// set adds (when create is true) or updates a service.
+func set(client *etcd.Client, create bool, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	ttl := fs.Uint64("ttl", 0, "TTL in seconds, the key expires after this time, 0 means never")
+	priority := fs.Int("priority", 0, "priority of the SRV record")
+	var rrs rrFlag
+	fs.Var(&rrs, "rr", "record of another type without owner name, i.e. \"TXT hello\", may be repeated")
+	args = parseInterspersed(fs, args)
+	if len(args) != 2 && (len(args) != 1 || len(rrs) == 0) {
+		usage()
+	}
+	serv := service{Version: serviceVersion, Priority: *priority, Rr: rrs}
+	for _, r := range rrs {
+		if _, err := dns.NewRR("x. " + r); err != nil {
+			return fmt.Errorf("bad record %q: %s", r, err)
+		}
+	}
+	if *priority < 0 || *priority > 65535 {
+		return fmt.Errorf("bad priority: %d, not in 0..65535", *priority)
+	}
+	if len(args) == 2 {
+		serv.Host = args[1]
+		if host, port, err := net.SplitHostPort(args[1]); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil || p < 1 || p > 65535 {
+				return fmt.Errorf("bad port: %q, not in 1..65535", port)
+			}
+			serv.Host, serv.Port = host, p
+		}
+		if net.ParseIP(serv.Host) == nil {
+			if _, ok := dns.IsDomainName(serv.Host); !ok || serv.Host == "" || strings.Trim(serv.Host, "0123456789.") == "" {
+				return fmt.Errorf("bad host: %q, not an address or host name", serv.Host)
+			}
+		}
+	}
+	b, _ := json.Marshal(serv)
+	key := keyPath(args[0])
+	var err error
+	if create {
+		_, err = client.Create(key, string(b), *ttl)
+	} else {
+		_, err = client.Update(key, string(b), *ttl)
+	}
+	return err
+}
+
+// list prints the services at and below name.
+func list(client *etcd.Client, name string) error {
+	r, err := client.Get(keyPath(name), true, true)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOST\tPORT\tPRIORITY\tTTL")
+	var walk func(n *etcd.Node)
+	walk = func(n *etcd.Node) {
+		if n.Dir {
+			for _, n1 := range n.Nodes {
+				walk(n1)
+			}
+			return
+		}
+		var serv service
+		if err := json.Unmarshal([]byte(n.Value), &serv); err != nil {
+			fmt.Fprintf(w, "%s\t(bad value: %s)\t\t\t\n", keyName(n.Key), err)
+			return
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", keyName(n.Key), serv.Host, serv.Port, serv.Priority, n.TTL)
+	}
+	walk(r.Node)
+	return w.Flush()
+}
+
+// parseInterspersed parses the flags in args, which may come after the
+// positional arguments, and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var pos []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return pos
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
+
+// keyPath returns the etcd key for name, see Path in SkyDNS.
+func keyPath(name string) string {
+	switch {
+	case name == "":
+		name = *domain
+	case !strings.HasSuffix(name, "."):
+		name += "." + *domain
+	}
+	l := dns.SplitDomainName(strings.ToLower(name))
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
+	}
+	return path.Join(append([]string{"/skydns/"}, l...)...)
+}
+
+// keyName returns the domain name for the etcd key, see Domain in SkyDNS.
+func keyName(key string) string {
+	l := strings.Split(strings.TrimPrefix(key, "/skydns/"), "/")
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
+	}
+	return dns.Fqdn(strings.Join(l, "."))
+}
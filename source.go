@@ -0,0 +1,99 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The queries to the nameservers can be sent from the addresses in
+// ForwardSource and the ports in ForwardPorts, for multi-homed hosts where
+// the firewalls only let some source addresses through.
+
+// setForwardSource parses ForwardSource and ForwardPorts.
+func setForwardSource(config *Config) error {
+	config.sources = nil
+	for _, src := range config.ForwardSource {
+		if ip := net.ParseIP(src); ip != nil {
+			config.sources = append(config.sources, ip)
+			continue
+		}
+		ifi, err := net.InterfaceByName(src)
+		if err != nil {
+			return fmt.Errorf("bad forward_source %q: not an address or interface", src)
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return fmt.Errorf("bad forward_source %q: %s", src, err)
+		}
+		n := len(config.sources)
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && !ipn.IP.IsLinkLocalUnicast() {
+				config.sources = append(config.sources, ipn.IP)
+			}
+		}
+		if len(config.sources) == n {
+			return fmt.Errorf("bad forward_source %q: interface has no addresses", src)
+		}
+	}
+	config.srcPorts = [2]int{}
+	if config.ForwardPorts == "" {
+		return nil
+	}
+	lo, hi := config.ForwardPorts, config.ForwardPorts
+	if i := strings.Index(config.ForwardPorts, "-"); i > 0 {
+		lo, hi = config.ForwardPorts[:i], config.ForwardPorts[i+1:]
+	}
+	l, err1 := strconv.Atoi(lo)
+	h, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || l < 1024 || h > 65535 || l > h {
+		return fmt.Errorf("bad forward_ports %q: want a range like 40000-40999 within 1024-65535", config.ForwardPorts)
+	}
+	config.srcPorts = [2]int{l, h}
+	return nil
+}
+
+// forwardDialer returns the dialer for queries to nameserver, or nil when
+// neither the source address nor the port is configured. The source is the first
+// address in ForwardSource of the family of the nameserver, the port is picked
+// at random from ForwardPorts for every query.
+func (config *Config) forwardDialer(nameserver string, tcp bool) *net.Dialer {
+	if len(config.sources) == 0 && config.srcPorts[0] == 0 {
+		return nil
+	}
+	var ip net.IP
+	host, _, _ := net.SplitHostPort(strings.TrimPrefix(nameserver, "tls://"))
+	if ns := net.ParseIP(host); ns != nil {
+		for _, src := range config.sources {
+			if (src.To4() != nil) == (ns.To4() != nil) {
+				ip = src
+				break
+			}
+		}
+	}
+	port := 0
+	if config.srcPorts[0] != 0 {
+		port = config.srcPorts[0] + rand.Intn(config.srcPorts[1]-config.srcPorts[0]+1)
+	}
+	if tcp {
+		return &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip, Port: port}}
+	}
+	return &net.Dialer{LocalAddr: &net.UDPAddr{IP: ip, Port: port}}
+}
+
+// sourceClient returns c, or a copy of it that uses the dialer for nameserver.
+func (config *Config) sourceClient(c *dns.Client, nameserver string) *dns.Client {
+	d := config.forwardDialer(nameserver, c.Net == "tcp")
+	if d == nil {
+		return c
+	}
+	return &dns.Client{Net: c.Net, ReadTimeout: c.ReadTimeout, Dialer: d}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestForwardDialer(t *testing.T) {
+	config := &Config{ForwardSource: []string{"192.0.2.10", "2001:db8::10"}, ForwardPorts: "40000-40009"}
+	if err := setForwardSource(config); err != nil {
+		t.Fatal(err)
+	}
+	for ns, src := range map[string]string{"10.0.0.1:53": "192.0.2.10", "[2001:db8::1]:53": "2001:db8::10", "tls://10.0.0.1:853": "192.0.2.10"} {
+		a := config.forwardDialer(ns, false).LocalAddr.(*net.UDPAddr)
+		if a.IP.String() != src || a.Port < 40000 || a.Port > 40009 {
+			t.Errorf("%s: expected %s with a port in the range, got %s", ns, src, a)
+		}
+	}
+	for _, ports := range []string{"80-90", "40010-40000", "40000-x"} {
+		if err := setForwardSource(&Config{ForwardPorts: ports}); err == nil {
+			t.Errorf("%s: expected an error", ports)
+		}
+	}
+	if (&Config{}).forwardDialer("10.0.0.1:53", false) != nil {
+		t.Error("expected no dialer")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Serve-stale (RFC 8767): the positive answers of the nameservers are kept
+// for ServeStale after they expire. When forwarding fails, times out or gets a
+// SERVFAIL, the client gets the expired answer with the TTLs set to StaleTtl.
+
+const edeStaleAnswer = 3
+
+// newStaleCache returns the cache for the forwarded answers, or nil when ServeStale is not set.
+func newStaleCache(config *Config) *msgCache {
+	if config.ServeStale == 0 {
+		return nil
+	}
+	return newMsgCache(config.CacheSize, 0, 0, StatsStaleCacheMemory)
+}
+
+// stale returns a copy of the cached response for req, even when it has
+// expired, but not for longer than max. The TTLs in it are set to ttl.
+func (c *msgCache) stale(req *dns.Msg, max time.Duration, ttl uint32) *dns.Msg {
+	if c == nil {
+		return nil
+	}
+	c.RLock()
+	e, ok := c.m[msgKey(req, "")]
+	c.RUnlock()
+	if !ok || time.Now().After(e.expire.Add(max)) {
+		return nil
+	}
+	m := e.msg.Copy()
+	m.Id = req.Id
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range section {
+			if r.Header().Rrtype != dns.TypeOPT {
+				r.Header().Ttl = ttl
+			}
+		}
+	}
+	echoCase(m, req.Question[0].Name)
+	return m
+}
+
+// forwarded writes the reply r of a nameserver to req. A SERVFAIL is replaced
+// by a stale answer, when there is one, others are cached for serve-stale.
+func (s *server) forwarded(w dns.ResponseWriter, req, r *dns.Msg) {
+	if r.Rcode == dns.RcodeServerFailure && s.serveStale(w, req) {
+		putMsg(r)
+		return
+	}
+	if r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0 && !r.Truncated {
+		s.fcache.insert(req, "", r)
+	}
+	s.config.truncate(w, req, r)
+	w.WriteMsg(r)
+	putMsg(r)
+}
+
+// serveStale writes a stale answer to req and returns true, or returns false
+// when there is none.
+func (s *server) serveStale(w dns.ResponseWriter, req *dns.Msg) bool {
+	m := s.fcache.stale(req, s.config.ServeStale, s.config.StaleTtl)
+	if m == nil {
+		return false
+	}
+	StatsStaleCount.Inc(1)
+	extendedError(m, req, edeStaleAnswer, "")
+	s.config.truncate(w, req, m)
+	w.WriteMsg(m)
+	return true
+}
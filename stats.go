@@ -8,8 +8,9 @@ import (
 	"github.com/rcrowley/go-metrics"
 	"github.com/rcrowley/go-metrics/influxdb"
 	"github.com/rcrowley/go-metrics/stathat"
-	"net"
+	"log"
 	"os"
+	"time"
 )
 
 var (
@@ -19,9 +20,43 @@ var (
 	StatsDnssecCacheMiss metrics.Counter
 	StatsNameErrorCount  metrics.Counter
 	StatsNoDataCount     metrics.Counter
+	StatsRefusedCount    metrics.Counter
+	StatsACLDeniedCount  map[string]metrics.Counter
+	StatsQuotaCount      map[string]metrics.Counter
+	StatsBlockedCount    metrics.Counter
+	StatsCacheHit        metrics.Counter
+	StatsCacheMiss       metrics.Counter
+
+	StatsNegativeCacheHit     metrics.Counter
+	StatsNegativeCacheMiss    metrics.Counter
+	StatsPrefetchCount        metrics.Counter
+	StatsOverloadCount        metrics.Counter
+	StatsDns64Count           metrics.Counter
+	StatsTimeoutCount         metrics.Counter
+	StatsBreakerOpenCount     metrics.Counter
+	StatsStaleCount           metrics.Counter
+	StatsCacheEvictCount      metrics.Counter
+	StatsTruncatedCount       metrics.Counter
+	StatsSharedCount          metrics.Counter
+	StatsServfailCacheHit     metrics.Counter
+	StatsEtcdResyncCount      metrics.Counter
+	StatsExistenceFilterCount metrics.Counter
+
+	StatsCacheMemory      metrics.Gauge
+	StatsCacheMemoryLimit metrics.Gauge
+	StatsSigCacheMemory   metrics.Gauge
+	StatsMsgCacheMemory   metrics.Gauge
+	StatsStaleCacheMemory metrics.Gauge
+	StatsEtcdUp           metrics.Gauge
+
+	StatsDnstapDroppedCount metrics.Counter
+	StatsSyslogDroppedCount metrics.Counter
 
 	influxConfig   *influxdb.Config
 	graphiteServer = os.Getenv("GRAPHITE_SERVER")
+	statsdServer   = os.Getenv("STATSD_SERVER")
+	statsPrefix    = os.Getenv("STATS_PREFIX")
+	statsInterval  = os.Getenv("STATS_INTERVAL")
 	stathatUser    = os.Getenv("STATHAT_USER")
 	influxServer   = os.Getenv("INFLUX_SERVER")
 	influxDatabase = os.Getenv("INFLUX_DATABASE")
@@ -53,14 +88,119 @@ func init() {
 
 	StatsNoDataCount = metrics.NewCounter()
 	metrics.Register("skydns-nodata-responses", StatsNoDataCount)
+
+	StatsRefusedCount = metrics.NewCounter()
+	metrics.Register("skydns-refused-responses", StatsRefusedCount)
+
+	StatsBlockedCount = metrics.NewCounter()
+	metrics.Register("skydns-blocked-requests", StatsBlockedCount)
+
+	StatsCacheHit = metrics.NewCounter()
+	metrics.Register("skydns-cache-hit", StatsCacheHit)
+
+	StatsCacheMiss = metrics.NewCounter()
+	metrics.Register("skydns-cache-miss", StatsCacheMiss)
+
+	StatsNegativeCacheHit = metrics.NewCounter()
+	metrics.Register("skydns-negative-cache-hit", StatsNegativeCacheHit)
+
+	StatsNegativeCacheMiss = metrics.NewCounter()
+	metrics.Register("skydns-negative-cache-miss", StatsNegativeCacheMiss)
+
+	StatsPrefetchCount = metrics.NewCounter()
+	metrics.Register("skydns-cache-prefetch", StatsPrefetchCount)
+
+	StatsOverloadCount = metrics.NewCounter()
+	metrics.Register("skydns-overload-requests", StatsOverloadCount)
+	StatsDns64Count = metrics.NewCounter()
+	metrics.Register("skydns-dns64-synthesized", StatsDns64Count)
+
+	StatsTimeoutCount = metrics.NewCounter()
+	metrics.Register("skydns-timeout-responses", StatsTimeoutCount)
+
+	StatsBreakerOpenCount = metrics.NewCounter()
+	metrics.Register("skydns-etcd-breaker-opened", StatsBreakerOpenCount)
+
+	StatsStaleCount = metrics.NewCounter()
+	metrics.Register("skydns-etcd-stale-lookups", StatsStaleCount)
+
+	StatsCacheEvictCount = metrics.NewCounter()
+	metrics.Register("skydns-cache-evictions", StatsCacheEvictCount)
+
+	StatsTruncatedCount = metrics.NewCounter()
+	metrics.Register("skydns-truncated-responses", StatsTruncatedCount)
+
+	StatsSharedCount = metrics.NewCounter()
+	metrics.Register("skydns-shared-requests", StatsSharedCount)
+
+	StatsServfailCacheHit = metrics.NewCounter()
+	metrics.Register("skydns-servfail-cache-hit", StatsServfailCacheHit)
+
+	StatsEtcdResyncCount = metrics.NewCounter()
+	metrics.Register("skydns-etcd-watch-resyncs", StatsEtcdResyncCount)
+
+	StatsExistenceFilterCount = metrics.NewCounter()
+	metrics.Register("skydns-existence-filter-nxdomain", StatsExistenceFilterCount)
+
+	StatsCacheMemory = metrics.NewGauge()
+	metrics.Register("skydns-cache-memory-bytes", StatsCacheMemory)
+
+	StatsCacheMemoryLimit = metrics.NewGauge()
+	metrics.Register("skydns-cache-memory-limit-bytes", StatsCacheMemoryLimit)
+
+	StatsSigCacheMemory = metrics.NewGauge()
+	metrics.Register("skydns-signature-cache-bytes", StatsSigCacheMemory)
+
+	StatsMsgCacheMemory = metrics.NewGauge()
+	metrics.Register("skydns-response-cache-bytes", StatsMsgCacheMemory)
+
+	StatsStaleCacheMemory = metrics.NewGauge()
+	metrics.Register("skydns-stale-cache-bytes", StatsStaleCacheMemory)
+
+	StatsEtcdUp = metrics.NewGauge()
+	StatsEtcdUp.Update(1)
+	metrics.Register("skydns-etcd-up", StatsEtcdUp)
+
+	StatsDnstapDroppedCount = metrics.NewCounter()
+	metrics.Register("skydns-dnstap-dropped", StatsDnstapDroppedCount)
+
+	StatsSyslogDroppedCount = metrics.NewCounter()
+	metrics.Register("skydns-syslog-dropped", StatsSyslogDroppedCount)
+
+	StatsACLDeniedCount = make(map[string]metrics.Counter)
+	for _, op := range []string{ACLQuery, ACLTransfer, ACLUpdate, ACLRecursion, ACLDebug} {
+		StatsACLDeniedCount[op] = metrics.NewCounter()
+		metrics.Register("skydns-acl-denied-"+op, StatsACLDeniedCount[op])
+	}
+	StatsQuotaCount = make(map[string]metrics.Counter)
+	for _, kind := range []string{quotaClient, quotaNetwork, quotaName} {
+		StatsQuotaCount[kind] = metrics.NewCounter()
+		metrics.Register("skydns-quota-exceeded-"+kind, StatsQuotaCount[kind])
+	}
 }
 
 func statsCollect() {
-	if graphiteServer != "" {
-		addr, err := net.ResolveTCPAddr("tcp", graphiteServer)
+	prefix := "skydns"
+	if statsPrefix != "" {
+		prefix = statsPrefix
+	}
+	interval := 10 * time.Second
+	if statsInterval != "" {
+		d, err := time.ParseDuration(statsInterval)
 		if err != nil {
-			go metrics.Graphite(metrics.DefaultRegistry, 10e9, "skydns", addr)
+			log.Fatalf("bad STATS_INTERVAL: %s", err)
 		}
+		interval = d
+	}
+	var exporters []exporter
+	if graphiteServer != "" {
+		exporters = append(exporters, &graphiteExporter{addr: graphiteServer, prefix: prefix})
+	}
+	if statsdServer != "" {
+		exporters = append(exporters, newStatsdExporter(statsdServer, prefix))
+	}
+	if len(exporters) > 0 {
+		go runExporters(metrics.DefaultRegistry, interval, exporters...)
 	}
 	if stathatUser != "" {
 		go stathat.Stathat(metrics.DefaultRegistry, 10e9, stathatUser)
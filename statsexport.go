@@ -0,0 +1,107 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// exporter sends the counters to a metrics backend.
+type exporter interface {
+	// export sends the current values of the counters, keyed by their
+	// registered name, for instance skydns-requests.
+	export(counters map[string]int64, now time.Time) error
+}
+
+// runExporters exports the counters in r to the exporters every interval.
+func runExporters(r metrics.Registry, interval time.Duration, exporters ...exporter) {
+	for now := range time.Tick(interval) {
+		counters := make(map[string]int64)
+		r.Each(func(name string, i interface{}) {
+			if c, ok := i.(metrics.Counter); ok {
+				counters[name] = c.Count()
+			}
+		})
+		for _, e := range exporters {
+			if err := e.export(counters, now); err != nil {
+				log.Printf("failure to export metrics: %s", err)
+			}
+		}
+	}
+}
+
+// metricName returns the name for the counter with the registered name, i.e.
+// skydns-forward-requests becomes <prefix>.forward-requests.
+func metricName(prefix, name string) string {
+	return prefix + "." + strings.TrimPrefix(name, "skydns-")
+}
+
+// statsdExporter sends the increments since the last export to statsd, as counters.
+type statsdExporter struct {
+	addr   string
+	prefix string
+	last   map[string]int64
+}
+
+func newStatsdExporter(addr, prefix string) *statsdExporter {
+	return &statsdExporter{addr: addr, prefix: prefix, last: make(map[string]int64)}
+}
+
+func (e *statsdExporter) export(counters map[string]int64, now time.Time) error {
+	conn, err := net.Dial("udp", e.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	for name, v := range counters {
+		delta := v - e.last[name]
+		e.last[name] = v
+		if delta == 0 {
+			continue
+		}
+		line := fmt.Sprintf("%s:%d|c\n", metricName(e.prefix, name), delta)
+		// Keep the packets small enough to not get fragmented.
+		if buf.Len()+len(line) > 512 {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// graphiteExporter sends the counters to Graphite using the plaintext protocol.
+type graphiteExporter struct {
+	addr   string
+	prefix string
+}
+
+func (e *graphiteExporter) export(counters map[string]int64, now time.Time) error {
+	conn, err := net.DialTimeout("tcp", e.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	for name, v := range counters {
+		fmt.Fprintf(&buf, "%s.count %d %d\n", metricName(e.prefix, name), v, now.Unix())
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
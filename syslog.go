@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+// The query log can also go to syslog, as RFC 5424 messages of facility daemon
+// and severity info, over a unix socket, UDP or TCP (with the octet counting
+// framing of RFC 6587). Writing never blocks a query: while the syslog server
+// can't be reached, or doesn't keep up, messages are dropped and counted.
+
+const syslogPriority = 3*8 + 6 // daemon.info
+
+// openLog returns the writer for dest: standard output for "stdout", syslog
+// for "syslog" (the local one at /dev/log) or "syslog:unix:/path",
+// "syslog:udp:host:port" and "syslog:tcp:host:port", and otherwise the file
+// dest, which is appended to. Msgid is the MSGID of the syslog messages.
+func openLog(dest, msgid string, l *log.Logger) (io.Writer, error) {
+	switch {
+	case dest == "stdout":
+		return os.Stdout, nil
+	case dest == "syslog":
+		return newSyslogWriter("unixgram", "/dev/log", msgid, l), nil
+	case strings.HasPrefix(dest, "syslog:"):
+		d := strings.TrimPrefix(dest, "syslog:")
+		i := strings.Index(d, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("bad syslog destination: %q", dest)
+		}
+		network, addr := d[:i], d[i+1:]
+		switch network {
+		case "unix":
+			network = "unixgram"
+		case "udp", "tcp":
+		default:
+			return nil, fmt.Errorf("bad syslog destination: %q", dest)
+		}
+		return newSyslogWriter(network, addr, msgid, l), nil
+	}
+	return os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// syslogWriter sends every Write, a line, as a syslog message.
+type syslogWriter struct {
+	network  string
+	addr     string
+	header   string // the part after the timestamp: hostname, app name, procid and msgid
+	messages chan []byte
+	log      *log.Logger
+}
+
+func newSyslogWriter(network, addr, msgid string, l *log.Logger) *syslogWriter {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{
+		network:  network,
+		addr:     addr,
+		header:   " " + hostname + " skydns " + strconv.Itoa(os.Getpid()) + " " + msgid + " - ",
+		messages: make(chan []byte, 1000),
+		log:      l,
+	}
+	go w.run()
+	return w
+}
+
+// Write queues p, without the trailing newline, as one message.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	select {
+	case w.messages <- w.format(strings.TrimSuffix(string(p), "\n"), time.Now()):
+	default:
+		StatsSyslogDroppedCount.Inc(1)
+	}
+	return len(p), nil
+}
+
+// format returns the RFC 5424 message for msg, framed for TCP.
+func (w *syslogWriter) format(msg string, t time.Time) []byte {
+	m := "<" + strconv.Itoa(syslogPriority) + ">1 " + t.UTC().Format("2006-01-02T15:04:05.000000Z") + w.header + msg
+	if w.network == "tcp" {
+		m = strconv.Itoa(len(m)) + " " + m
+	}
+	return []byte(m)
+}
+
+// run connects to the syslog server and writes the messages, reconnecting on errors.
+func (w *syslogWriter) run() {
+	for {
+		conn, err := net.Dial(w.network, w.addr)
+		if err != nil {
+			w.log.Errorf("failure to connect to syslog: %s", err.Error())
+			w.discard(5 * time.Second)
+			continue
+		}
+		for m := range w.messages {
+			if _, err := conn.Write(m); err != nil {
+				w.log.Errorf("failure to write to syslog: %s", err.Error())
+				break
+			}
+		}
+		conn.Close()
+	}
+}
+
+// discard drops messages for duration d.
+func (w *syslogWriter) discard(d time.Duration) {
+	timeout := time.After(d)
+	for {
+		select {
+		case <-w.messages:
+			StatsSyslogDroppedCount.Inc(1)
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	w := &syslogWriter{network: "tcp", header: " host skydns 42 query - "}
+	ts := time.Date(2015, 3, 1, 12, 0, 0, 5000, time.UTC)
+	want := "<30>1 2015-03-01T12:00:00.000005Z host skydns 42 query - {}"
+	if m := string(w.format("{}", ts)); m != "59 "+want {
+		t.Errorf("format over tcp = %q, want %q", m, "59 "+want)
+	}
+	w.network = "udp"
+	if m := string(w.format("{}", ts)); m != want {
+		t.Errorf("format over udp = %q, want %q", m, want)
+	}
+}
+
+func TestOpenLog(t *testing.T) {
+	for _, dest := range []string{"syslog:", "syslog:tls:host:514", "syslog:udp"} {
+		if _, err := openLog(dest, "query", nil); err == nil {
+			t.Errorf("openLog(%q): expected an error", dest)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+)
+
+// Template synthesizes the answer from the question name itself, for names
+// like 10-0-0-1.ip.skydns.local. that have no record in etcd.
+type Template struct {
+	// Regular expression the (lower case) question name must match, its named
+	// groups can be used in Answer.
+	Name string `json:"name"`
+	// The query type answered, i.e. "A". Other types get a NODATA reply.
+	Type string `json:"type"`
+	// A text/template of the answer in presentation format. In it .Name is the
+	// question name and .Group holds the named groups. The function ip turns a
+	// name with dashes, like 10-0-0-1 or 2001-db8--1, into an address.
+	Answer string `json:"answer"`
+
+	re    *regexp.Regexp
+	qtype uint16
+	tmpl  *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"ip": func(s string) string {
+		if ip := strings.Replace(s, "-", ".", -1); net.ParseIP(ip).To4() != nil {
+			return ip
+		}
+		return strings.Replace(s, "-", ":", -1)
+	},
+}
+
+// podTemplates returns the templates for the Kubernetes pod names in domain:
+// 10-0-0-1.<namespace>.pod.<domain> has the address 10.0.0.1. As with the
+// "pods insecure" mode of kube-dns any address is answered.
+func podTemplates(domain string) []*Template {
+	suffix := `\.[^.]+\.pod\.` + regexp.QuoteMeta(dns.Fqdn(strings.ToLower(domain))) + "$"
+	return []*Template{
+		{Name: `^(?P<ip>\d+-\d+-\d+-\d+)` + suffix, Type: "A", Answer: "{{.Name}} 30 IN A {{ip .Group.ip}}"},
+		{Name: `^(?P<ip>[0-9a-f-]+)` + suffix, Type: "AAAA", Answer: "{{.Name}} 30 IN AAAA {{ip .Group.ip}}"},
+	}
+}
+
+// setTemplates checks and compiles the templates in config.
+func setTemplates(config *Config) (err error) {
+	if config.PodNames {
+		config.Templates = append(podTemplates(config.Domain), config.Templates...)
+	}
+	for _, t := range config.Templates {
+		if t.re, err = regexp.Compile(t.Name); err != nil {
+			return fmt.Errorf("bad template name %q: %s", t.Name, err)
+		}
+		var ok bool
+		if t.qtype, ok = dns.StringToType[strings.ToUpper(t.Type)]; !ok {
+			return fmt.Errorf("bad template type %q", t.Type)
+		}
+		if t.tmpl, err = template.New(t.Name).Funcs(templateFuncs).Parse(t.Answer); err != nil {
+			return fmt.Errorf("bad template answer %q: %s", t.Answer, err)
+		}
+	}
+	return nil
+}
+
+// template returns the first template that matches name, or nil.
+func (config *Config) template(name string) *Template {
+	for _, t := range config.Templates {
+		if t.re.MatchString(name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// templateAnswer returns the answer of the first template that matches the
+// name in q and true, or false when none does or its answer is invalid. The
+// answer is empty when the template has another type.
+func (s *server) templateAnswer(q dns.Question) ([]dns.RR, bool) {
+	t := s.config.template(strings.ToLower(q.Name))
+	if t == nil {
+		return nil, false
+	}
+	rr, err := t.answer(q)
+	if err != nil {
+		s.config.log.Debugf("template %s: %s", t.Name, err.Error())
+		return nil, false
+	}
+	if rr == nil {
+		return nil, true
+	}
+	return []dns.RR{rr}, true
+}
+
+// answer returns the answer of t to q, nil when q has another type, or an
+// error when the answer doesn't parse (i.e. 999-0-0-1 for an A record).
+func (t *Template) answer(q dns.Question) (dns.RR, error) {
+	if q.Qtype != t.qtype {
+		return nil, nil
+	}
+	name := strings.ToLower(q.Name)
+	data := struct {
+		Name  string
+		Group map[string]string
+	}{q.Name, make(map[string]string)}
+	match := t.re.FindStringSubmatch(name)
+	for i, g := range t.re.SubexpNames() {
+		if g != "" && i < len(match) {
+			data.Group[g] = match[i]
+		}
+	}
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	rr, err := dns.NewRR(b.String())
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil || rr.Header().Rrtype != t.qtype {
+		return nil, fmt.Errorf("template for %s gives no %s record: %q", t.Name, t.Type, b.String())
+	}
+	return rr, nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTemplate(t *testing.T) {
+	config := &Config{Templates: []*Template{
+		{
+			Name:   `^(?P<ip>[0-9a-f-]+)\.ip\.skydns\.test\.$`,
+			Type:   "A",
+			Answer: "{{.Name}} 60 IN A {{ip .Group.ip}}",
+		},
+		{
+			Name:   `^(?P<d>\d+)\.(?P<c>\d+)\.(?P<b>\d+)\.(?P<a>\d+)\.in-addr\.arpa\.$`,
+			Type:   "PTR",
+			Answer: "{{.Name}} 60 IN PTR {{.Group.a}}-{{.Group.b}}-{{.Group.c}}-{{.Group.d}}.ip.skydns.test.",
+		},
+	}}
+	if err := setTemplates(config); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		want  string // empty for no answer
+		err   bool
+	}{
+		{"10-0-0-1.ip.skydns.test.", dns.TypeA, "10-0-0-1.ip.skydns.test.\t60\tIN\tA\t10.0.0.1", false},
+		{"10-0-0-1.ip.skydns.test.", dns.TypeMX, "", false},
+		{"999-0-0-1.ip.skydns.test.", dns.TypeA, "", true},
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, "1.0.0.10.in-addr.arpa.\t60\tIN\tPTR\t10-0-0-1.ip.skydns.test.", false},
+	} {
+		tmpl := config.template(tc.name)
+		if tmpl == nil {
+			t.Fatalf("%s: no template", tc.name)
+		}
+		rr, err := tmpl.answer(dns.Question{Name: tc.name, Qtype: tc.qtype, Qclass: dns.ClassINET})
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		got := ""
+		if rr != nil {
+			got = rr.String()
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+	if config.template("www.skydns.test.") != nil {
+		t.Error("expected no template for www.skydns.test.")
+	}
+}
+
+func TestPodTemplates(t *testing.T) {
+	config := &Config{Domain: "cluster.local", PodNames: true}
+	if err := setTemplates(config); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"10-0-0-1.default.pod.cluster.local.":    "10.0.0.1",
+		"2001-db8--1.default.pod.cluster.local.": "2001:db8::1",
+	} {
+		tmpl := config.template(name)
+		if tmpl == nil {
+			t.Fatalf("%s: no template", name)
+		}
+		rr, err := tmpl.answer(dns.Question{Name: name, Qtype: tmpl.qtype, Qclass: dns.ClassINET})
+		if err != nil || rr == nil {
+			t.Fatalf("%s: no answer: %v", name, err)
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.A.String() != want {
+				t.Errorf("%s: expected %s, got %s", name, want, rr.A)
+			}
+		case *dns.AAAA:
+			if rr.AAAA.String() != want {
+				t.Errorf("%s: expected %s, got %s", name, want, rr.AAAA)
+			}
+		}
+	}
+}
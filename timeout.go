@@ -0,0 +1,125 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// Every query gets a context with a deadline of QueryTimeout, which is passed
+// to the etcd lookups, the forwarding and the signing. When the deadline passes
+// the client gets a SERVFAIL with an Extended DNS Error (RFC 8914). The go-etcd
+// client can't be cancelled, so a lookup that is still running is left to
+// finish in the background and its result is dropped.
+
+const (
+	edns0EDE = 15 // the EDNS0 option code of Extended DNS Errors
+	edeOther = 0
+)
+
+// queryContext returns the context for a query, with a deadline when QueryTimeout is set.
+func (config *Config) queryContext() (context.Context, context.CancelFunc) {
+	if config.QueryTimeout == 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), config.QueryTimeout)
+}
+
+// get is s.client.Get, but it gives up when ctx is done. While the breaker is
+// open the response comes from its snapshot.
+func (s *server) get(ctx context.Context, key string, sort, recursive bool) (*etcd.Response, error) {
+	k := snapshotKey{key, sort, recursive}
+	if s.breaker.isOpen() {
+		return s.breaker.stale(k)
+	}
+	r, err := s.getContext(ctx, key, sort, recursive)
+	if ctx.Err() == nil {
+		s.etcdResult(err)
+	}
+	s.breaker.record(k, r, err)
+	if etcdFailure(err) && s.breaker.isOpen() {
+		return s.breaker.stale(k)
+	}
+	return r, err
+}
+
+func (s *server) getContext(ctx context.Context, key string, sort, recursive bool) (*etcd.Response, error) {
+	if ctx.Done() == nil {
+		return s.sharedGet(key, sort, recursive)
+	}
+	type result struct {
+		r   *etcd.Response
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		r, err := s.sharedGet(key, sort, recursive)
+		c <- result{r, err}
+	}()
+	select {
+	case res := <-c:
+		return res.r, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sharedGet is s.client.Get, done once for the identical requests that come in
+// while it is going on. The response is shared, so it must not be changed.
+func (s *server) sharedGet(key string, sort, recursive bool) (*etcd.Response, error) {
+	k := fmt.Sprintf("%s/%t/%t", key, sort, recursive)
+	v, err, _ := s.lookups.Do(k, func() (interface{}, error) {
+		return s.client.Get(key, sort, recursive)
+	})
+	r, _ := v.(*etcd.Response)
+	return r, err
+}
+
+// timeout returns d, or the time left until the deadline of ctx when that is less.
+func timeout(ctx context.Context, d time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return d
+	}
+	left := time.Until(deadline)
+	if left < time.Millisecond {
+		// Zero would mean the default timeout of the client.
+		left = time.Millisecond
+	}
+	if left < d {
+		return left
+	}
+	return d
+}
+
+// timedOut writes a SERVFAIL reply to req, for a query that ran past its deadline.
+func timedOut(w dns.ResponseWriter, req *dns.Msg) {
+	StatsTimeoutCount.Inc(1)
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	m.RecursionAvailable = true
+	extendedError(m, req, edeOther, "query timed out")
+	w.WriteMsg(m)
+}
+
+// extendedError adds an Extended DNS Error with code and text to m, the reply
+// to req, when req has EDNS0.
+func extendedError(m, req *dns.Msg, code uint16, text string) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+	o := m.IsEdns0()
+	if o == nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		o = m.IsEdns0()
+	}
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: edns0EDE, Data: append([]byte{byte(code >> 8), byte(code)}, text...)})
+}
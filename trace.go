@@ -0,0 +1,236 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+// Tracing of the query path. Spans are exported in batches to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding.
+
+// Span kinds as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type tracer struct {
+	endpoint string
+	sample   float64
+	spans    chan *span
+	resource []otlpAttr
+	log      *log.Logger
+}
+
+type span struct {
+	t        *tracer
+	traceID  []byte
+	spanID   []byte
+	parentID []byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []otlpAttr
+	err      bool
+}
+
+// newTracer returns a tracer that exports to endpoint, i.e. http://localhost:4318/v1/traces.
+// Sample is the fraction of the queries that are traced.
+func newTracer(endpoint string, sample float64, l *log.Logger) *tracer {
+	hostname, _ := os.Hostname()
+	return &tracer{
+		endpoint: endpoint,
+		sample:   sample,
+		spans:    make(chan *span, 1000),
+		resource: []otlpAttr{stringAttr("service.name", "skydns"), stringAttr("host.name", hostname)},
+		log:      l,
+	}
+}
+
+// start starts a new span. When parent is nil a new trace is started, subject
+// to sampling. Start and all methods on span are safe to call on nil values.
+func (t *tracer) start(name string, kind int, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+	sp := &span{t: t, name: name, kind: kind, start: time.Now(), spanID: randomID(8)}
+	if parent == nil {
+		if t.sample < 1 && rand.Float64() >= t.sample {
+			return nil
+		}
+		sp.traceID = randomID(16)
+		return sp
+	}
+	sp.traceID = parent.traceID
+	sp.parentID = parent.spanID
+	return sp
+}
+
+// child starts a span below sp, it returns nil when sp is nil.
+func (sp *span) child(name string, kind int) *span {
+	if sp == nil {
+		return nil
+	}
+	return sp.t.start(name, kind, sp)
+}
+
+func (sp *span) attr(key, value string) {
+	if sp != nil {
+		sp.attrs = append(sp.attrs, stringAttr(key, value))
+	}
+}
+
+// fail marks the span as failed.
+func (sp *span) fail(err error) {
+	if sp != nil && err != nil {
+		sp.err = true
+		sp.attr("error.message", err.Error())
+	}
+}
+
+// finish ends the span and queues it for export. The span is dropped when the queue is full.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case sp.t.spans <- sp:
+	default:
+	}
+}
+
+// run exports the spans in batches, every 5 seconds or when 256 spans are queued.
+func (t *tracer) run() {
+	batch := make([]*span, 0, 256)
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			t.log.Errorf("failure to export spans: %s", err.Error())
+		}
+		batch = batch[:0]
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: t.resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "skydns"}}},
+	}}}
+	ss := &req.ResourceSpans[0].ScopeSpans[0]
+	for _, sp := range spans {
+		o := otlpSpan{
+			TraceID:      hex.EncodeToString(sp.traceID),
+			SpanID:       hex.EncodeToString(sp.spanID),
+			ParentSpanID: hex.EncodeToString(sp.parentID),
+			Name:         sp.name,
+			Kind:         sp.kind,
+			Start:        strconv.FormatInt(sp.start.UnixNano(), 10),
+			End:          strconv.FormatInt(sp.end.UnixNano(), 10),
+			Attributes:   sp.attrs,
+		}
+		if sp.err {
+			o.Status.Code = 2 // STATUS_CODE_ERROR
+		}
+		ss.Spans = append(ss.Spans, o)
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func randomID(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rand.Intn(256))
+	}
+	return b
+}
+
+// The OTLP/JSON messages, only the fields we use.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func stringAttr(key, value string) otlpAttr {
+	a := otlpAttr{Key: key}
+	a.Value.StringValue = value
+	return a
+}
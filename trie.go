@@ -0,0 +1,123 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// The breaker's snapshot of the etcd responses is kept in a trie of the
+// elements of the etcd paths, which are the labels of the names in reverse:
+// /skydns/local/skydns/east/web is local -> skydns -> east -> web. A key that
+// wasn't looked up itself is still answered from the nearest key above it
+// that was looked up recursively, the longest suffix of the name: its
+// response holds the subtree of the key, or shows the key doesn't exist. So
+// wildcards, whose "*" keys are found through the listing of their parent,
+// keep working too.
+
+// lookupOpts are the options of an etcd lookup besides the key.
+type lookupOpts struct {
+	sort, recursive bool
+}
+
+// recordTrie is a node in the trie, for one element of the etcd path.
+type recordTrie struct {
+	children map[string]*recordTrie
+	entries  map[lookupOpts]snapshotEntry
+}
+
+func newRecordTrie() *recordTrie {
+	return &recordTrie{children: make(map[string]*recordTrie)}
+}
+
+// pathElements returns the elements of the etcd path key.
+func pathElements(key string) []string {
+	return strings.FieldsFunc(key, func(r rune) bool { return r == '/' })
+}
+
+// insert stores e as the response to the lookup k.
+func (t *recordTrie) insert(k snapshotKey, e snapshotEntry) {
+	n := t
+	for _, el := range pathElements(k.key) {
+		c, ok := n.children[el]
+		if !ok {
+			c = newRecordTrie()
+			n.children[el] = c
+		}
+		n = c
+	}
+	if n.entries == nil {
+		n.entries = make(map[lookupOpts]snapshotEntry)
+	}
+	n.entries[lookupOpts{k.sort, k.recursive}] = e
+}
+
+// remove removes the response to the lookup k, if it is stored.
+func (t *recordTrie) remove(k snapshotKey) {
+	n := t
+	for _, el := range pathElements(k.key) {
+		if n = n.children[el]; n == nil {
+			return
+		}
+	}
+	delete(n.entries, lookupOpts{k.sort, k.recursive})
+}
+
+// lookup returns the response to the lookup k: the one stored for k, or one
+// made from the recursive response of the nearest key above k.
+func (t *recordTrie) lookup(k snapshotKey) (snapshotEntry, bool) {
+	els := pathElements(k.key)
+	// The trie nodes along the path, as far as they go.
+	trail := []*recordTrie{t}
+	for _, el := range els {
+		c, ok := trail[len(trail)-1].children[el]
+		if !ok {
+			break
+		}
+		trail = append(trail, c)
+	}
+	if len(trail) == len(els)+1 {
+		if e, ok := trail[len(els)].entries[lookupOpts{k.sort, k.recursive}]; ok {
+			return e, true
+		}
+	}
+	for i := len(trail) - 1; i >= 0; i-- {
+		for opts, e := range trail[i].entries {
+			if !opts.recursive {
+				continue
+			}
+			return subtree(e, k.key), true
+		}
+	}
+	return snapshotEntry{}, false
+}
+
+// subtree returns the response for key, which is at or below the key of the
+// recursive response e. When key isn't in e it doesn't exist.
+func subtree(e snapshotEntry, key string) snapshotEntry {
+	if e.err != nil {
+		// The key above doesn't exist, so neither does key.
+		return e
+	}
+	n := e.r.Node
+	for n != nil && n.Key != key {
+		var next *etcd.Node
+		for _, c := range n.Nodes {
+			if c.Key == key || strings.HasPrefix(key, c.Key+"/") {
+				next = c
+				break
+			}
+		}
+		n = next
+	}
+	if n == nil {
+		return snapshotEntry{err: &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key, Index: e.r.EtcdIndex}}
+	}
+	r := *e.r
+	r.Node = n
+	return snapshotEntry{r: &r}
+}
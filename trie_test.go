@@ -0,0 +1,46 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestRecordTrie(t *testing.T) {
+	tr := newRecordTrie()
+	web := &etcd.Node{Key: "/skydns/local/skydns/web", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/web/1", Value: `{"host":"10.0.0.1"}`},
+		{Key: "/skydns/local/skydns/web/*", Value: `{"host":"10.0.0.2"}`},
+	}}
+	tr.insert(snapshotKey{key: "/skydns/local/skydns", recursive: true}, snapshotEntry{r: &etcd.Response{Node: &etcd.Node{
+		Key: "/skydns/local/skydns", Dir: true, Nodes: etcd.Nodes{web}}}})
+	db := &etcd.Node{Key: "/skydns/local/skydns/db", Value: `{"host":"10.0.1.1"}`}
+	tr.insert(snapshotKey{key: "/skydns/local/skydns/db"}, snapshotEntry{r: &etcd.Response{Node: db}})
+
+	// Stored itself.
+	if e, ok := tr.lookup(snapshotKey{key: "/skydns/local/skydns/db"}); !ok || e.r.Node != db {
+		t.Error("expected the stored response for db")
+	}
+	// From the subtree of the recursive lookup above it.
+	if e, ok := tr.lookup(snapshotKey{key: "/skydns/local/skydns/web/1"}); !ok || e.err != nil || e.r.Node.Key != "/skydns/local/skydns/web/1" {
+		t.Error("expected web/1 from the lookup of the domain")
+	}
+	if e, ok := tr.lookup(snapshotKey{key: "/skydns/local/skydns/web", recursive: true}); !ok || e.r.Node != web {
+		t.Error("expected web from the lookup of the domain")
+	}
+	if e, ok := tr.lookup(snapshotKey{key: "/skydns/local/skydns/web/*"}); !ok || e.err != nil {
+		t.Error("expected the wildcard from the lookup of the domain")
+	}
+	// Missing from the subtree, so it doesn't exist.
+	if e, ok := tr.lookup(snapshotKey{key: "/skydns/local/skydns/web/2"}); !ok || !notFound(e.err) {
+		t.Errorf("expected key not found for web/2, got %v", e.err)
+	}
+	// Nothing recursive above it.
+	if _, ok := tr.lookup(snapshotKey{key: "/skydns/test/skydns/web"}); ok {
+		t.Error("expected no response outside the snapshot")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// replySize returns the largest reply we send to the client of w: over UDP the
+// EDNS0 size of req (512 without EDNS0), at most EdnsUdpSize and MaxUdpSize.
+func (config *Config) replySize(w dns.ResponseWriter, req *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+		if config.EdnsUdpSize > 0 && size > int(config.EdnsUdpSize) {
+			size = int(config.EdnsUdpSize)
+		}
+	}
+	if config.MaxUdpSize > 0 && size > int(config.MaxUdpSize) {
+		size = int(config.MaxUdpSize)
+	}
+	return size
+}
+
+// fits returns true when m can be sent to the client of w without truncation.
+func (config *Config) fits(w dns.ResponseWriter, req, m *dns.Msg) bool {
+	return m.Len() <= config.replySize(w, req)
+}
+
+// truncate makes m, the reply to req, fit for the client of w. With the
+// "drop_additional" TruncatePolicy the additional section goes first, as it is
+// optional. When m still doesn't fit, or with the "tc" policy, the records are
+// removed and the TC bit is set, so the client retries over TCP.
+func (config *Config) truncate(w dns.ResponseWriter, req, m *dns.Msg) {
+	if config.fits(w, req, m) {
+		return
+	}
+	opt := m.IsEdns0()
+	if config.TruncatePolicy != "tc" {
+		m.Extra = nil
+		if opt != nil {
+			m.Extra = []dns.RR{opt}
+		}
+		if config.fits(w, req, m) {
+			return
+		}
+	}
+	StatsTruncatedCount.Inc(1)
+	m.Answer, m.Ns, m.Extra = nil, nil, nil
+	if opt != nil {
+		m.Extra = []dns.RR{opt}
+	}
+	m.Truncated = true
+}
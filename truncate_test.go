@@ -0,0 +1,49 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncate(t *testing.T) {
+	w := &prefetchWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53}}
+	req := new(dns.Msg)
+	req.SetQuestion("www.skydns.test.", dns.TypeSRV)
+	reply := func(answers, extra int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		for i := 0; i < answers; i++ {
+			target := strconv.Itoa(i) + ".www.skydns.test."
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: "www.skydns.test.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60}, Target: target})
+			if i < extra {
+				m.Extra = append(m.Extra, new(Service).NewA(target, 60, net.ParseIP("10.0.0.1").To4()))
+			}
+		}
+		return m
+	}
+	config := &Config{EdnsUdpSize: 4096}
+
+	m := reply(6, 6)
+	config.truncate(w, req, m)
+	if m.Truncated || len(m.Answer) != 6 || len(m.Extra) != 0 {
+		t.Errorf("expected 6 answers without additional section, got %d and %d", len(m.Answer), len(m.Extra))
+	}
+	m = reply(40, 0)
+	config.truncate(w, req, m)
+	if !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("expected an empty truncated reply, got %d answers", len(m.Answer))
+	}
+	config.TruncatePolicy = "tc"
+	m = reply(6, 6)
+	config.truncate(w, req, m)
+	if !m.Truncated {
+		t.Error("expected a truncated reply with the tc policy")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// View is a split-horizon view: clients from Networks see the records in
+// /skydns-<Name> before the ones in /skydns. So a name can have an internal
+// address in a view and an external one for everybody else.
+type View struct {
+	Name     string   `json:"name"`
+	Networks []string `json:"networks"`
+	// Match the address in the EDNS0 client subnet option, when the query has one,
+	// instead of the address of the client.
+	Ecs bool `json:"ecs,omitempty"`
+
+	nets []*net.IPNet
+}
+
+// setViews checks and parses the views in config.
+func setViews(config *Config) (err error) {
+	seen := make(map[string]bool)
+	for _, v := range config.Views {
+		if v.Name == "" || strings.Contains(v.Name, "/") || seen[v.Name] {
+			return fmt.Errorf("bad or duplicate view name: %q", v.Name)
+		}
+		seen[v.Name] = true
+		if v.nets, err = parseCIDRs(v.Networks); err != nil {
+			return fmt.Errorf("view %s: %s", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// view returns the etcd root of the first view that matches the client of req,
+// or "" when none does.
+func (s *server) view(remote net.Addr, req *dns.Msg) string {
+	if len(s.config.Views) == 0 {
+		return ""
+	}
+	ip, _ := splitAddr(remote)
+	var ecs net.IP
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				ecs = e.Address
+			}
+		}
+	}
+	for _, v := range s.config.Views {
+		ip := ip
+		if v.Ecs && ecs != nil {
+			ip = ecs
+		}
+		if ip == nil {
+			continue
+		}
+		for _, n := range v.nets {
+			if n.Contains(ip) {
+				return "/skydns-" + v.Name
+			}
+		}
+	}
+	return ""
+}
+
+// inRoot returns path, which starts with /skydns, with root instead.
+func inRoot(path, root string) string {
+	if root == "" {
+		return path
+	}
+	return root + strings.TrimPrefix(path, "/skydns")
+}
+
+// lookup gets name from etcd, first from the tree of the view root, when set,
+// then from /skydns. Wildcard records are used when name does not exist in a
+// tree. Parts are the parts of the etcd path of name in the tree that answered,
+// for loopNodes.
+func (s *server) lookup(ctx context.Context, name, root string) (r *etcd.Response, parts []string, star, wildcard bool, err error) {
+	path, star := Path(name)
+	roots := []string{""}
+	if root != "" {
+		roots = []string{root, ""}
+	}
+	for _, rt := range roots {
+		r, err = s.get(ctx, inRoot(path, rt), false, true)
+		if err != nil && !star {
+			r, err = s.wildcard(ctx, name, rt, err)
+			wildcard = err == nil
+		}
+		if !notFound(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, star, false, err
+	}
+	root = strings.SplitN(r.Node.Key, "/", 3)[1]
+	return r, strings.Split(inRoot(PathNoWildcard(name), "/"+root), "/"), star, wildcard, nil
+}
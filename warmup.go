@@ -0,0 +1,107 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// With DNSSEC and DnssecWarmup the signatures for our names are made at startup
+// and put in the signature cache, so the first queries don't have to wait for
+// them. Every name with a service, and the names above it in the domain, is
+// queried for A, AAAA and SRV with the DO bit set, the apex for SOA, NS and
+// DNSKEY too, by DnssecWarmup queries at the same time. Until that is done we
+// are not ready, see readyz. The answers for a view and the denials of names
+// that don't exist are still signed on the first query.
+
+// warmupAddr is the client address of the warmup queries.
+var warmupAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// warmupQuestions returns the questions to ask for the names in the tree at n.
+func (config *Config) warmupQuestions(n *etcd.Node) []dns.Question {
+	seen := make(map[string]bool)
+	var qs []dns.Question
+	var walk func(n *etcd.Node)
+	walk = func(n *etcd.Node) {
+		if name := Domain(n.Key); !seen[name] {
+			seen[name] = true
+			for _, t := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV} {
+				qs = append(qs, dns.Question{Name: name, Qtype: t, Qclass: dns.ClassINET})
+			}
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	for _, t := range []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY} {
+		qs = append(qs, dns.Question{Name: config.Domain, Qtype: t, Qclass: dns.ClassINET})
+	}
+	if n != nil {
+		walk(n)
+	}
+	return qs
+}
+
+// warmup signs the answers for our names, see above. We are ready when it
+// returns.
+func (s *server) warmup(config *Config) {
+	defer atomic.StoreInt32(&s.warming, 0)
+	start := time.Now()
+	p, _ := Path(config.Domain)
+	r, err := s.client.Get(p, true, true)
+	if err != nil && !notFound(err) {
+		config.log.Errorf("failure to warm up the signatures: %s", err.Error())
+		return
+	}
+	var root *etcd.Node
+	if err == nil && r != nil {
+		root = r.Node
+	}
+	qs := config.warmupQuestions(root)
+
+	work := make(chan dns.Question)
+	var wg sync.WaitGroup
+	for i := 0; i < config.DnssecWarmup; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &prefetchWriter{local: warmupAddr, remote: warmupAddr}
+			for q := range work {
+				req := new(dns.Msg)
+				req.SetQuestion(q.Name, q.Qtype)
+				req.SetEdns0(4096, true)
+				s.warmQuery(w, req)
+			}
+		}()
+	}
+	misses := StatsDnssecCacheMiss.Count()
+Send:
+	for _, q := range qs {
+		select {
+		case work <- q:
+		case <-s.done:
+			break Send
+		}
+	}
+	close(work)
+	wg.Wait()
+	config.log.Infof("made %d signatures for %d queries in %s", StatsDnssecCacheMiss.Count()-misses, len(qs), time.Since(start))
+}
+
+// warmQuery answers req from etcd, skipping the other stages.
+func (s *server) warmQuery(w dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddInt32(&s.queries, 1)
+	defer atomic.AddInt32(&s.queries, -1)
+	s = s.current()
+	ctx, cancel := s.config.queryContext()
+	defer cancel()
+	s.serveBackend(w, req, &query{ctx: ctx, start: time.Now(), source: "warmup", prefetch: true})
+}
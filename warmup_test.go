@@ -0,0 +1,36 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+func TestWarmupQuestions(t *testing.T) {
+	config := &Config{Domain: "skydns.local."}
+	root := &etcd.Node{Key: "/skydns/local/skydns", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/web", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/skydns/web/1", Value: `{"host":"10.0.0.1"}`},
+			{Key: "/skydns/local/skydns/web/2", Value: `{"host":"10.0.0.2"}`},
+		}},
+	}}
+	qs := config.warmupQuestions(root)
+	// The apex for SOA, NS and DNSKEY, and four names for A, AAAA and SRV.
+	if len(qs) != 3+4*3 {
+		t.Fatalf("warmupQuestions = %d questions, want %d", len(qs), 3+4*3)
+	}
+	want := map[string]bool{"skydns.local.": true, "web.skydns.local.": true, "1.web.skydns.local.": true, "2.web.skydns.local.": true}
+	for _, q := range qs {
+		if !want[q.Name] {
+			t.Errorf("unexpected question for %s", q.Name)
+		}
+		if q.Qtype == dns.TypeDNSKEY && q.Name != "skydns.local." {
+			t.Errorf("DNSKEY question for %s", q.Name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// Wildcard records are stored under a "*" key, i.e. /skydns/local/skydns/preview/*
+// answers for any name below preview.skydns.local that does not exist itself.
+// As in RFC 4592 the wildcard is only used when it sits at the closest encloser:
+// the nearest ancestor of the name that does exist.
+
+// closestEncloser returns the closest encloser of name in the tree of root and
+// its etcd node, listing its children. The node is nil when no ancestor below
+// the domain exists, the domain itself is returned in that case.
+func (s *server) closestEncloser(ctx context.Context, name, root string) (string, *etcd.Node, error) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; len(labels)-i > s.config.DomainLabels; i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		r, err := s.get(ctx, inRoot(PathNoWildcard(ce), root), false, false)
+		if err != nil {
+			if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+				continue
+			}
+			return "", nil, err
+		}
+		return ce, r.Node, nil
+	}
+	return s.config.Domain, nil, nil
+}
+
+// wildcard returns the wildcard record that answers for name, which does not
+// exist in the tree of root. When there is none, err (the original "key not
+// found") is returned.
+func (s *server) wildcard(ctx context.Context, name, root string, err error) (*etcd.Response, error) {
+	if e, ok := err.(*etcd.EtcdError); !ok || e.ErrorCode != 100 {
+		return nil, err
+	}
+	ce, n, err1 := s.closestEncloser(ctx, name, root)
+	if err1 != nil {
+		return nil, err1
+	}
+	key := inRoot(PathNoWildcard(ce), root) + "/*"
+	if n == nil {
+		// Nothing below the domain exists, a wildcard may still sit at the apex.
+		return s.get(ctx, key, false, true)
+	}
+	if !n.Dir {
+		return nil, err
+	}
+	for _, c := range n.Nodes {
+		if c.Key == key {
+			return s.get(ctx, key, false, true)
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// exportZone writes the services under the domain as a zone master file to
+// w, together with the SOA and NS records SkyDNS synthesizes. Only the records
+// for the names of the services themselves are written, not the ones SkyDNS
+// returns for names higher up in the tree or for wildcards.
+func (s *server) exportZone(w io.Writer) error {
+	path, _ := Path(s.config.Domain)
+	// The serial of the SOA record, see serial.go.
+	if _, err := s.loadSerial(path); err != nil {
+		return err
+	}
+	ns, glue := s.nsRecords()
+	rrs := append([]dns.RR{s.NewSOA()}, ns...)
+	rrs = append(rrs, glue...)
+
+	r, err := s.client.Get(path, true, true)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); !ok || e.ErrorCode != 100 {
+			return err
+		}
+	}
+	if r != nil {
+		services, err := s.zoneRecords(r.Node.Nodes)
+		if err != nil {
+			return err
+		}
+		sort.Sort(byName(services))
+		rrs = append(rrs, services...)
+	}
+
+	fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", s.config.Domain, s.config.Ttl)
+	for _, rr := range rrs {
+		fmt.Fprintln(w, rr.String())
+	}
+	return nil
+}
+
+// zoneRecords returns the records for the services in nodes: the address and
+// SRV records, the latter only for services with a host, and the other records
+// they publish. The TTL is that of the etcd key or the default TTL and the
+// weight of the SRV records is 100.
+func (s *server) zoneRecords(nodes etcd.Nodes) (rrs []dns.RR, err error) {
+	for _, n := range nodes {
+		if n.Dir {
+			rrs1, err := s.zoneRecords(n.Nodes)
+			if err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, rrs1...)
+			continue
+		}
+		serv, err := s.config.decodeService(n)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", n.Key, err)
+		}
+		name := Domain(n.Key)
+		if serv.Priority == 0 {
+			serv.Priority = int(s.config.Priority)
+		}
+		ip := net.ParseIP(serv.Host)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			rrs = append(rrs, serv.NewA(name, serv.ttl, ip.To4()))
+			serv.Host = name
+		default:
+			rrs = append(rrs, serv.NewAAAA(name, serv.ttl, ip.To16()))
+			serv.Host = name
+		}
+		if serv.Host != "" {
+			rrs = append(rrs, serv.NewSRV(name, serv.ttl, 100))
+		}
+		if serv.Naptr != nil {
+			rrs = append(rrs, serv.NewNAPTR(name, serv.ttl))
+		}
+		if serv.Tlsa != nil {
+			rrs = append(rrs, serv.NewTLSA(name, serv.ttl))
+		}
+		rrs = append(rrs, serv.NewSSHFP(name, serv.ttl)...)
+		raw, err := serv.NewRR(name, serv.ttl, dns.TypeANY)
+		if err != nil {
+			s.config.log.Warningf("%s", err.Error())
+		}
+		rrs = append(rrs, raw...)
+	}
+	return rrs, nil
+}
+
+// byName sorts records on their owner name, with the labels compared from
+// right to left, so the records of a subtree are kept together.
+type byName []dns.RR
+
+func (b byName) Len() int      { return len(b) }
+func (b byName) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool {
+	ni, nj := reverseName(b[i].Header().Name), reverseName(b[j].Header().Name)
+	if ni == nj {
+		return b[i].Header().Rrtype < b[j].Header().Rrtype
+	}
+	return ni < nj
+}
+
+func reverseName(name string) string {
+	l := dns.SplitDomainName(strings.ToLower(name))
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
+	}
+	return strings.Join(l, ".")
+}
+
+// importZone reads the zone master file in r and creates the etcd keys for the
+// records in the domain: A and AAAA records become services with the address
+// as host, SRV records services with the target, port and priority. An SRV
+// record whose target is its own name, as written by exportZone, is merged with
+// the addresses of that name. Names with more than one service get a numbered
+// key for each. The SOA and NS records of the domain and other types are
+// skipped. Existing keys are never overwritten, they are reported as
+// collisions. Services that fail validate, like an SRV record with the root as
+// target (no service), are reported and skipped. With dryRun nothing is
+// written to etcd. What is done (or would be) is reported to w.
+func (s *server) importZone(r io.Reader, file string, dryRun bool, w io.Writer) error {
+	addrs := make(map[string][]string)
+	srvs := make(map[string][]*dns.SRV)
+	var names []string
+	seen := make(map[string]bool)
+	for t := range dns.ParseZone(r, s.config.Domain, file) {
+		if t.Error != nil {
+			return t.Error
+		}
+		h := t.RR.Header()
+		h.Name = strings.ToLower(h.Name)
+		if !dns.IsSubDomain(s.config.Domain, h.Name) {
+			fmt.Fprintf(w, "skip %s: not in %s\n", t.RR, s.config.Domain)
+			continue
+		}
+		if strings.Contains(h.Name, "*") {
+			fmt.Fprintf(w, "skip %s: wildcards are not supported\n", t.RR)
+			continue
+		}
+		switch rr := t.RR.(type) {
+		case *dns.A:
+			addrs[h.Name] = append(addrs[h.Name], rr.A.String())
+		case *dns.AAAA:
+			addrs[h.Name] = append(addrs[h.Name], rr.AAAA.String())
+		case *dns.SRV:
+			srvs[h.Name] = append(srvs[h.Name], rr)
+		case *dns.SOA, *dns.NS:
+			if h.Name == s.config.Domain || strings.HasSuffix(h.Name, ".dns."+s.config.Domain) {
+				continue // synthesized by SkyDNS
+			}
+			fmt.Fprintf(w, "skip %s: type not supported\n", t.RR)
+			continue
+		default:
+			fmt.Fprintf(w, "skip %s: type not supported\n", t.RR)
+			continue
+		}
+		if !seen[h.Name] {
+			seen[h.Name] = true
+			names = append(names, h.Name)
+		}
+	}
+
+	created, collisions, invalid := 0, 0, 0
+	for _, name := range names {
+		if strings.HasSuffix(name, ".dns."+s.config.Domain) {
+			continue // the glue of the synthesized nameservers
+		}
+		var services []*Service
+		merged := false
+		for _, srv := range srvs[name] {
+			target := strings.ToLower(srv.Target)
+			if target == name && len(addrs[name]) > 0 {
+				for _, a := range addrs[name] {
+					services = append(services, &Service{Host: a, Port: int(srv.Port), Priority: int(srv.Priority)})
+				}
+				merged = true
+				continue
+			}
+			services = append(services, &Service{Host: strings.TrimSuffix(srv.Target, "."), Port: int(srv.Port), Priority: int(srv.Priority)})
+		}
+		if !merged {
+			for _, a := range addrs[name] {
+				services = append(services, &Service{Host: a})
+			}
+		}
+
+		path, _ := Path(name)
+		for i, serv := range services {
+			key := path
+			if len(services) > 1 {
+				key = fmt.Sprintf("%s/%d", path, i+1)
+			}
+			if problems := serv.validate(name); len(problems) > 0 {
+				fmt.Fprintf(w, "invalid %s: %s\n", key, strings.Join(problems, "; "))
+				invalid++
+				continue
+			}
+			serv.Version = serviceVersion
+			b, _ := json.Marshal(serv)
+			if dryRun {
+				if _, err := s.client.Get(key, false, false); err == nil {
+					fmt.Fprintf(w, "collision %s: key exists\n", key)
+					collisions++
+					continue
+				}
+				fmt.Fprintf(w, "create %s %s\n", key, b)
+				created++
+				continue
+			}
+			if _, err := s.client.Create(key, string(b), 0); err != nil {
+				fmt.Fprintf(w, "collision %s: %s\n", key, err)
+				collisions++
+				continue
+			}
+			s.audit.record("import", "create", key, "", string(b), 0)
+			fmt.Fprintf(w, "create %s %s\n", key, b)
+			created++
+		}
+	}
+	fmt.Fprintf(w, "%d keys created, %d collisions, %d invalid\n", created, collisions, invalid)
+	return nil
+}